@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// the boot rom lives where it does on common boards
+const BoardBootromAddr = 0x1000
+
+var ErrBootromOverlap = errors.New("the boot rom overlaps the loaded image")
+
+// bootrom assembles a boot rom that jumps to entry with hartId in a0 and
+// the address of the device tree in a1. The hart id is part of the rom
+// rather than read from mhartid, with an SBI the rom runs in supervisor
+// mode where mhartid isn't accessible.
+func bootrom(entry, dtb, hartId uint32) []uint8 {
+	code := []uint32{
+		// auipc t0, 0
+		RegT0<<7 | OP_AUIPC,
+		encodeI(OP_LOAD, RegA0, 2, RegT0, 20),
+		encodeI(OP_LOAD, RegA1, 2, RegT0, 24),
+		encodeI(OP_LOAD, RegT0, 2, RegT0, 28),
+		encodeI(OP_JALR, RegZero, 0, RegT0, 0),
+		hartId,
+		dtb,
+		entry,
+	}
+	rom := make([]uint8, len(code)*4)
+	for i, word := range code {
+		binary.LittleEndian.PutUint32(rom[i*4:], word)
+	}
+	return rom
+}
+
+// EnableBootrom maps a read only boot rom at BoardBootromAddr and resets
+// into it. Like on real boards the rom passes the hart id in a0 and dtb
+// in a1 and jumps to the image's entry point. The hart id is the one set
+// when the rom is enabled.
+func (b *Board) EnableBootrom(dtb uint32) error {
+	rom := bootrom(b.cpu.initialAddr, dtb, b.cpu.hartId)
+	err := b.mmu.AddRange(BoardBootromAddr, uint32(len(rom)), NewRom(rom))
+	if err == ErrRangeOverlap {
+		return ErrBootromOverlap
+	} else if err != nil {
+		return err
+	}
+	b.cpu.initialAddr = BoardBootromAddr
+	b.cpu.Reset()
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBootrom(t *testing.T) {
+	prog := `
+	mv s0, a0
+	mv s1, a1
+	auipc s2, 0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog)).board
+	cpu := board.Cpu()
+	cpu.SetHartId(2)
+	if err := board.EnableBootrom(0x87e00000); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertPcEq(t, cpu, BoardBootromAddr)
+	if r, _ := board.Mmu().findRange(BoardBootromAddr); r == nil || r.Perm != PermR|PermX {
+		t.Errorf("expected a read only rom got %+v", r)
+	}
+	cpu.Execute()
+	assertRegEq(t, cpu, RegS0, 2)
+	assertRegEq(t, cpu, RegS1, 0x87e00000)
+	// the image ran from where it was loaded
+	assertRegEq(t, cpu, RegS2, BoardInitialAddr+8)
+
+	// resetting goes through the boot rom again
+	cpu.Reset()
+	assertPcEq(t, cpu, BoardBootromAddr)
+}
+
+func TestBootromSbi(t *testing.T) {
+	prog := `
+	mv s0, a0
+	li a7, {{.shutdown}}
+	ecall
+	`
+	prog = NewProgTemplate(prog).Execute(ProgArgs{"shutdown": SbiShutdown})
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog)).board
+	cpu := board.Cpu()
+	cpu.SetHartId(3)
+	if err := board.EnableBootrom(0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// with an SBI the rom runs in supervisor mode
+	board.EnableSbi()
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	if cpu.LastFault() != nil {
+		t.Fatalf("unexpected exception: %s", cpu.LastFault())
+	}
+	assertRegEq(t, cpu, RegS0, 3)
+}
+
+func TestBootromOverlap(t *testing.T) {
+	board := NewBoard([]uint8{0x13, 0, 0, 0}, nil, nil)
+	board.Mmu().AddRange(BoardBootromAddr+8, 4, NewRam(4))
+	if err := board.EnableBootrom(0); err != ErrBootromOverlap {
+		t.Errorf("expected ErrBootromOverlap got %v", err)
+	}
+	assertPcEq(t, board.Cpu(), BoardInitialAddr)
+}
@@ -0,0 +1,85 @@
+package main
+
+// AddBreakpoint makes the cpu halt before executing the instruction at
+// addr, guest memory is left untouched
+func (cpu *Cpu) AddBreakpoint(addr uint32) {
+	if cpu.breakpoints == nil {
+		cpu.breakpoints = map[uint32]bool{}
+	}
+	cpu.breakpoints[addr] = true
+}
+
+// RemoveBreakpoint removes a breakpoint added with AddBreakpoint and
+// reports if it was found
+func (cpu *Cpu) RemoveBreakpoint(addr uint32) bool {
+	if !cpu.breakpoints[addr] {
+		return false
+	}
+	delete(cpu.breakpoints, addr)
+	return true
+}
+
+// BreakpointHit tells if the cpu halted on a breakpoint, the pc is the
+// address of the breakpoint
+func (cpu *Cpu) BreakpointHit() bool {
+	return cpu.breakHit
+}
+
+// ClearBreakpointHit lets a cpu halted by a breakpoint continue, the
+// next step executes the instruction at the pc even if it has a
+// breakpoint
+func (cpu *Cpu) ClearBreakpointHit() {
+	if cpu.breakHit {
+		cpu.breakHit = false
+		cpu.halt = false
+	}
+	cpu.resuming = true
+}
+
+// checkBreakpoint halts the cpu if there is a breakpoint at the pc
+func (cpu *Cpu) checkBreakpoint() bool {
+	resuming := cpu.resuming
+	cpu.resuming = false
+	if resuming || !cpu.breakpoints[cpu.pc] {
+		return false
+	}
+	cpu.breakHit = true
+	cpu.halt = true
+	return true
+}
+
+// BreakpointCallback is called by a callback breakpoint, it may change
+// the state of the cpu and its memory
+type BreakpointCallback func(cpu *Cpu)
+
+// AddCallbackBreakpoint makes the cpu call cb when it reaches addr and
+// then continue. When cb moves the pc, for example to ra to stub a
+// function, the instruction at addr isn't executed.
+func (cpu *Cpu) AddCallbackBreakpoint(addr uint32, cb BreakpointCallback) {
+	if cpu.callbacks == nil {
+		cpu.callbacks = map[uint32]BreakpointCallback{}
+	}
+	cpu.callbacks[addr] = cb
+}
+
+// RemoveCallbackBreakpoint removes a breakpoint added with
+// AddCallbackBreakpoint and reports if it was found
+func (cpu *Cpu) RemoveCallbackBreakpoint(addr uint32) bool {
+	if _, ok := cpu.callbacks[addr]; !ok {
+		return false
+	}
+	delete(cpu.callbacks, addr)
+	return true
+}
+
+// runCallback calls the callback breakpoint at the pc and tells if it
+// ended the step by moving the pc or halting
+func (cpu *Cpu) runCallback() bool {
+	cb, ok := cpu.callbacks[cpu.pc]
+	if !ok {
+		return false
+	}
+	pc := cpu.pc
+	cb(cpu)
+	return cpu.halt || cpu.pc != pc
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBreakpoint(t *testing.T) {
+	prog := `
+	li a0, 1
+	li a1, 2
+	target:
+	li a2, 3
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	target := cpu.initialAddr + 8
+	inst := cpu.LoadWord(target)
+	cpu.AddBreakpoint(target)
+	cpu.Execute()
+
+	if !cpu.BreakpointHit() {
+		t.Fatalf("expected a breakpoint hit")
+	}
+	assertPcEq(t, cpu, target)
+	assertRegEq(t, cpu, RegA0, 1)
+	assertRegEq(t, cpu, RegA1, 2)
+	assertRegEq(t, cpu, RegA2, 0)
+	if v := cpu.LoadWord(target); v != inst {
+		t.Errorf("breakpoint changed guest memory to 0x%08x", v)
+	}
+
+	// resuming executes the instruction under the breakpoint
+	cpu.ClearBreakpointHit()
+	cpu.Execute()
+	if cpu.BreakpointHit() {
+		t.Errorf("unexpected breakpoint hit")
+	}
+	assertRegEq(t, cpu, RegA2, 3)
+	assertCsrEq(t, cpu, CsrHalt, 1)
+
+	if !cpu.RemoveBreakpoint(target) || cpu.RemoveBreakpoint(target) {
+		t.Errorf("expected the breakpoint to be removed once")
+	}
+}
+
+func TestCallbackBreakpoint(t *testing.T) {
+	prog := `
+	li a0, 7
+	jal ra, square
+	mv s1, a0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	square:
+	li a0, -1
+	ret
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	square := cpu.initialAddr + 5*4
+	calls := 0
+	cpu.AddCallbackBreakpoint(square, func(cpu *Cpu) {
+		calls++
+		a0 := cpu.GetReg(RegA0)
+		cpu.SetReg(RegA0, a0*a0)
+		cpu.SetPc(cpu.GetReg(RegRA))
+	})
+	cpu.Execute()
+
+	if calls != 1 {
+		t.Errorf("expected the callback to be called once got %d", calls)
+	}
+	if cpu.BreakpointHit() {
+		t.Errorf("a callback breakpoint should not halt")
+	}
+	assertRegEq(t, cpu, RegS1, 49)
+	assertCsrEq(t, cpu, CsrHalt, 1)
+
+	if !cpu.RemoveCallbackBreakpoint(square) || cpu.RemoveCallbackBreakpoint(square) {
+		t.Errorf("expected the callback breakpoint to be removed once")
+	}
+}
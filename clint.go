@@ -0,0 +1,79 @@
+package main
+
+// The core local interruptor holds the machine timer and the software
+// interrupt, it is laid out like the SiFive CLINT so existing guests find
+// msip, mtime and mtimecmp where they expect them
+const (
+	BoardClintAddr = 0x02000000
+	ClintSize      = 0x10000
+	ClintMsip      = 0x0
+	ClintMtimecmp  = 0x4000
+	ClintMtime     = 0xbff8
+)
+
+type Clint struct {
+	cpu *Cpu
+}
+
+func NewClint(cpu *Cpu) *Clint {
+	return &Clint{cpu}
+}
+
+func (c *Clint) LoadWord(addr uint32) uint32 {
+	switch addr {
+	case ClintMsip:
+		if c.cpu.msip {
+			return 1
+		}
+	case ClintMtimecmp:
+		return uint32(c.cpu.mtimecmp)
+	case ClintMtimecmp + 4:
+		return uint32(c.cpu.mtimecmp >> 32)
+	case ClintMtime:
+		return uint32(c.cpu.ticks)
+	case ClintMtime + 4:
+		return uint32(c.cpu.ticks >> 32)
+	}
+
+	return 0
+}
+
+func (c *Clint) LoadHalfWord(addr uint32) uint16 {
+	return uint16(c.LoadWord(addr&^3) >> (8 * (addr & 3)))
+}
+
+func (c *Clint) LoadByte(addr uint32) uint8 {
+	return uint8(c.LoadWord(addr&^3) >> (8 * (addr & 3)))
+}
+
+func (c *Clint) StoreWord(addr uint32, v uint32) {
+	switch addr {
+	case ClintMsip:
+		// only the lowest bit is implemented
+		c.cpu.msip = v&1 != 0
+	case ClintMtimecmp:
+		c.cpu.mtimecmp = c.cpu.mtimecmp&^0xffffffff | uint64(v)
+	case ClintMtimecmp + 4:
+		c.cpu.mtimecmp = c.cpu.mtimecmp&0xffffffff | uint64(v)<<32
+	case ClintMtime:
+		c.cpu.ticks = c.cpu.ticks&^0xffffffff | uint64(v)
+	case ClintMtime + 4:
+		c.cpu.ticks = c.cpu.ticks&0xffffffff | uint64(v)<<32
+	}
+}
+
+// narrow stores are merged into the word they fall in
+func (c *Clint) storeBits(addr uint32, v uint32, mask uint32) {
+	shift := 8 * (addr & 3)
+	word := c.LoadWord(addr &^ 3)
+	word = word&^(mask<<shift) | (v&mask)<<shift
+	c.StoreWord(addr&^3, word)
+}
+
+func (c *Clint) StoreHalfWord(addr uint32, v uint16) {
+	c.storeBits(addr, uint32(v), 0xffff)
+}
+
+func (c *Clint) StoreByte(addr uint32, v uint8) {
+	c.storeBits(addr, uint32(v), 0xff)
+}
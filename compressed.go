@@ -0,0 +1,264 @@
+package main
+
+// compressed instructions are told apart by their quadrant, the low 2
+// bits, and their funct3, the top 3 bits
+const (
+	C_QUADRANT_0 = 0x0
+	C_QUADRANT_1 = 0x1
+	C_QUADRANT_2 = 0x2
+)
+
+// QUADRANT 0
+const (
+	C_FUNCT_ADDI4SPN = 0x0
+	C_FUNCT_LW       = 0x2
+	C_FUNCT_SW       = 0x6
+)
+
+// QUADRANT 1
+const (
+	C_FUNCT_ADDI = 0x0
+	C_FUNCT_JAL  = 0x1
+	C_FUNCT_LI   = 0x2
+	C_FUNCT_LUI  = 0x3
+	C_FUNCT_MISC = 0x4
+	C_FUNCT_J    = 0x5
+	C_FUNCT_BEQZ = 0x6
+	C_FUNCT_BNEZ = 0x7
+)
+
+// QUADRANT 2
+const (
+	C_FUNCT_SLLI = 0x0
+	C_FUNCT_LWSP = 0x2
+	C_FUNCT_JR   = 0x4
+	C_FUNCT_SWSP = 0x6
+)
+
+func encodeI(opcode, rd, funct3, rs1, imm uint32) uint32 {
+	return (imm&0xfff)<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeS(opcode, funct3, rs1, rs2, imm uint32) uint32 {
+	return bitrange(imm, 5, 7)<<25 | rs2<<20 | rs1<<15 | funct3<<12 |
+		bitrange(imm, 0, 5)<<7 | opcode
+}
+
+func encodeR(opcode, rd, funct3, rs1, rs2, funct7 uint32) uint32 {
+	return funct7<<25 | rs2<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeB(funct3, rs1, rs2, imm uint32) uint32 {
+	return bitrange(imm, 12, 1)<<31 | bitrange(imm, 5, 6)<<25 | rs2<<20 |
+		rs1<<15 | funct3<<12 | bitrange(imm, 1, 4)<<8 |
+		bitrange(imm, 11, 1)<<7 | OP_BRANCH
+}
+
+func encodeJ(rd, imm uint32) uint32 {
+	return bitrange(imm, 20, 1)<<31 | bitrange(imm, 1, 10)<<21 |
+		bitrange(imm, 11, 1)<<20 | bitrange(imm, 12, 8)<<12 | rd<<7 | OP_JAL
+}
+
+// cImm6 is the sign extended 6 bit immediate shared by c.addi, c.li,
+// c.andi and the shifts
+func cImm6(c uint32) uint32 {
+	return signExtend(bitrange(c, 12, 1)<<5|bitrange(c, 2, 5), 5)
+}
+
+// cPrime is a 3 bit register field, it addresses x8-x15
+func cPrime(c uint32, fromBit uint) uint32 {
+	return bitrange(c, fromBit, 3) + 8
+}
+
+// cjImm is the offset of c.j and c.jal
+func cjImm(c uint32) uint32 {
+	var imm uint32
+	imm |= bitrange(c, 12, 1) << 11
+	imm |= bitrange(c, 11, 1) << 4
+	imm |= bitrange(c, 9, 2) << 8
+	imm |= bitrange(c, 8, 1) << 10
+	imm |= bitrange(c, 7, 1) << 6
+	imm |= bitrange(c, 6, 1) << 7
+	imm |= bitrange(c, 3, 3) << 1
+	imm |= bitrange(c, 2, 1) << 5
+	return signExtend(imm, 11)
+}
+
+// cbImm is the offset of c.beqz and c.bnez
+func cbImm(c uint32) uint32 {
+	var imm uint32
+	imm |= bitrange(c, 12, 1) << 8
+	imm |= bitrange(c, 10, 2) << 3
+	imm |= bitrange(c, 5, 2) << 6
+	imm |= bitrange(c, 3, 2) << 1
+	imm |= bitrange(c, 2, 1) << 5
+	return signExtend(imm, 8)
+}
+
+// expandCompressed translates a compressed instruction to the 32 bit
+// instruction it stands for. Reserved encodings and the floating point
+// instructions are reported as illegal.
+func expandCompressed(parcel uint16) (uint32, bool) {
+	c := uint32(parcel)
+	funct3 := bitrange(c, 13, 3)
+	switch bitrange(c, 0, 2) {
+	case C_QUADRANT_0:
+		return expandQuadrant0(c, funct3)
+	case C_QUADRANT_1:
+		return expandQuadrant1(c, funct3)
+	case C_QUADRANT_2:
+		return expandQuadrant2(c, funct3)
+	}
+	return 0, false
+}
+
+func expandQuadrant0(c, funct3 uint32) (uint32, bool) {
+	// the word offset of c.lw and c.sw, uimm[5:3] uimm[2|6]
+	offset := bitrange(c, 10, 3)<<3 | bitrange(c, 6, 1)<<2 |
+		bitrange(c, 5, 1)<<6
+	switch funct3 {
+	case C_FUNCT_ADDI4SPN:
+		// nzuimm[5:4|9:6|2|3]
+		var imm uint32
+		imm |= bitrange(c, 11, 2) << 4
+		imm |= bitrange(c, 7, 4) << 6
+		imm |= bitrange(c, 6, 1) << 2
+		imm |= bitrange(c, 5, 1) << 3
+		if imm == 0 {
+			// reserved, this includes the all zeroes parcel
+			return 0, false
+		}
+		return encodeI(OP_IMM, cPrime(c, 2), FUNCT_ADDI, RegSP, imm), true
+	case C_FUNCT_LW:
+		return encodeI(OP_LOAD, cPrime(c, 2), 2, cPrime(c, 7), offset), true
+	case C_FUNCT_SW:
+		return encodeS(OP_STORE, 2, cPrime(c, 7), cPrime(c, 2), offset), true
+	}
+	return 0, false
+}
+
+func expandQuadrant1(c, funct3 uint32) (uint32, bool) {
+	rd := bitrange(c, 7, 5)
+	switch funct3 {
+	case C_FUNCT_ADDI:
+		// rd == x0 is c.nop, a zero immediate is a hint
+		return encodeI(OP_IMM, rd, FUNCT_ADDI, rd, cImm6(c)), true
+	case C_FUNCT_JAL:
+		return encodeJ(RegRA, cjImm(c)), true
+	case C_FUNCT_LI:
+		// rd == x0 is a hint
+		return encodeI(OP_IMM, rd, FUNCT_ADDI, RegZero, cImm6(c)), true
+	case C_FUNCT_LUI:
+		if rd == RegSP {
+			// c.addi16sp, nzimm[9] nzimm[4|6|8:7|5]
+			var imm uint32
+			imm |= bitrange(c, 12, 1) << 9
+			imm |= bitrange(c, 6, 1) << 4
+			imm |= bitrange(c, 5, 1) << 6
+			imm |= bitrange(c, 3, 2) << 7
+			imm |= bitrange(c, 2, 1) << 5
+			if imm == 0 {
+				// reserved
+				return 0, false
+			}
+			return encodeI(OP_IMM, RegSP, FUNCT_ADDI, RegSP,
+				signExtend(imm, 9)), true
+		}
+
+		// c.lui, nzimm[17] nzimm[16:12]
+		imm := bitrange(c, 12, 1)<<5 | bitrange(c, 2, 5)
+		if imm == 0 {
+			// reserved
+			return 0, false
+		}
+		// rd == x0 is a hint, it expands to a lui that discards the result
+		imm = signExtend(imm, 5) & 0xfffff
+		return imm<<12 | rd<<7 | OP_LUI, true
+	case C_FUNCT_MISC:
+		rd := cPrime(c, 7)
+		switch bitrange(c, 10, 2) {
+		case 0, 1: // c.srli, c.srai
+			if bitrange(c, 12, 1) != 0 {
+				// shamt[5] must be 0 on RV32
+				return 0, false
+			}
+			imm := bitrange(c, 2, 5)
+			if bitrange(c, 10, 2) == 1 {
+				imm |= 0x400
+			}
+			return encodeI(OP_IMM, rd, FUNCT_SRXI, rd, imm), true
+		case 2: // c.andi
+			return encodeI(OP_IMM, rd, FUNCT_ANDI, rd, cImm6(c)), true
+		}
+		if bitrange(c, 12, 1) != 0 {
+			// c.subw and c.addw are RV64 only
+			return 0, false
+		}
+		rs2 := cPrime(c, 2)
+		switch bitrange(c, 5, 2) {
+		case 0:
+			return encodeR(OP, rd, FUNCT_ADD_SUB, rd, rs2, 0x20), true
+		case 1:
+			return encodeR(OP, rd, FUNCT_XOR, rd, rs2, 0), true
+		case 2:
+			return encodeR(OP, rd, FUNCT_OR, rd, rs2, 0), true
+		case 3:
+			return encodeR(OP, rd, FUNCT_AND, rd, rs2, 0), true
+		}
+	case C_FUNCT_J:
+		return encodeJ(RegZero, cjImm(c)), true
+	case C_FUNCT_BEQZ:
+		return encodeB(FUNCT_BEQ, cPrime(c, 7), RegZero, cbImm(c)), true
+	case C_FUNCT_BNEZ:
+		return encodeB(FUNCT_BNE, cPrime(c, 7), RegZero, cbImm(c)), true
+	}
+	return 0, false
+}
+
+func expandQuadrant2(c, funct3 uint32) (uint32, bool) {
+	rd := bitrange(c, 7, 5)
+	rs2 := bitrange(c, 2, 5)
+	switch funct3 {
+	case C_FUNCT_SLLI:
+		if bitrange(c, 12, 1) != 0 {
+			// shamt[5] must be 0 on RV32
+			return 0, false
+		}
+		return encodeI(OP_IMM, rd, FUNCT_SLLI, rd, rs2), true
+	case C_FUNCT_LWSP:
+		if rd == RegZero {
+			// reserved
+			return 0, false
+		}
+		// uimm[5] uimm[4:2|7:6]
+		offset := bitrange(c, 12, 1)<<5 | bitrange(c, 4, 3)<<2 |
+			bitrange(c, 2, 2)<<6
+		return encodeI(OP_LOAD, rd, 2, RegSP, offset), true
+	case C_FUNCT_JR:
+		if bitrange(c, 12, 1) == 0 {
+			if rs2 != 0 {
+				// c.mv
+				return encodeR(OP, rd, FUNCT_ADD_SUB, RegZero, rs2, 0), true
+			}
+			if rd == RegZero {
+				// reserved
+				return 0, false
+			}
+			return encodeI(OP_JALR, RegZero, 0, rd, 0), true
+		}
+		if rs2 != 0 {
+			// c.add
+			return encodeR(OP, rd, FUNCT_ADD_SUB, rd, rs2, 0), true
+		}
+		if rd == RegZero {
+			return encodeI(OP_SYSTEM, 0, FUNCT_PRIV, 0, PRIV_EBREAK), true
+		}
+		// c.jalr
+		return encodeI(OP_JALR, RegRA, 0, rd, 0), true
+	case C_FUNCT_SWSP:
+		// uimm[5:2|7:6]
+		offset := bitrange(c, 9, 4)<<2 | bitrange(c, 7, 2)<<6
+		return encodeS(OP_STORE, 2, RegSP, rs2, offset), true
+	}
+	return 0, false
+}
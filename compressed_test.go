@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpandCompressedLui(t *testing.T) {
+	tests := []struct {
+		parcel uint16
+		inst   uint32
+		ok     bool
+	}{
+		// c.lui a0, 1
+		{0x6505, 0x00001537, true},
+		// c.lui a0, 0xfffff
+		{0x757d, 0xfffff537, true},
+		// c.lui x0, 1 is a hint
+		{0x6005, 0x00001037, true},
+		// c.addi16sp sp, 16
+		{0x6141, 0x01010113, true},
+		// c.addi16sp sp, -512
+		{0x7101, 0xe0010113, true},
+		// c.lui a0, 0 is reserved
+		{0x6501, 0, false},
+		// c.addi16sp sp, 0 is reserved
+		{0x6101, 0, false},
+	}
+	for _, test := range tests {
+		inst, ok := expandCompressed(test.parcel)
+		if ok != test.ok {
+			t.Errorf("expected ok %v for 0x%04x got %v",
+				test.ok, test.parcel, ok)
+		}
+		if inst != test.inst {
+			t.Errorf("expected 0x%08x for 0x%04x got 0x%08x",
+				test.inst, test.parcel, inst)
+		}
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	prog := `
+	.option norelax
+	.option rvc
+	c.li a0, 5
+	addi a1, x0, 100
+	c.addi a0, 3
+	c.mv a2, a1
+	c.add a2, a0
+	la s0, data
+	c.sw a2, 0(s0)
+	c.lw a3, 4(s0)
+	c.beqz a0, fail
+	c.j over
+	fail:
+	c.li a0, 0
+	over:
+	c.srli a3, 4
+	c.li t1, 1
+	csrrw x0, 0x3ff, t1
+	.p2align 2
+	data:
+	.word 0
+	.word 0x120
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	// the first instructions alternate between 2 and 4 bytes
+	for _, pc := range []uint32{0x102, 0x106, 0x108, 0x10a, 0x10c} {
+		cpu.Step()
+		assertPcEq(t, cpu, pc)
+	}
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	if cpu.LastFault() != nil {
+		t.Fatalf("unexpected exception: %s", cpu.LastFault())
+	}
+	assertRegEq(t, cpu, RegA0, 8)
+	assertRegEq(t, cpu, RegA2, 108)
+	assertRegEq(t, cpu, RegA3, 0x12)
+	if v := cpu.LoadWord(cpu.GetReg(RegS0)); v != 108 {
+		t.Errorf("expected c.sw to store 108 got %d", v)
+	}
+}
+
+func TestCompressedShifts(t *testing.T) {
+	tests := []struct {
+		op  string
+		imm int32
+	}{
+		{"slli", 1},
+		{"slli", 31},
+		{"srli", 4},
+		{"srli", 31},
+		{"srai", 4},
+		{"srai", 31},
+		{"andi", 0x1f},
+		{"andi", -8},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %d", test.op, test.imm), func(t *testing.T) {
+			prog := NewProgTemplate(`
+			.option rvc
+			li a0, 0x80f0f0f5
+			c.{{.op}} a0, {{.imm}}
+			mv a1, a0
+			li a0, 0x80f0f0f5
+			{{.op}} a0, a0, {{.imm}}
+			li t1, 1
+			csrrw x0, 0x3ff, t1
+			`).Execute(ProgArgs{"op": test.op, "imm": test.imm})
+			t.Log("prog: ", prog)
+			cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+			cpu.Execute()
+			if cpu.LastFault() != nil {
+				t.Fatalf("unexpected exception: %s", cpu.LastFault())
+			}
+			assertRegEq(t, cpu, RegA1, cpu.GetReg(RegA0))
+		})
+	}
+}
+
+func TestIllegalCompressed(t *testing.T) {
+	tests := []uint16{
+		// all zeroes
+		0x0000,
+		// c.lui a0, 0
+		0x6501,
+		// c.addi16sp sp, 0
+		0x6101,
+		// c.lwsp x0, 0(sp)
+		0x4002,
+		// c.jr x0
+		0x8002,
+		// c.slli a0, 32 is for custom extensions on RV32
+		0x1502,
+		// c.srli a0, 32
+		0x9101,
+		// c.srai a0, 32
+		0x9501,
+		// c.flw
+		0x6000,
+	}
+	for _, parcel := range tests {
+		prog := []uint8{uint8(parcel), uint8(parcel >> 8), 0, 0}
+		cpu := NewDebugBoard(prog).Cpu()
+		cpu.SetHaltOnException(true)
+		cpu.Step()
+		fault := cpu.LastFault()
+		if fault == nil || fault.Cause != ExceptionIllegalInstruction {
+			t.Errorf("expected 0x%04x to be illegal got %v", parcel, fault)
+			continue
+		}
+		if fault.Tval != uint32(parcel) {
+			t.Errorf("expected tval 0x%04x got 0x%08x", parcel, fault.Tval)
+		}
+	}
+}
+
+func TestTrailingParcel(t *testing.T) {
+	tests := []struct {
+		name string
+		prog []uint8
+		// the pc of the fetch that faults
+		fault uint32
+	}{
+		// c.nop fits in the last 2 bytes, the fault is past it
+		{"compressed", []uint8{0x13, 0, 0, 0, 0x01, 0}, 0x106},
+		// the first half of a nop, the rest is past the end
+		{"truncated", []uint8{0x13, 0, 0, 0, 0x13, 0}, 0x104},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cpu := NewDebugBoard(test.prog).Cpu()
+			for i := 0; i < 3 && cpu.LastFault() == nil; i++ {
+				cpu.Step()
+			}
+			assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionInstructionAccessFault)
+			assertCsrEq(t, cpu, CsrTval|CsrM, test.fault)
+		})
+	}
+}
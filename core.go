@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	_CoreElfHeaderSize     = 52
+	_CoreProgHeaderSize    = 32
+	_CorePrstatusSize      = 204
+	_CorePrstatusRegOffset = 72
+)
+
+// prstatus renders an NT_PRSTATUS note descriptor using the 32 bit linux
+// elf_prstatus layout, only the registers are filled in
+func (cpu *Cpu) prstatus(pc uint32) []uint8 {
+	desc := make([]uint8, _CorePrstatusSize)
+	regs := desc[_CorePrstatusRegOffset:]
+	// the riscv gregset starts with the pc in place of x0
+	binary.LittleEndian.PutUint32(regs, pc)
+	for i := uint8(1); i < 32; i++ {
+		binary.LittleEndian.PutUint32(regs[4*uint32(i):], cpu.GetReg(i))
+	}
+	return desc
+}
+
+func coreNote(name string, typ uint32, desc []uint8) []uint8 {
+	var note bytes.Buffer
+	namesz := uint32(len(name) + 1)
+	binary.Write(&note, binary.LittleEndian,
+		[]uint32{namesz, uint32(len(desc)), typ})
+	note.WriteString(name)
+	// the name and descriptor are padded to 4 bytes
+	note.Write(make([]uint8, 4-len(name)%4))
+	note.Write(desc)
+	note.Write(make([]uint8, (4-len(desc)%4)%4))
+	return note.Bytes()
+}
+
+// coreSegment is a PT_LOAD segment of a core dump, its contents are the
+// concatenation of chunks, or read from the memory of r when there are
+// none
+type coreSegment struct {
+	r      Range
+	addr   uint32
+	size   uint32
+	chunks [][]uint8
+}
+
+// coreSegments returns the segments holding the contents of r. Ram is
+// dumped as it is, paged memories get a segment per run of allocated
+// pages, the rest reads as zero, and other memories are read a page at a
+// time as they are written out.
+func coreSegments(r Range) []coreSegment {
+	switch mem := r.Memory.(type) {
+	case *Ram:
+		return []coreSegment{{r, r.Addr, r.Size, [][]uint8{mem.memory[:r.Size]}}}
+	case pagedMemory:
+		var segments []coreSegment
+		prev := ^uint32(0)
+		for _, idx := range mem.allocated() {
+			addr := idx * LazyRamPageSize
+			if addr >= r.Size {
+				break
+			}
+			page, _ := mem.page(addr, false)
+			if r.Size-addr < LazyRamPageSize {
+				page = page[:r.Size-addr]
+			}
+			if len(segments) == 0 || idx != prev+1 {
+				segments = append(segments, coreSegment{r: r, addr: r.Addr + addr})
+			}
+			s := &segments[len(segments)-1]
+			s.size += uint32(len(page))
+			s.chunks = append(s.chunks, page)
+			prev = idx
+		}
+		return segments
+	}
+	return []coreSegment{{r: r, addr: r.Addr, size: r.Size}}
+}
+
+// writeTo writes the contents of the segment to w
+func (s coreSegment) writeTo(w io.Writer) error {
+	if s.chunks != nil {
+		for _, chunk := range s.chunks {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	buf := make([]uint8, LazyRamPageSize)
+	for off := uint64(0); off < uint64(s.size); off += LazyRamPageSize {
+		n := uint64(s.size) - off
+		if n > LazyRamPageSize {
+			n = LazyRamPageSize
+		}
+		base := s.addr - s.r.Addr + uint32(off)
+		for i := range buf[:n] {
+			buf[i] = s.r.Memory.LoadByte(base + uint32(i))
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteCore writes an elf core dump of the cpu registers and of the plain
+// memory mapped by the board, it can be loaded by gdb along with the
+// program's elf
+func (b *Board) WriteCore(w io.Writer) error {
+	pc := b.cpu.pc
+	if fault := b.cpu.LastFault(); fault != nil {
+		pc = fault.Epc
+	}
+	note := coreNote("CORE", uint32(elf.NT_PRSTATUS), b.cpu.prstatus(pc))
+
+	var segments []coreSegment
+	for _, r := range b.mmu.ranges {
+		if r.isRam {
+			segments = append(segments, coreSegments(r)...)
+		}
+	}
+
+	phnum := 1 + len(segments)
+	offset := uint32(_CoreElfHeaderSize + phnum*_CoreProgHeaderSize)
+	var out bytes.Buffer
+	header := elf.Header32{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     _CoreElfHeaderSize,
+		Ehsize:    _CoreElfHeaderSize,
+		Phentsize: _CoreProgHeaderSize,
+		Phnum:     uint16(phnum),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = uint8(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = uint8(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = uint8(elf.EV_CURRENT)
+	binary.Write(&out, binary.LittleEndian, header)
+
+	binary.Write(&out, binary.LittleEndian, elf.Prog32{
+		Type:   uint32(elf.PT_NOTE),
+		Off:    offset,
+		Filesz: uint32(len(note)),
+		Align:  4,
+	})
+	offset += uint32(len(note))
+	for _, s := range segments {
+		binary.Write(&out, binary.LittleEndian, elf.Prog32{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    offset,
+			Vaddr:  s.addr,
+			Paddr:  s.addr,
+			Filesz: s.size,
+			Memsz:  s.size,
+			Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+			Align:  1,
+		})
+		offset += s.size
+	}
+	out.Write(note)
+
+	// the headers are small, the memory is written out as it is read
+	if _, err := out.WriteTo(w); err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if err := s.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWriteCore(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 0x123
+	.word 0xffffffff
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	bin := assemble(t, prog)
+	board := NewDebugBoard(append([]uint8(nil), bin...))
+	board.Cpu().SetHaltOnException(true)
+	board.Cpu().Execute()
+
+	var core bytes.Buffer
+	if err := board.board.WriteCore(&core); err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(core.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != elf.ET_CORE || f.Machine != elf.EM_RISCV {
+		t.Fatalf("expected a riscv core got %s %s", f.Type, f.Machine)
+	}
+
+	var note, text *elf.Prog
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_NOTE {
+			note = p
+		} else if p.Type == elf.PT_LOAD && p.Vaddr == BoardInitialAddr {
+			text = p
+		}
+	}
+	if note == nil || text == nil {
+		t.Fatalf("expected a note and the program segment got %v", f.Progs)
+	}
+
+	data := make([]uint8, note.Filesz)
+	note.ReadAt(data, 0)
+	if typ := elf.NType(binary.LittleEndian.Uint32(data[8:])); typ != elf.NT_PRSTATUS {
+		t.Fatalf("expected an NT_PRSTATUS note got %s", typ)
+	}
+	// 12 bytes of header and "CORE" padded to 8 bytes
+	regs := data[20+_CorePrstatusRegOffset:]
+	if pc := binary.LittleEndian.Uint32(regs); pc != BoardInitialAddr+4 {
+		t.Errorf("expected pc 0x%08x got 0x%08x", BoardInitialAddr+4, pc)
+	}
+	if a0 := binary.LittleEndian.Uint32(regs[4*RegA0:]); a0 != 0x123 {
+		t.Errorf("expected a0 0x123 got 0x%08x", a0)
+	}
+
+	mem := make([]uint8, text.Filesz)
+	text.ReadAt(mem, 0)
+	if !bytes.Equal(mem, bin) {
+		t.Errorf("expected the program segment to hold the program")
+	}
+}
+
+// limitWriter fails once more than n bytes were written to it
+type limitWriter struct {
+	n int
+}
+
+var errWriteLimit = errors.New("write limit reached")
+
+func (w *limitWriter) Write(p []uint8) (int, error) {
+	if len(p) > w.n {
+		return 0, errWriteLimit
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteCoreError(t *testing.T) {
+	board := NewDebugBoard(make([]uint8, 4096))
+	// the headers fit, the memory doesn't
+	w := &limitWriter{1024}
+	if err := board.board.WriteCore(w); err != errWriteLimit {
+		t.Errorf("expected the writer's error got %v", err)
+	}
+}
+
+func TestWriteCoreSparse(t *testing.T) {
+	board := NewDebugBoard(make([]uint8, 4))
+	mem := NewSparseRam(0x40000000)
+	if err := board.board.mmu.AddRange(0x40000000, 0x40000000, mem); err != nil {
+		t.Fatal(err)
+	}
+	mem.StoreWord(0x10, 0x11111111)
+	mem.StoreWord(LazyRamPageSize+0x20, 0x22222222)
+	mem.StoreWord(0x100000, 0x33333333)
+
+	var core bytes.Buffer
+	if err := board.board.WriteCore(&core); err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(core.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type segment struct{ addr, size uint64 }
+	var segments []segment
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Vaddr >= 0x40000000 {
+			segments = append(segments, segment{p.Vaddr, p.Filesz})
+		}
+	}
+	expected := []segment{
+		{0x40000000, 2 * LazyRamPageSize},
+		{0x40100000, LazyRamPageSize},
+	}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Fatalf("expected segments %x got %x", expected, segments)
+	}
+	for addr, v := range map[uint64]uint32{
+		0x40000010:                          0x11111111,
+		0x40000000 + LazyRamPageSize + 0x20: 0x22222222,
+		0x40100000:                          0x33333333,
+	} {
+		for _, p := range f.Progs {
+			if p.Type != elf.PT_LOAD || addr < p.Vaddr || addr >= p.Vaddr+p.Filesz {
+				continue
+			}
+			data := make([]uint8, 4)
+			p.ReadAt(data, int64(addr-p.Vaddr))
+			if got := binary.LittleEndian.Uint32(data); got != v {
+				t.Errorf("expected 0x%08x at 0x%08x got 0x%08x", v, addr, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// Offsets of the 64 bit counters in the counters device
+const (
+	BoardCountersAddr = 0x02010000
+	CountersSize      = 0x18
+	CountersCycle     = 0x00
+	CountersInstret   = 0x08
+	CountersTime      = 0x10
+)
+
+// Counters exposes the performance counters as memory so guests that
+// can't access the counter csrs can still read them. Reading the low word
+// of a counter latches its high word, so reading the low and then the
+// high word gives a consistent 64 bit value. Any other read returns the
+// current value.
+type Counters struct {
+	cpu *Cpu
+	// the counter whose high word is latched, -1 if none is
+	latched int
+	high    uint32
+}
+
+func NewCounters(cpu *Cpu) *Counters {
+	return &Counters{cpu: cpu, latched: -1}
+}
+
+func (c *Counters) current(idx int) uint64 {
+	return [...]uint64{c.cpu.cycles, c.cpu.instret, c.cpu.ticks}[idx]
+}
+
+func (c *Counters) LoadWord(addr uint32) uint32 {
+	if addr >= CountersSize {
+		return 0
+	}
+
+	idx := int(addr / 8)
+	v := c.current(idx)
+	latched := c.latched
+	c.latched = -1
+	if addr%8 < 4 {
+		c.latched = idx
+		c.high = uint32(v >> 32)
+		return uint32(v >> (8 * (addr % 4)))
+	}
+	high := uint32(v >> 32)
+	if latched == idx {
+		high = c.high
+	}
+	return high >> (8 * (addr % 4))
+}
+
+func (c *Counters) LoadHalfWord(addr uint32) uint16 {
+	return uint16(c.LoadWord(addr))
+}
+
+func (c *Counters) LoadByte(addr uint32) uint8 {
+	return uint8(c.LoadWord(addr))
+}
+
+// the counters are read-only
+func (c *Counters) StoreWord(addr uint32, v uint32)     {}
+func (c *Counters) StoreHalfWord(addr uint32, v uint16) {}
+func (c *Counters) StoreByte(addr uint32, v uint8)      {}
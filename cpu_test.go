@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"text/template"
@@ -74,7 +77,11 @@ func assertRegEq(t *testing.T, cpu *Cpu, reg uint8, v uint32) bool {
 }
 
 func assertCsrEq(t *testing.T, cpu *Cpu, csr uint32, v uint32) bool {
-	regv := cpu.GetCsr(csr)
+	regv, ok := cpu.GetCsr(csr)
+	if !ok {
+		t.Errorf("expected csr 0x%03x to exist", csr)
+		return false
+	}
 	res := regv == v
 	if !res {
 		t.Errorf(("expected csr 0x%03x to have value 0x%08x" +
@@ -108,7 +115,21 @@ func disassemble(prog []byte) string {
 	fmt.Println(string(out))
 }
 */
-func compile(prog string) []byte {
+
+// requireTool skips the test if tool can't be found
+func requireTool(t testing.TB, tool string) {
+	t.Helper()
+	if _, err := exec.LookPath(tool); err != nil {
+		t.Skipf("toolchain not available: %s", err)
+	}
+}
+
+func compile(t testing.TB, prog string, cflags ...string) []byte {
+	t.Helper()
+	requireTool(t, _CC)
+	requireTool(t, _LD)
+	requireTool(t, _OBJCOPY)
+
 	dir, err := ioutil.TempDir("", "riscv_cpu_test")
 	if err != nil {
 		panic(err)
@@ -128,7 +149,7 @@ func compile(prog string) []byte {
 	}
 
 	// compile
-	cmd := exec.Command(_CC,
+	args := append([]string{
 		"-c",
 		"-Iruntime/",
 		"-ffreestanding",
@@ -136,8 +157,8 @@ func compile(prog string) []byte {
 		"-std=c99",
 		"-march=rv32i",
 		"-mabi=ilp32",
-		"-o", objPath,
-		srcPath)
+	}, cflags...)
+	cmd := exec.Command(_CC, append(args, "-o", objPath, srcPath)...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		panic(fmt.Sprint("compilation failed (", err, ") ", string(out)))
@@ -174,21 +195,35 @@ func compile(prog string) []byte {
 	return res
 }
 
-func assemble(prog string) []byte {
-	dir, err := ioutil.TempDir("", "riscv_cpu_test")
-	if err != nil {
-		panic(err)
-	}
+// asArch selects the instruction set a test program is assembled for
+type asArch struct {
+	march, mabi, emulation string
+}
 
-	defer os.RemoveAll(dir)
+var (
+	_Rv32  = asArch{"rv32i", "ilp32", "elf32lriscv"}
+	_Rv64  = asArch{"rv64i", "lp64", "elf64lriscv"}
+	_Rv32A = asArch{"rv32ia", "ilp32", "elf32lriscv"}
+)
+
+// assembleElf assembles and links prog with its text at textAddr, the
+// elf is written into dir and its path is returned
+func assembleElf(t testing.TB, dir string, prog string, textAddr uint32) string {
+	t.Helper()
+	return assembleElfArch(t, dir, prog, textAddr, _Rv32)
+}
+
+func assembleElfArch(t testing.TB, dir string, prog string, textAddr uint32, arch asArch) string {
+	t.Helper()
+	requireTool(t, _AS)
+	requireTool(t, _LD)
 
 	srcPath := filepath.Join(dir, "prog.s")
 	objPath := filepath.Join(dir, "prog.o")
 	elfPath := filepath.Join(dir, "prog.elf")
-	binPath := filepath.Join(dir, "prog.bin")
 
 	// write source
-	err = ioutil.WriteFile(srcPath, []byte(prog), 0444)
+	err := ioutil.WriteFile(srcPath, []byte(prog), 0444)
 	if err != nil {
 		panic(err)
 	}
@@ -196,8 +231,8 @@ func assemble(prog string) []byte {
 	// compile
 	cmd := exec.Command(_AS,
 		"-o", objPath,
-		"-march=rv32i",
-		"-mabi=ilp32",
+		"-march="+arch.march,
+		"-mabi="+arch.mabi,
 		srcPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -207,19 +242,41 @@ func assemble(prog string) []byte {
 	// link
 	cmd = exec.Command(_LD,
 		"-nostdlib",
-		"-Ttext", "0x100",
-		"-m", "elf32lriscv",
+		"-Ttext", fmt.Sprintf("0x%x", textAddr),
+		"-m", arch.emulation,
 		"-o", elfPath, objPath)
 	out, err = cmd.CombinedOutput()
 	if err != nil {
 		panic(fmt.Sprint("linkage failed (", err, ") ", string(out)))
 	}
 
+	return elfPath
+}
+
+func assemble(t testing.TB, prog string) []byte {
+	t.Helper()
+	return assembleArch(t, prog, _Rv32)
+}
+
+func assembleArch(t testing.TB, prog string, arch asArch) []byte {
+	t.Helper()
+	requireTool(t, _OBJCOPY)
+
+	dir, err := ioutil.TempDir("", "riscv_cpu_test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	elfPath := assembleElfArch(t, dir, prog, BoardInitialAddr, arch)
+	binPath := filepath.Join(dir, "prog.bin")
+
 	// dump
-	cmd = exec.Command(_OBJCOPY,
+	cmd := exec.Command(_OBJCOPY,
 		"-O", "binary",
 		elfPath, binPath)
-	out, err = cmd.CombinedOutput()
+	out, err := cmd.CombinedOutput()
 	if err != nil {
 		panic(fmt.Sprint("dump failed (", err, ") ", string(out)))
 	}
@@ -233,6 +290,20 @@ func assemble(prog string) []byte {
 	return res
 }
 
+func TestRequireTool(t *testing.T) {
+	var skipped bool
+	t.Run("missing", func(t *testing.T) {
+		defer func() {
+			skipped = t.Skipped()
+		}()
+		requireTool(t, _CC+"-missing")
+		t.Error("expected the test to be skipped")
+	})
+	if !skipped {
+		t.Error("missing tool did not skip the test")
+	}
+}
+
 // since we can't check every permutation we check random permutations
 // this defines how many random permutations to try
 const FUZZ_ITER = 10
@@ -255,7 +326,7 @@ func TestMOVI(t *testing.T) {
 		imm := rand.Int31()%0xfff - 0x800
 		prog := fmt.Sprintf("addi x%d, x0, %d", reg, imm)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.Step()
 		expected := sextend(imm)
 		if cpu.GetReg(reg) != expected {
@@ -274,7 +345,7 @@ func TestADDI(t *testing.T) {
 		vv := sextend(imm)
 		vv += v
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, v)
 		cpu.Step()
 		if cpu.GetReg(rd) != vv {
@@ -297,7 +368,7 @@ func TestSTLI(t *testing.T) {
 			vv = 0
 		}
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != vv {
@@ -320,7 +391,7 @@ func TestSTLU(t *testing.T) {
 			expected = 0
 		}
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -338,7 +409,7 @@ func TestANDI(t *testing.T) {
 		prog := fmt.Sprintf("andi x%d, x%d, %d", rd, rs1, imm)
 		expected := rs1v & sextend(imm)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -356,7 +427,7 @@ func TestORI(t *testing.T) {
 		prog := fmt.Sprintf("ori x%d, x%d, %d", rd, rs1, imm)
 		expected := rs1v | sextend(imm)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -374,7 +445,7 @@ func TestXORI(t *testing.T) {
 		prog := fmt.Sprintf("xori x%d, x%d, %d", rd, rs1, imm)
 		expected := rs1v ^ sextend(imm)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -392,7 +463,7 @@ func TestSLLI(t *testing.T) {
 		prog := fmt.Sprintf("slli x%d, x%d, %d", rd, rs1, shamt)
 		expected := rs1v << shamt
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -410,7 +481,7 @@ func TestSRLI(t *testing.T) {
 		prog := fmt.Sprintf("srli x%d, x%d, %d", rd, rs1, shamt)
 		expected := rs1v >> shamt
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -428,7 +499,7 @@ func TestSRAI(t *testing.T) {
 		prog := fmt.Sprintf("srai x%d, x%d, %d", rd, rs1, shamt)
 		expected := uint32(int32(rs1v) >> shamt)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -437,6 +508,30 @@ func TestSRAI(t *testing.T) {
 	}
 }
 
+func TestShiftReservedBits(t *testing.T) {
+	for _, inst := range []uint32{
+		// slli a0, a0, 1 with shamt[5] set
+		encodeI(OP_IMM, RegA0, FUNCT_SLLI, RegA0, 0x21),
+		// slli with the srai bit set
+		encodeI(OP_IMM, RegA0, FUNCT_SLLI, RegA0, 0x401),
+		// srli a0, a0, 1 with shamt[5] set
+		encodeI(OP_IMM, RegA0, FUNCT_SRXI, RegA0, 0x21),
+		// srai a0, a0, 1 with shamt[5] set
+		encodeI(OP_IMM, RegA0, FUNCT_SRXI, RegA0, 0x421),
+		// srli with a reserved bit set
+		encodeI(OP_IMM, RegA0, FUNCT_SRXI, RegA0, 0x801),
+	} {
+		prog := NewProgTemplate(`.word {{.inst}}`).Execute(ProgArgs{"inst": inst})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.SetReg(RegA0, 0x10)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+		assertCsrEq(t, cpu, CsrTval|CsrM, inst)
+		assertRegEq(t, cpu, RegA0, 0x10)
+	}
+}
+
 func TestLUI(t *testing.T) {
 	for i := 0; i < FUZZ_ITER; i++ {
 		rd := randReg()
@@ -444,7 +539,7 @@ func TestLUI(t *testing.T) {
 		prog := fmt.Sprintf("lui x%d, %d", rd, imm)
 		expected := imm << 12
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
 			t.Error("expected", expected, "got", cpu.GetReg(rd))
@@ -459,7 +554,7 @@ func TestAUIPC(t *testing.T) {
 		imm := rand.Uint32() % 0xfffff
 		prog := fmt.Sprintf("auipc x%d, %d", rd, imm)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		expected := (imm << 12) + cpu.pc
 		cpu.Step()
 		if cpu.GetReg(rd) != expected {
@@ -480,7 +575,7 @@ func TestADD(t *testing.T) {
 		}
 		prog := fmt.Sprintf("add x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -503,7 +598,7 @@ func TestSUB(t *testing.T) {
 		}
 		prog := fmt.Sprintf("sub x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -526,7 +621,7 @@ func TestSLT(t *testing.T) {
 		}
 		prog := fmt.Sprintf("slt x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -554,7 +649,7 @@ func TestSLTU(t *testing.T) {
 		}
 		prog := fmt.Sprintf("sltu x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -582,7 +677,7 @@ func TestAND(t *testing.T) {
 		}
 		prog := fmt.Sprintf("and x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -605,7 +700,7 @@ func TestOR(t *testing.T) {
 		}
 		prog := fmt.Sprintf("or x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -628,7 +723,7 @@ func TestXOR(t *testing.T) {
 		}
 		prog := fmt.Sprintf("xor x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -651,7 +746,7 @@ func TestSLL(t *testing.T) {
 		}
 		prog := fmt.Sprintf("sll x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -674,7 +769,7 @@ func TestSRL(t *testing.T) {
 		}
 		prog := fmt.Sprintf("srl x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -697,7 +792,7 @@ func TestSRA(t *testing.T) {
 		}
 		prog := fmt.Sprintf("sra x%d, x%d, x%d", rd, rs1, rs2)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -708,6 +803,35 @@ func TestSRA(t *testing.T) {
 	}
 }
 
+func TestShiftAmountMask(t *testing.T) {
+	tests := []struct {
+		op       string
+		rs1v     uint32
+		rs2v     uint32
+		expected uint32
+	}{
+		// only the low 5 bits of rs2 are used, 0x21 shifts by 1 not 33
+		{"sll", 0x80000001, 0x21, 0x00000002},
+		{"srl", 0x80000001, 0x21, 0x40000000},
+		{"sra", 0x80000001, 0x21, 0xc0000000},
+		{"sll", 0x00000001, 0xffffffe0, 0x00000001},
+		{"srl", 0x80000000, 0x3f, 0x00000001},
+		{"sra", 0x80000000, 0x3f, 0xffffffff},
+	}
+	for _, test := range tests {
+		prog := fmt.Sprintf("%s x3, x1, x2", test.op)
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.SetReg(1, test.rs1v)
+		cpu.SetReg(2, test.rs2v)
+		cpu.Step()
+		if cpu.GetReg(3) != test.expected {
+			t.Errorf("%s 0x%08x, 0x%x: expected 0x%08x got 0x%08x",
+				test.op, test.rs1v, test.rs2v, test.expected, cpu.GetReg(3))
+		}
+	}
+}
+
 func TestJAL(t *testing.T) {
 	progTmpl := NewProgTemplate(`jal x{{.rd}}, {{.offt}}`)
 	for i := 0; i < FUZZ_ITER; i++ {
@@ -715,7 +839,7 @@ func TestJAL(t *testing.T) {
 		offt := (rand.Int31() % 0x3ffff) << 1
 		prog := progTmpl.Execute(ProgArgs{"rd": rd, "offt": offt})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.Step()
 		imm := uint32(offt)
 		if offt < 0 {
@@ -735,7 +859,7 @@ func TestJALR(t *testing.T) {
 		rs1v := rand.Uint32()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd, "rs1": rs1})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.Step()
 		assertRegEq(t, cpu, rd, cpu.initialAddr+4)
@@ -764,7 +888,7 @@ func testBranch(t *testing.T, opcode string, cond func(rs1v, rs2v uint32) bool)
 			"rs2":    rs2,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, rs1v)
 		cpu.SetReg(rs2, rs2v)
 		cpu.Step()
@@ -817,7 +941,7 @@ func testLd(t *testing.T, opcode string, bits uint, isSigned bool) {
 			"v":      v,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		//@investigate: load instruction get broken down to 2
 		// instructions by the assmebler I need to figure out
 		// how to make sure only one is made is that this is
@@ -867,7 +991,7 @@ func testStr(t *testing.T, opcode string, bits uint) {
 			"v":      v,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rs1, v)
 		cpu.Step()
 		cpu.Step()
@@ -890,6 +1014,327 @@ func TestSB(t *testing.T) {
 	testStr(t, "sb", 8)
 }
 
+func TestFENCE(t *testing.T) {
+	prog := NewProgTemplate(`
+	fence rw, rw
+	fence.tso
+	fence.i
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	if cpu.LastFault() != nil {
+		t.Errorf("unexpected exception: %s", cpu.LastFault())
+	}
+	if expected := cpu.initialAddr + 12; cpu.pc != expected {
+		t.Errorf("expected pc 0x%08x got 0x%08x", expected, cpu.pc)
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+}
+
+func TestMalformedFence(t *testing.T) {
+	// a fence with the reserved funct3 2
+	state := &CpuState{Pc: 0x100, Priv: PrivMachine}
+	_, err := ExecuteOne(state, 0x0ff0200f)
+	exception, ok := err.(*Exception)
+	if !ok || exception.Cause != ExceptionIllegalInstruction {
+		t.Errorf("expected an illegal instruction got %v", err)
+	}
+}
+
+func TestRunToEcall(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a7, 64
+	li a0, 1
+	li a1, 0x200
+	li a2, 5
+	ecall
+	mv s0, a0
+	ecall
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	args, err := cpu.RunToEcall(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint32{1, 0x200, 5, 0, 0, 0, 0, 64}
+	if fmt.Sprint(args) != fmt.Sprint(expected) {
+		t.Errorf("expected args %v got %v", expected, args)
+	}
+	if ecallPc := cpu.initialAddr + 16; cpu.Pc() != ecallPc {
+		t.Errorf("expected to stop at 0x%08x got 0x%08x", ecallPc, cpu.Pc())
+	}
+	if cause, _ := cpu.GetCsr(CsrCause | CsrM); cause != 0 {
+		t.Errorf("expected the ecall trap not to be taken")
+	}
+	cpu.SetReg(RegA0, 5)
+	cpu.SetPc(cpu.Pc() + 4)
+	if _, err := cpu.RunToEcall(100); err != nil {
+		t.Fatal(err)
+	}
+	if s0 := cpu.GetReg(RegS0); s0 != 5 {
+		t.Errorf("expected the result to be visible to the guest got %d", s0)
+	}
+	if _, err := cpu.RunToEcall(0); err != ErrBudgetExhausted {
+		t.Errorf("expected ErrBudgetExhausted got %v", err)
+	}
+}
+
+func TestMisalignedEmulation(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, 0x101
+	lw a0, 0(t0)
+	li t0, 0x1ffe
+	li a1, 0x11223344
+	sw a1, 0(t0)
+	lw a2, 0(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	bin := assemble(t, prog)
+	board := NewDebugBoard(bin)
+	// the word at 0x1ffe straddles both rams
+	low, high := NewRam(0x1000), NewRam(0x1000)
+	board.board.Mmu().AddRange(0x1000, 0x1000, low)
+	board.board.Mmu().AddRange(0x2000, 0x1000, high)
+	cpu := board.Cpu()
+	cpu.SetMisalignedEmulation(true)
+	cpu.Execute()
+	expected := binary.LittleEndian.Uint32(bin[1:5])
+	if a0 := cpu.GetReg(RegA0); a0 != expected {
+		t.Errorf("expected lw from 0x101 to be 0x%08x got 0x%08x", expected, a0)
+	}
+	if a2 := cpu.GetReg(RegA2); a2 != 0x11223344 {
+		t.Errorf("expected lw from 0x1ffe to be 0x11223344 got 0x%08x", a2)
+	}
+	if v := low.LoadHalfWord(0xffe); v != 0x3344 {
+		t.Errorf("expected low half 0x3344 got 0x%04x", v)
+	}
+	if v := high.LoadHalfWord(0); v != 0x1122 {
+		t.Errorf("expected high half 0x1122 got 0x%04x", v)
+	}
+}
+
+func TestRecordWrites(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, 0x1000
+	li t1, 8
+	loop:
+	sw t1, 0(t0)
+	addi t0, t0, 4
+	addi t1, t1, -1
+	bnez t1, loop
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	mmu := board.board.Mmu()
+	mmu.AddRange(0x1000, 0x100, NewRam(0x100))
+	mmu.RecordWrites(true)
+	board.Cpu().Execute()
+	expected := []Range{{Addr: 0x1000, Size: 32}}
+	if ranges := mmu.WrittenRanges(); fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Errorf("expected %v got %v", expected, ranges)
+	}
+
+	// writes out of order get coalesced once the gaps are filled
+	mmu.RecordWrites(true)
+	mmu.StoreWord(0x1008, 0)
+	mmu.StoreByte(0x1000, 0)
+	mmu.StoreHalfWord(0x1010, 0)
+	expected = []Range{{Addr: 0x1000, Size: 1}, {Addr: 0x1008, Size: 4},
+		{Addr: 0x1010, Size: 2}}
+	if ranges := mmu.WrittenRanges(); fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Errorf("expected %v got %v", expected, ranges)
+	}
+	mmu.StoreWord(0x1001, 0)
+	mmu.StoreWord(0x100c, 0)
+	mmu.StoreWord(0x1005, 0)
+	expected = []Range{{Addr: 0x1000, Size: 0x12}}
+	if ranges := mmu.WrittenRanges(); fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Errorf("expected %v got %v", expected, ranges)
+	}
+}
+
+func TestCallFunction(t *testing.T) {
+	prog := NewProgTemplate(`
+	j halt
+	add:
+	add a0, a0, a1
+	ret
+	halt:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	if _, err := cpu.CallFunction(cpu.initialAddr+4, []uint32{2, 3}, 1); err != ErrBudgetExhausted {
+		t.Errorf("expected ErrBudgetExhausted got %v", err)
+	}
+	// the add and the ret
+	res, err := cpu.CallFunction(cpu.initialAddr+4, []uint32{2, 3}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 5 {
+		t.Errorf("expected add(2, 3) to return 5 got %d", res)
+	}
+	if _, err := cpu.CallFunction(cpu.initialAddr, nil, 100); err != ErrHalted {
+		t.Errorf("expected ErrHalted got %v", err)
+	}
+}
+
+func TestAddRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr, size uint32
+		err        error
+	}{
+		{"exact overlap", 0x1000, 0x100, ErrRangeOverlap},
+		{"partial overlap", 0x10f0, 0x100, ErrRangeOverlap},
+		{"contained", 0x1010, 0x10, ErrRangeOverlap},
+		{"wraparound", 0xffffff00, 0x200, ErrRangeWraps},
+		{"below", 0xf00, 0x100, nil},
+		{"above", 0x1100, 0x100, nil},
+		{"end of the address space", 0xffffff00, 0x100, nil},
+	}
+	for _, test := range tests {
+		mmu := NewMmu()
+		if err := mmu.AddRange(0x1000, 0x100, NewRam(0x100)); err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+		err := mmu.AddRange(test.addr, test.size, NewRam(test.size))
+		if err != test.err {
+			t.Errorf("%s: expected %v got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestWriteProtect(t *testing.T) {
+	progTmpl := NewProgTemplate(`
+	sw x{{.rs1}}, 0x108(x0)
+	nop
+	data:
+	.word 0
+	`)
+	for i := 0; i < FUZZ_ITER; i++ {
+		rs1 := randReg()
+		v := rand.Uint32()
+		prog := progTmpl.Execute(ProgArgs{"rs1": rs1})
+		t.Log("prog: ", prog)
+		board := NewDebugBoard(assemble(t, prog))
+		cpu := board.Cpu()
+		mmu := board.board.Mmu()
+		mmu.SetWriteProtect(0x108, 4, true)
+		cpu.SetReg(rs1, v)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionStoreAccessFault)
+		assertCsrEq(t, cpu, CsrTval|CsrM, 0x108)
+		assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr)
+		if cpu.LoadWord(0x108) != 0 {
+			t.Errorf("protected memory was written")
+		}
+
+		mmu.SetWriteProtect(0x108, 4, false)
+		cpu.Reset()
+		cpu.SetReg(rs1, v)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+		assertPcEq(t, cpu, cpu.initialAddr+4)
+		if cpu.LoadWord(0x108) != v {
+			t.Errorf("expected 0x%08x got 0x%08x", v, cpu.LoadWord(0x108))
+		}
+	}
+}
+
+func TestWriteProtectSplit(t *testing.T) {
+	mmu := NewMmu()
+	mmu.AddRange(0, 0x100, NewRam(0x100))
+	mmu.SetWriteProtect(0x10, 0x20, true)
+	mmu.SetWriteProtect(0x18, 0x4, false)
+	for _, test := range []struct {
+		addr  uint32
+		fault bool
+	}{
+		{0x0c, false},
+		{0x0e, true}, // straddles the start of the region
+		{0x10, true},
+		{0x14, true},
+		{0x18, false},
+		{0x1c, true},
+		{0x2c, true},
+		{0x30, false},
+	} {
+		mmu.StoreWord(test.addr, 0xffffffff)
+		if fault := mmu.TakeFault(); fault != test.fault {
+			t.Errorf("expected fault to be %v for 0x%02x", test.fault, test.addr)
+		}
+	}
+}
+
+func TestAccessStats(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, -2
+	li t1, 100
+	lw t2, data
+	poll:
+	lbu a0, 0(t0)
+	addi t1, t1, -1
+	bnez t1, poll
+	sb a0, 0(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	data:
+	.word 0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.Cpu().Execute()
+	stats := board.board.Mmu().Stats()
+	expected := AccessStats{
+		RamLoads:   1,
+		MmioLoads:  100,
+		MmioStores: 1,
+	}
+	if stats != expected {
+		t.Errorf("expected %+v got %+v", expected, stats)
+	}
+	board.board.Mmu().ResetStats()
+	if stats := board.board.Mmu().Stats(); stats != (AccessStats{}) {
+		t.Errorf("expected stats to be reset got %+v", stats)
+	}
+}
+
+func TestAccessStatsRom(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, 0x10000
+	lw a0, 0(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	if err := board.board.Mmu().AddRange(0x10000, 4, NewRom(make([]uint8, 4))); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	board.Cpu().Execute()
+	expected := AccessStats{RamLoads: 1}
+	if stats := board.board.Mmu().Stats(); stats != expected {
+		t.Errorf("expected %+v got %+v", expected, stats)
+	}
+	if !board.board.Mmu().PokeByte(0x10000, 1) {
+		t.Errorf("expected poking the rom to succeed")
+	}
+	if v, _ := board.board.Mmu().PeekByte(0x10000); v != 1 {
+		t.Errorf("expected the poked byte 1 got %d", v)
+	}
+}
+
 func TestRdcycle(t *testing.T) {
 	progTmpl := NewProgTemplate(`
 		rdcycle x{{.rd}}
@@ -899,7 +1344,7 @@ func TestRdcycle(t *testing.T) {
 		cycles := rand.Uint64()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.cycles = cycles
 		cpu.Step()
 		assertRegEq(t, cpu, rd, uint32(cycles))
@@ -915,7 +1360,7 @@ func TestRdcycleh(t *testing.T) {
 		cycles := rand.Uint64()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.cycles = cycles
 		cpu.Step()
 		assertRegEq(t, cpu, rd, uint32(cycles>>32))
@@ -931,7 +1376,7 @@ func TestRdtime(t *testing.T) {
 		ticks := rand.Uint64()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.ticks = ticks
 		cpu.Step()
 		assertRegEq(t, cpu, rd, uint32(ticks))
@@ -947,13 +1392,97 @@ func TestRdtimeh(t *testing.T) {
 		ticks := rand.Uint64()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.ticks = ticks
 		cpu.Step()
 		assertRegEq(t, cpu, rd, uint32(ticks>>32))
 	}
 }
 
+func TestTimebase(t *testing.T) {
+	progTmpl := NewProgTemplate(`
+	{{range .nops}}nop
+	{{end}}rdtime x{{.rd}}
+	`)
+	for i := 0; i < FUZZ_ITER; i++ {
+		rd := randReg()
+		n := int(rand.Uint32()%16) + 1
+		timebase := uint64(rand.Uint32()%1000) + 1
+		prog := progTmpl.Execute(ProgArgs{
+			"rd":   rd,
+			"nops": make([]struct{}, n),
+		})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.SetTimebase(timebase)
+		for j := 0; j < n; j++ {
+			cpu.Step()
+		}
+		if cpu.ticks != uint64(n)*timebase {
+			t.Errorf("expected %d ticks after %d instructions got %d",
+				uint64(n)*timebase, n, cpu.ticks)
+		}
+		cpu.Step()
+		assertRegEq(t, cpu, rd, uint32(uint64(n)*timebase))
+	}
+}
+
+func TestTimebaseTimerInterrupt(t *testing.T) {
+	// start counts the instructions to the one where time is read, the
+	// interrupt is due delta ticks, or n instructions, after that
+	progTmpl := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, 0x80
+	csrrw x0, mie, t0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	li t0, {{.mtimecmp}}
+	li s2, {{.delta}}
+	la s5, start
+	start:
+	rdtime s1
+	add s1, s1, s2
+	sw s1, 0(t0)
+	sw x0, 4(t0)
+	{{range .nops}}nop
+	{{end}}li t1, 1
+	csrrw x0, 0x3ff, t1
+	handler:
+	rdinstret s4
+	csrrs s3, mepc, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`)
+	for i := 0; i < FUZZ_ITER; i++ {
+		// the 4 instructions that program mtimecmp have to run first
+		n := uint32(rand.Uint32()%16) + 4
+		timebase := uint64(rand.Uint32()%1000) + 1
+		prog := progTmpl.Execute(ProgArgs{
+			"mtimecmp": BoardClintAddr + ClintMtimecmp,
+			"delta":    uint64(n) * timebase,
+			"nops":     make([]struct{}, n+4),
+		})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.SetTimebase(timebase)
+		for j := 0; j < 1000 && !cpu.halt; j++ {
+			cpu.Step()
+		}
+		assertCsrEq(t, cpu, CsrCause|CsrM, CauseInterrupt|InterruptMachineTimer)
+		start := cpu.GetReg(RegS5)
+		if epc := cpu.GetReg(RegS3); epc != start+4*n {
+			t.Errorf("expected the interrupt %d instructions after 0x%x at 0x%x got 0x%x",
+				n, start, start+4*n, epc)
+		}
+		expected := (start-cpu.initialAddr)/4 + n
+		if instret := cpu.GetReg(RegS4); instret != expected {
+			t.Errorf("expected the interrupt after %d instructions got %d",
+				expected, instret)
+		}
+	}
+}
+
 func TestRdinstret(t *testing.T) {
 	progTmpl := NewProgTemplate(`rdinstret x{{.rd}}`)
 	for i := 0; i < FUZZ_ITER; i++ {
@@ -961,7 +1490,7 @@ func TestRdinstret(t *testing.T) {
 		instret := rand.Uint64()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.instret = instret
 		cpu.Step()
 		assertRegEq(t, cpu, rd, uint32(instret))
@@ -975,15 +1504,65 @@ func TestRdinstreth(t *testing.T) {
 		instret := rand.Uint64()
 		prog := progTmpl.Execute(ProgArgs{"rd": rd})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.instret = instret
 		cpu.Step()
 		assertRegEq(t, cpu, rd, uint32(instret>>32))
 	}
 }
 
+func testCounterRollover(t *testing.T, name string, set func(cpu *Cpu, v uint64)) {
+	progTmpl := NewProgTemplate(`
+	rd{{.name}}h x{{.before}}
+	nop
+	rd{{.name}} x{{.low}}
+	rd{{.name}}h x{{.after}}
+	`)
+	prog := progTmpl.Execute(ProgArgs{
+		"name":   name,
+		"before": RegA0,
+		"low":    RegA1,
+		"after":  RegA2,
+	})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	// two instructions away from rolling over the low 32 bits
+	set(cpu, 0x2fffffffe)
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+	}
+	assertRegEq(t, cpu, RegA0, 2)
+	assertRegEq(t, cpu, RegA1, 0)
+	assertRegEq(t, cpu, RegA2, 3)
+}
+
+func TestCounterRollover(t *testing.T) {
+	testCounterRollover(t, "cycle", func(cpu *Cpu, v uint64) { cpu.cycles = v })
+	testCounterRollover(t, "time", func(cpu *Cpu, v uint64) { cpu.ticks = v })
+	testCounterRollover(t, "instret", func(cpu *Cpu, v uint64) { cpu.instret = v })
+}
+
+func TestTimebaseRollover(t *testing.T) {
+	prog := NewProgTemplate(`
+	rdtimeh a0
+	nop
+	rdtime a1
+	rdtimeh a2
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetTimebase(0x80000000)
+	cpu.ticks = 0x7fffffff
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+	}
+	assertRegEq(t, cpu, RegA0, 0)
+	assertRegEq(t, cpu, RegA1, 0x7fffffff)
+	assertRegEq(t, cpu, RegA2, 1)
+}
+
 func TestReadCsr(t *testing.T) {
-	progTmpl := NewProgTemplate(`csrrw x{{.rd}}, mscratch, x0`)
+	progTmpl := NewProgTemplate(`csrrs x{{.rd}}, mscratch, x0`)
 	for i := 0; i < FUZZ_ITER; i++ {
 		rd := randReg()
 		v := rand.Uint32()
@@ -991,7 +1570,7 @@ func TestReadCsr(t *testing.T) {
 			"rd": rd,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetCsr(CsrScratch|CsrM, v)
 		cpu.Step()
 		assertRegEq(t, cpu, rd, v)
@@ -1008,7 +1587,7 @@ func TestWriteCsr(t *testing.T) {
 			"rd": rd,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rd, v)
 		cpu.Step()
 		assertCsrEq(t, cpu, CsrScratch|CsrM, v)
@@ -1025,7 +1604,7 @@ func TestCsrrw(t *testing.T) {
 			"rd": rd,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rd, rdv)
 		cpu.SetCsr(CsrScratch|CsrM, csrv)
 		cpu.Step()
@@ -1044,15 +1623,42 @@ func TestCsrrs(t *testing.T) {
 			"rd": rd,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rd, rdv)
 		cpu.SetCsr(CsrScratch|CsrM, csrv)
 		cpu.Step()
-		assertCsrEq(t, cpu, CsrScratch|CsrM, csrv&rdv)
+		assertCsrEq(t, cpu, CsrScratch|CsrM, csrv|rdv)
 		assertRegEq(t, cpu, rd, csrv)
 	}
 }
 
+func TestCsrrwX0(t *testing.T) {
+	prog := `csrrw a0, mscratch, x0`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetCsr(CsrScratch|CsrM, 0x55)
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrScratch|CsrM, 0)
+	assertRegEq(t, cpu, RegA0, 0x55)
+
+	// it writes even with x0 as the source so a read-only csr traps
+	prog = `csrrw a0, cycle, x0`
+	t.Log("prog: ", prog)
+	cpu = NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+}
+
+func TestCsrrsX0(t *testing.T) {
+	prog := `csrrs a0, mscratch, x0`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetCsr(CsrScratch|CsrM, 0x1234)
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrScratch|CsrM, 0x1234)
+	assertRegEq(t, cpu, RegA0, 0x1234)
+}
+
 func TestCsrrc(t *testing.T) {
 	progTmpl := NewProgTemplate(`csrrc x{{.rd}}, mscratch, x{{.rd}}`)
 	for i := 0; i < FUZZ_ITER; i++ {
@@ -1063,7 +1669,7 @@ func TestCsrrc(t *testing.T) {
 			"rd": rd,
 		})
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.SetReg(rd, rdv)
 		cpu.SetCsr(CsrScratch|CsrM, csrv)
 		cpu.Step()
@@ -1072,12 +1678,133 @@ func TestCsrrc(t *testing.T) {
 	}
 }
 
+func TestCsrImmediate(t *testing.T) {
+	tests := []struct {
+		op       string
+		imm      uint32
+		expected uint32
+	}{
+		{"csrrwi", 0x15, 0x15},
+		{"csrrsi", 0x15, 0xf0f0f0f5},
+		{"csrrci", 0x1f, 0xf0f0f0e0},
+		// a zero immediate only keeps the set and clear forms from writing
+		{"csrrwi", 0, 0},
+		{"csrrsi", 0, 0xf0f0f0f0},
+		{"csrrci", 0, 0xf0f0f0f0},
+	}
+	for _, test := range tests {
+		prog := NewProgTemplate(`{{.op}} a0, mscratch, {{.imm}}`).Execute(ProgArgs{
+			"op":  test.op,
+			"imm": test.imm,
+		})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.SetCsr(CsrScratch|CsrM, 0xf0f0f0f0)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+		assertCsrEq(t, cpu, CsrScratch|CsrM, test.expected)
+		assertRegEq(t, cpu, RegA0, 0xf0f0f0f0)
+	}
+}
+
+func TestUserHalt(t *testing.T) {
+	progTmpl := NewProgTemplate(`csrrw x0, 0x3ff, x{{.rs1}}`)
+	for i := 0; i < FUZZ_ITER; i++ {
+		rs1 := randReg()
+		v := rand.Uint32()
+		prog := progTmpl.Execute(ProgArgs{"rs1": rs1})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.priv = PrivUser
+		cpu.SetReg(rs1, v)
+		cpu.Step()
+		if cpu.halt {
+			t.Errorf("user mode was able to halt the cpu")
+		}
+		assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+		assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr)
+
+		cpu.Reset()
+		cpu.priv = PrivUser
+		cpu.AllowUserHalt(true)
+		cpu.SetReg(rs1, v)
+		cpu.Step()
+		if !cpu.halt {
+			t.Errorf("expected user mode halt to be allowed")
+		}
+		assertCsrEq(t, cpu, CsrHalt, v)
+	}
+}
+
+func TestRegisterCSR(t *testing.T) {
+	progTmpl := NewProgTemplate(`csrrw x{{.rd}}, 0x7c0, x{{.rs1}}`)
+	for i := 0; i < FUZZ_ITER; i++ {
+		rd := randReg()
+		rs1 := randReg()
+		for rs1 == rd {
+			rs1 = randReg()
+		}
+		csrv := rand.Uint32()
+		rs1v := rand.Uint32()
+		prog := progTmpl.Execute(ProgArgs{"rd": rd, "rs1": rs1})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		var reads int
+		var written []uint32
+		cpu.RegisterCSR(0x7c0, func() uint32 {
+			reads++
+			return csrv
+		}, func(v uint32) {
+			written = append(written, v)
+		})
+		cpu.SetReg(rs1, rs1v)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+		assertRegEq(t, cpu, rd, csrv)
+		if reads != 1 {
+			t.Errorf("expected a single read got %d", reads)
+		}
+		if len(written) != 1 || written[0] != rs1v {
+			t.Errorf("expected a single write of 0x%08x got %v", rs1v, written)
+		}
+
+		// machine mode csr accessed from user mode
+		cpu.Reset()
+		cpu.priv = PrivUser
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+
+		// read-only csr
+		cpu.Reset()
+		cpu.RegisterCSR(0x7c0, func() uint32 { return csrv }, nil)
+		cpu.SetReg(rs1, rs1v)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+		if len(written) != 1 {
+			t.Errorf("read-only csr was written")
+		}
+
+		// write-only csr
+		cpu.Reset()
+		cpu.RegisterCSR(0x7c0, nil, func(v uint32) {
+			written = append(written, v)
+		})
+		cpu.SetReg(rs1, rs1v)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+		assertRegEq(t, cpu, rd, 0)
+		if v, ok := cpu.GetCsr(0x7c0); !ok || v != 0 {
+			t.Errorf("expected the write-only csr to read 0 got 0x%08x %v", v, ok)
+		}
+	}
+}
+
 func TestEbreak(t *testing.T) {
 	progTmpl := NewProgTemplate(`ebreak`)
 	for i := 0; i < FUZZ_ITER; i++ {
 		prog := progTmpl.Execute(nil)
 		t.Log("prog: ", prog)
-		cpu := NewDebugBoard(assemble(prog)).Cpu()
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
 		cpu.Step()
 		assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr)
 		assertCsrEq(t, cpu, CsrTval|CsrM, cpu.initialAddr)
@@ -1085,6 +1812,791 @@ func TestEbreak(t *testing.T) {
 	}
 }
 
+// ProgMeta describes what is expected from running a test prog, it is
+// read from an optional <prog>.meta sidecar file made of "key: value" lines
+type ProgMeta struct {
+	// value written to the halt csr
+	ExitCode uint32
+	// "halt" if the prog is expected to halt on its own or "limit" if it
+	// is expected to still be running after MaxInstructions
+	HaltReason      string
+	MaxInstructions uint64
+	// extra compiler flags separated by spaces
+	Cflags string
+}
+
+const _DefaultMaxInstructions = 10000000
+
+func parseProgMeta(data string) (ProgMeta, error) {
+	meta := ProgMeta{
+		HaltReason:      "halt",
+		MaxInstructions: _DefaultMaxInstructions,
+	}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return meta, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		key := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "exit":
+			var code int64
+			code, err = strconv.ParseInt(value, 0, 64)
+			meta.ExitCode = uint32(code)
+		case "reason":
+			if value != "halt" && value != "limit" {
+				err = fmt.Errorf("unknown halt reason %q", value)
+			}
+			meta.HaltReason = value
+		case "max-instructions":
+			meta.MaxInstructions, err = strconv.ParseUint(value, 0, 64)
+		case "cflags":
+			meta.Cflags = value
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return meta, fmt.Errorf("line %d: %s", i+1, err)
+		}
+	}
+
+	return meta, nil
+}
+
+func TestParseProgMeta(t *testing.T) {
+	meta, err := parseProgMeta(`
+	# comment
+	exit: 7
+	reason: limit
+	max-instructions: 0x100
+	cflags: -O2 -mcmodel=medany
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ProgMeta{ExitCode: 7, HaltReason: "limit", MaxInstructions: 0x100,
+		Cflags: "-O2 -mcmodel=medany"}
+	if meta != expected {
+		t.Errorf("expected %+v got %+v", expected, meta)
+	}
+
+	meta, err = parseProgMeta("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = ProgMeta{HaltReason: "halt", MaxInstructions: _DefaultMaxInstructions}
+	if meta != expected {
+		t.Errorf("expected %+v got %+v", expected, meta)
+	}
+
+	for _, bad := range []string{"exit 7", "exit: seven", "reason: crash", "color: blue"} {
+		if _, err := parseProgMeta(bad); err == nil {
+			t.Errorf("expected %q to fail parsing", bad)
+		}
+	}
+}
+
+func TestSerialInterrupt(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, 0x800
+	csrrw x0, mie, t0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	loop:
+	j loop
+	handler:
+	li t0, -2
+	lbu a0, 0(t0)
+	csrrw x0, 0x3ff, a0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewBoard(assemble(t, prog), strings.NewReader("x"), ioutil.Discard)
+	board.EnableSerialInterrupt()
+	cpu := board.Cpu()
+	for i := 0; i < 1000000 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	if !cpu.halt {
+		t.Fatal("interrupt handler never ran")
+	}
+	assertCsrEq(t, cpu, CsrHalt, 'x')
+	assertCsrEq(t, cpu, CsrCause|CsrM, CauseInterrupt|InterruptMachineExternal)
+	// the interrupt can only arrive while spinning in the loop
+	assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr+0x20)
+	if cpu.mstatus&MstatusMIE != 0 || cpu.mstatus&MstatusMPIE == 0 {
+		t.Errorf("expected interrupts to be disabled in the handler")
+	}
+}
+
+func TestScheduleInterrupt(t *testing.T) {
+	for _, interrupt := range []uint32{InterruptMachineExternal, InterruptMachineTimer} {
+		prog := NewProgTemplate(`
+		la t0, handler
+		csrrw x0, mtvec, t0
+		li t0, 1
+		slli t0, t0, {{.interrupt}}
+		csrrw x0, mie, t0
+		li t0, 8
+		csrrw x0, mstatus, t0
+		loop:
+		addi a1, a1, 1
+		j loop
+		handler:
+		csrrs a0, instret, x0
+		csrrw x0, 0x3ff, a0
+		`).Execute(ProgArgs{"interrupt": interrupt})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.ScheduleInterrupt(50, interrupt)
+		for i := 0; i < 1000 && !cpu.halt; i++ {
+			cpu.Step()
+		}
+		if !cpu.halt {
+			t.Fatal("interrupt handler never ran")
+		}
+		assertCsrEq(t, cpu, CsrHalt, 50)
+		assertCsrEq(t, cpu, CsrCause|CsrM, CauseInterrupt|interrupt)
+		// 8 instructions set up the handler, the rest are spent in the
+		// two instruction loop
+		loopIterations := uint32(50-8) / 2
+		assertRegEq(t, cpu, RegA1, loopIterations)
+	}
+}
+
+func TestBoardTick(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, {{.mtimecmp}}
+	li t1, 1000
+	sw t1, 0(t0)
+	sw x0, 4(t0)
+	li t0, 0x80
+	csrrw x0, mie, t0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	loop:
+	j loop
+	handler:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(ProgArgs{"mtimecmp": BoardClintAddr + ClintMtimecmp})
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	cpu := board.Cpu()
+	for i := 0; i < 50; i++ {
+		cpu.Step()
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+	board.board.Tick(1000)
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, CauseInterrupt|InterruptMachineTimer)
+	cpu.Step()
+	if !cpu.halt {
+		t.Errorf("expected the timer handler to run")
+	}
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, {{.mtime}}
+	lw s1, 0(t0)
+	addi s1, s1, 100
+	li t0, {{.mtimecmp}}
+	sw s1, 0(t0)
+	sw x0, 4(t0)
+	li t0, 0x80
+	csrrw x0, mie, t0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	loop:
+	addi a1, a1, 1
+	j loop
+	handler:
+	li t0, {{.mtime}}
+	lw s2, 0(t0)
+	csrrs s3, mepc, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(ProgArgs{
+		"mtime":    BoardClintAddr + ClintMtime,
+		"mtimecmp": BoardClintAddr + ClintMtimecmp,
+	})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 1000 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	if !cpu.halt {
+		t.Fatal("the timer interrupt was never taken")
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, CauseInterrupt|InterruptMachineTimer)
+	if cpu.GetReg(RegS2) < cpu.GetReg(RegS1) {
+		t.Errorf("the interrupt was taken at mtime %d before mtimecmp %d",
+			cpu.GetReg(RegS2), cpu.GetReg(RegS1))
+	}
+	if cpu.GetReg(RegA1) == 0 {
+		t.Errorf("expected the loop to spin before the interrupt")
+	}
+	// the interrupt was taken from the loop
+	loop := cpu.initialAddr + 15*4
+	if epc := cpu.GetReg(RegS3); epc != loop && epc != loop+4 {
+		t.Errorf("expected mepc in the loop at 0x%x got 0x%x", loop, epc)
+	}
+}
+
+func TestMieMip(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, -1
+	csrrw x0, mie, t0
+	csrrs a0, mie, x0
+	csrrs a1, mip, x0
+	li t0, {{.mtimecmp}}
+	sw x0, 0(t0)
+	sw x0, 4(t0)
+	csrrs a2, mip, x0
+	li t0, {{.msip}}
+	li t1, 1
+	sw t1, 0(t0)
+	csrrs a3, mip, x0
+	li t0, -1
+	csrrw x0, mip, t0
+	csrrs a4, mip, x0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	nop
+	handler:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(ProgArgs{
+		"mtimecmp": BoardClintAddr + ClintMtimecmp,
+		"msip":     BoardClintAddr + ClintMsip,
+	})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	// only the implemented enable bits stick
+	assertRegEq(t, cpu, RegA0, MieMSIE|MieMTIE|MieMEIE|MieSSIE|MieSTIE|MieSEIE)
+	assertRegEq(t, cpu, RegA1, 0)
+	// the timer is pending once mtime reaches mtimecmp
+	assertRegEq(t, cpu, RegA2, MipMTIP)
+	assertRegEq(t, cpu, RegA3, MipMTIP|MipMSIP)
+	// only the supervisor software and timer bits of mip can be written
+	assertRegEq(t, cpu, RegA4, MipMTIP|MipMSIP|MipSSIP|MipSTIP)
+	// the software interrupt is taken before the timer
+	assertCsrEq(t, cpu, CsrCause|CsrM, CauseInterrupt|InterruptMachineSoftware)
+}
+
+func TestRunResult(t *testing.T) {
+	tests := []struct {
+		prog    string
+		result  RunResult
+		success bool
+	}{
+		{"li t1, 0\ncsrrw x0, 0x3ff, t1", RunResult{true, 0, 0}, true},
+		{"li t1, 3\ncsrrw x0, 0x3ff, t1", RunResult{true, 3, 0}, false},
+		{"loop:\nj loop", RunResult{false, 0, 0}, false},
+		{"la t0, handler\ncsrrw x0, mtvec, t0\n.word 0\n" +
+			"handler:\nli t1, 1\ncsrrw x0, 0x3ff, t1",
+			RunResult{true, 1, 1}, false},
+	}
+	for _, test := range tests {
+		prog := NewProgTemplate(test.prog).Execute(nil)
+		t.Log("prog: ", prog)
+		board := NewDebugBoard(assemble(t, prog))
+		board.board.SetLimits(100, 0)
+		board.board.Run()
+		result := board.board.Result()
+		if result != test.result {
+			t.Errorf("expected %+v got %+v", test.result, result)
+		}
+		if result.Success() != test.success {
+			t.Errorf("expected Success() to be %v", test.success)
+		}
+	}
+}
+
+func TestUnimplementedCsr(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li a0, 5
+	csrrs a0, 0x7c0, x0
+	nop
+	handler:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.Execute()
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+	assertRegEq(t, cpu, RegA0, 5)
+
+	// the host gets told instead of the emulator crashing
+	for _, csr := range []uint32{0x7c0, 0x200, 0x001} {
+		if _, ok := cpu.GetCsr(csr); ok {
+			t.Errorf("expected reading 0x%03x to fail", csr)
+		}
+		if cpu.SetCsr(csr, 1) {
+			t.Errorf("expected writing 0x%03x to fail", csr)
+		}
+	}
+	if cpu.SetCsr(CsrCycle, 1) {
+		t.Errorf("expected writing cycle to fail")
+	}
+}
+
+func TestMisa(t *testing.T) {
+	prog := NewProgTemplate(`
+	csrrs a0, misa, x0
+	csrrw x0, misa, x0
+	csrrs a1, misa, x0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+	misa := cpu.GetReg(RegA0)
+	if mxl := misa >> 30; mxl != 1 {
+		t.Errorf("expected MXL 1 (32 bits) got %d", mxl)
+	}
+	var extensions string
+	for letter := 'A'; letter <= 'Z'; letter++ {
+		if misa&(1<<uint(letter-'A')) != 0 {
+			extensions += string(letter)
+		}
+	}
+	if extensions != "ACISU" {
+		t.Errorf("expected extensions ACISU got %s", extensions)
+	}
+	// writes are ignored
+	assertRegEq(t, cpu, RegA1, misa)
+}
+
+func TestMachineInfoCsrs(t *testing.T) {
+	prog := NewProgTemplate(`
+	csrrs a0, mvendorid, x0
+	csrrs a1, marchid, x0
+	csrrs a2, mimpid, x0
+	csrrs a3, mhartid, x0
+	csrrw x0, mhartid, a3
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetHartId(3)
+	cpu.Reset()
+	for _, reg := range []uint8{RegA0, RegA1, RegA2, RegA3} {
+		cpu.SetReg(reg, 0xff)
+	}
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+	assertRegEq(t, cpu, RegA0, 0)
+	assertRegEq(t, cpu, RegA1, 0)
+	assertRegEq(t, cpu, RegA2, 0)
+	assertRegEq(t, cpu, RegA3, 3)
+	// they are read-only
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+}
+
+func TestWriteCounterCsr(t *testing.T) {
+	for _, csr := range []string{"cycle", "time", "instret"} {
+		prog := NewProgTemplate(`
+		li t0, 5
+		csrrs a1, {{.csr}}, x0
+		csrrw a0, {{.csr}}, t0
+		`).Execute(ProgArgs{"csr": csr})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+		cpu.SetReg(RegA0, 7)
+		for i := 0; i < 3; i++ {
+			cpu.Step()
+		}
+		// reading it is fine
+		assertRegEq(t, cpu, RegA1, 1)
+		assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+		assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr+8)
+		assertRegEq(t, cpu, RegA0, 7)
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	prog := NewProgTemplate(`
+	nop
+	nop
+	nop
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetTimebase(3)
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	if pc := cpu.Pc(); pc != cpu.initialAddr+12 {
+		t.Errorf("expected pc 0x%08x got 0x%08x", cpu.initialAddr+12, pc)
+	}
+	if n := cpu.Cycles(); n != 3 {
+		t.Errorf("expected 3 cycles got %d", n)
+	}
+	if n := cpu.Instret(); n != 3 {
+		t.Errorf("expected 3 instructions retired got %d", n)
+	}
+	if n := cpu.Time(); n != 9 {
+		t.Errorf("expected time 9 got %d", n)
+	}
+	if cpu.IsHalted() {
+		t.Errorf("the cpu halted early")
+	}
+	cpu.Execute()
+	if !cpu.IsHalted() {
+		t.Errorf("expected the cpu to halt")
+	}
+	cpu.SetPc(cpu.initialAddr)
+	if pc := cpu.Pc(); pc != cpu.initialAddr {
+		t.Errorf("expected pc 0x%08x got 0x%08x", cpu.initialAddr, pc)
+	}
+}
+
+func TestExecuteN(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 1
+	loop:
+	j loop
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	executed, halted := cpu.ExecuteN(100)
+	if executed != 100 || halted {
+		t.Errorf("expected 100 instructions without halting got %d, %v",
+			executed, halted)
+	}
+	assertRegEq(t, cpu, RegA0, 1)
+	if err := cpu.ExecuteWithLimit(10); err != ErrBudgetExhausted {
+		t.Errorf("expected ErrBudgetExhausted got %v", err)
+	}
+	assertCsrEq(t, cpu, CsrInstret, 110)
+
+	prog = NewProgTemplate(`
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu = NewDebugBoard(assemble(t, prog)).Cpu()
+	executed, halted = cpu.ExecuteN(100)
+	if executed != 2 || !halted {
+		t.Errorf("expected to halt after 2 instructions got %d, %v",
+			executed, halted)
+	}
+	if err := cpu.ExecuteWithLimit(100); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// fetching from 0 faults and the trap vector is 0 too, nothing ever
+	// retires but the step cap still stops it
+	prog = NewProgTemplate(`
+	jalr x0, 0(x0)
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu = NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetStepCap(1000)
+	if err := cpu.ExecuteWithLimit(100); err != ErrBudgetExhausted {
+		t.Errorf("expected ErrBudgetExhausted got %v", err)
+	}
+	assertCsrEq(t, cpu, CsrInstret, 1)
+}
+
+func TestFlush(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, -2
+	li t1, 'o'
+	sb t1, 0(t0)
+	li t1, 'k'
+	sb t1, 0(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.Cpu().Execute()
+	if output := board.output.String(); output != "" {
+		t.Errorf("expected output to be buffered got %q", output)
+	}
+	if err := board.board.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if output := board.output.String(); output != "ok" {
+		t.Errorf("expected output %q got %q", "ok", output)
+	}
+}
+
+// promptReader records the output written before each read
+type promptReader struct {
+	output  *strings.Builder
+	prompts []string
+}
+
+func (r *promptReader) Read(b []uint8) (int, error) {
+	r.prompts = append(r.prompts, r.output.String())
+	b[0] = 'y'
+	return 1, nil
+}
+
+func TestFlushBeforeRead(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, -2
+	li t1, '?'
+	sb t1, 0(t0)
+	lbu a0, 0(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	output := strings.Builder{}
+	in := &promptReader{output: &output}
+	cpu := NewBoard(assemble(t, prog), in, &output).Cpu()
+	cpu.Execute()
+	if len(in.prompts) != 1 || in.prompts[0] != "?" {
+		t.Errorf("expected the prompt to be flushed before reading got %q",
+			in.prompts)
+	}
+	assertRegEq(t, cpu, RegA0, 'y')
+}
+
+func TestX0WriteHook(t *testing.T) {
+	prog := NewProgTemplate(`
+	li x1, 1
+	li x2, 2
+	nop
+	add x0, x1, x2
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	type warning struct{ pc, inst uint32 }
+	var warnings []warning
+	cpu.SetX0WriteHook(func(pc, inst uint32) {
+		warnings = append(warnings, warning{pc, inst})
+	})
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+	}
+	expected := warning{cpu.initialAddr + 12, 0x00208033}
+	if len(warnings) != 1 || warnings[0] != expected {
+		t.Errorf("expected a single warning %v got %v", expected, warnings)
+	}
+	if v := cpu.GetReg(RegZero); v != 0 {
+		t.Errorf("expected x0 to stay 0 got %d", v)
+	}
+	if v := cpu.GetReg(1) + cpu.GetReg(2); v != 3 {
+		t.Errorf("expected x1, x2 to be unaffected")
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, -2
+	li t1, 'a'
+	loop:
+	sb t1, 0(t0)
+	j loop
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.board.SetLimits(0, 100)
+	if err := board.board.Run(); err != ErrOutputLimit {
+		t.Errorf("expected ErrOutputLimit got %v", err)
+	}
+	board.board.Flush()
+	if output := board.output.String(); output != strings.Repeat("a", 100) {
+		t.Errorf("expected output to be cut at 100 bytes got %d bytes",
+			len(output))
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	prog := NewProgTemplate(`
+	loop:
+	j loop
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.board.SetLimits(1000, 0)
+	if err := board.board.Run(); err != ErrBudgetExhausted {
+		t.Errorf("expected ErrBudgetExhausted got %v", err)
+	}
+	if instret := board.Cpu().instret; instret != 1000 {
+		t.Errorf("expected to stop after 1000 instructions got %d", instret)
+	}
+}
+
+func TestMissingExtension(t *testing.T) {
+	tests := []struct {
+		inst      uint32
+		extension string
+	}{
+		// fadd.s ft0, ft1, ft2
+		{0x0020f053, "F"},
+		// fadd.d ft0, ft1, ft2
+		{0x0220f053, "D"},
+		// flw ft0, 0(a0)
+		{0x00052007, "F"},
+		{0xffffffff, ""},
+	}
+	for _, test := range tests {
+		prog := NewProgTemplate(`.word {{.inst}}`).Execute(
+			ProgArgs{"inst": test.inst})
+		t.Log("prog: ", prog)
+		board := NewDebugBoard(assemble(t, prog))
+		board.Cpu().SetHaltOnException(true)
+		board.Cpu().Execute()
+		fault := board.board.LastFault()
+		if fault == nil || fault.Cause != ExceptionIllegalInstruction {
+			t.Fatalf("expected an illegal instruction fault got %v", fault)
+		}
+		if fault.MissingExtension != test.extension {
+			t.Errorf("0x%08x: expected missing extension %q got %q",
+				test.inst, test.extension, fault.MissingExtension)
+		}
+		mentioned := strings.Contains(fault.String(), "extension is not supported")
+		if mentioned != (test.extension != "") {
+			t.Errorf("0x%08x: unexpected diagnostic %q", test.inst, fault)
+		}
+	}
+}
+
+func TestUninitializedReadHook(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 1
+	add a1, a0, a0
+	add a2, a1, s1
+	add a3, s1, zero
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	type warning struct {
+		pc  uint32
+		reg uint8
+	}
+	var warnings []warning
+	cpu.SetUninitializedReadHook(func(pc uint32, reg uint8) {
+		warnings = append(warnings, warning{pc, reg})
+	})
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+	}
+	// s1 is reported once and x0 never is
+	expected := warning{cpu.initialAddr + 8, RegS1}
+	if len(warnings) != 1 || warnings[0] != expected {
+		t.Errorf("expected a single warning %v got %v", expected, warnings)
+	}
+	// reads by the host aren't reported
+	cpu.GetReg(RegS2)
+	if len(warnings) != 1 {
+		t.Errorf("unexpected warning for a host read %v", warnings)
+	}
+}
+
+func TestLastFault(t *testing.T) {
+	prog := NewProgTemplate(`
+	nop
+	.word 0xffffffff
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	cpu := board.Cpu()
+	cpu.SetHaltOnException(true)
+	cpu.Execute()
+	expected := Fault{
+		Cause:     ExceptionIllegalInstruction,
+		CauseName: "illegal instruction",
+		Tval:      0xffffffff,
+		Epc:       cpu.initialAddr + 4,
+		Inst:      0xffffffff,
+		Disasm:    ".word 0xffffffff",
+	}
+	fault := board.board.LastFault()
+	if fault == nil {
+		t.Fatal("expected a fault to be recorded")
+	}
+	if *fault != expected {
+		t.Errorf("expected %+v got %+v", expected, *fault)
+	}
+	// only the nop retired and the hart stopped at the faulting word
+	assertPcEq(t, cpu, cpu.initialAddr+4)
+	if cpu.instret != 1 {
+		t.Errorf("expected 1 retired instruction got %d", cpu.instret)
+	}
+
+	prog = NewProgTemplate(`ebreak`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu = NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetHaltOnException(true)
+	cpu.Execute()
+	expected = Fault{
+		Cause:     ExceptionBreakpoint,
+		CauseName: "breakpoint",
+		Tval:      cpu.initialAddr,
+		Epc:       cpu.initialAddr,
+		Inst:      0x00100073,
+		Disasm:    "ebreak",
+	}
+	if fault := cpu.LastFault(); fault == nil || *fault != expected {
+		t.Errorf("expected %+v got %+v", expected, fault)
+	}
+	// the trap should not have been taken
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+}
+
+func TestRunOffEnd(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 1
+	addi a0, a0, 1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetHaltOnException(true)
+	cpu.Execute()
+	end := cpu.initialAddr + 8
+	fault := cpu.LastFault()
+	if fault == nil || fault.Cause != ExceptionInstructionAccessFault ||
+		fault.Epc != end || fault.Tval != end {
+		t.Fatalf("expected an instruction access fault at 0x%08x got %v",
+			end, fault)
+	}
+	if !strings.Contains(fault.String(), "run off its end") {
+		t.Errorf("expected the report to explain the fault got %q", fault)
+	}
+	assertRegEq(t, cpu, RegA0, 2)
+
+	// without halting the trap is taken
+	cpu = NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionInstructionAccessFault)
+	assertCsrEq(t, cpu, CsrEpc|CsrM, end)
+	assertCsrEq(t, cpu, CsrTval|CsrM, end)
+}
+
 func TestProgs(t *testing.T) {
 	files, err := ioutil.ReadDir("./testprogs")
 	if err != nil {
@@ -1099,15 +2611,35 @@ func TestProgs(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		board := NewDebugBoard(compile(string(prog)))
+		meta, _ := parseProgMeta("") // defaults
+		metafile := "./testprogs/" + f.Name() + ".meta"
+		if data, err := ioutil.ReadFile(metafile); err == nil {
+			meta, err = parseProgMeta(string(data))
+			if err != nil {
+				t.Errorf("Failed to parse %s: %s", metafile, err)
+				continue
+			}
+		}
+		board := NewDebugBoard(compile(t, string(prog),
+			strings.Fields(meta.Cflags)...))
 		cpu := board.Cpu()
-		cpu.Execute()
+		for !cpu.halt && cpu.instret < meta.MaxInstructions {
+			cpu.Step()
+		}
+		board.board.Flush()
 		output := strings.TrimSpace(board.output.String())
 		if output != "" {
 			t.Log("output: ", output)
 		}
-		if cpu.GetCsr(CsrHalt) != 0 {
-			t.Errorf("Execution failed")
+		reason := "halt"
+		if !cpu.halt {
+			reason = "limit"
+		}
+		if reason != meta.HaltReason {
+			t.Errorf("Expected halt reason %s got %s", meta.HaltReason, reason)
+		} else if code, _ := cpu.GetCsr(CsrHalt); cpu.halt && code != meta.ExitCode {
+			t.Errorf("Execution failed, expected exit code %d got %d",
+				meta.ExitCode, code)
 		}
 
 		outfile := "./testprogs/" + f.Name() + ".out"
@@ -1125,3 +2657,625 @@ func TestProgs(t *testing.T) {
 	}
 
 }
+
+func TestCountersDevice(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, {{.counters}}
+	lw a0, {{.cycle}}(t0)
+	lw a1, {{.instret}}(t0)
+	lw a2, {{.instrethi}}(t0)
+	csrrs a3, instret, x0
+	`).Execute(ProgArgs{
+		"counters":  BoardCountersAddr,
+		"cycle":     CountersCycle,
+		"instret":   CountersInstret,
+		"instrethi": CountersInstret + 4,
+	})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.priv = PrivUser
+	for i := 0; i < 5; i++ {
+		cpu.Step()
+	}
+	if cpu.lastFault != nil {
+		t.Fatalf("unexpected fault: %s", cpu.lastFault)
+	}
+	// the low word is read 2 instructions before the csr
+	assertRegEq(t, cpu, RegA1, cpu.GetReg(RegA3)-2)
+	assertRegEq(t, cpu, RegA2, 0)
+}
+
+func TestCountersLatch(t *testing.T) {
+	cpu := NewDebugBoard(nil).Cpu()
+	c := NewCounters(cpu)
+	cpu.instret = 0x1ffffffff
+	if v := c.LoadWord(CountersInstret); v != 0xffffffff {
+		t.Errorf("expected the low word 0xffffffff got 0x%08x", v)
+	}
+	// the high word read right after the low one is the latched one
+	cpu.instret++
+	if v := c.LoadWord(CountersInstret + 4); v != 1 {
+		t.Errorf("expected the latched high word 1 got 0x%08x", v)
+	}
+	// without a matching low word read it is the current one
+	if v := c.LoadWord(CountersInstret + 4); v != 2 {
+		t.Errorf("expected the current high word 2 got 0x%08x", v)
+	}
+	c.LoadWord(CountersCycle)
+	cpu.ticks = 5 << 32
+	if v := c.LoadWord(CountersTime + 4); v != 5 {
+		t.Errorf("expected the current time high word 5 got 0x%08x", v)
+	}
+}
+
+// storeRecorder is a device that remembers the stores made to it
+type storeRecorder struct {
+	stores []recordedStore
+}
+
+type recordedStore struct {
+	offset uint32
+	v      uint32
+	size   int
+}
+
+func (r *storeRecorder) LoadWord(addr uint32) uint32     { return 0 }
+func (r *storeRecorder) LoadHalfWord(addr uint32) uint16 { return 0 }
+func (r *storeRecorder) LoadByte(addr uint32) uint8      { return 0 }
+func (r *storeRecorder) StoreWord(addr uint32, v uint32) {
+	r.stores = append(r.stores, recordedStore{addr, v, 4})
+}
+func (r *storeRecorder) StoreHalfWord(addr uint32, v uint16) {
+	r.stores = append(r.stores, recordedStore{addr, uint32(v), 2})
+}
+func (r *storeRecorder) StoreByte(addr uint32, v uint8) {
+	r.stores = append(r.stores, recordedStore{addr, uint32(v), 1})
+}
+
+func TestAddDevice(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, {{.device}}
+	sw t0, 4(t0)
+	li t1, 0x5a
+	sb t1, 9(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(ProgArgs{"device": 0x10000})
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog)).board
+	dev := &storeRecorder{}
+	board.AddDevice(0x10000, 0x10, dev)
+	board.Execute()
+	if fault := board.LastFault(); fault != nil {
+		t.Fatalf("unexpected fault: %s", fault)
+	}
+	// the device sees offsets into its range
+	expected := []recordedStore{{4, 0x10000, 4}, {9, 0x5a, 1}}
+	if !reflect.DeepEqual(dev.stores, expected) {
+		t.Errorf("expected stores %v got %v", expected, dev.stores)
+	}
+}
+
+func TestRegisterSeed(t *testing.T) {
+	cpu := NewDebugBoard(assemble(t, "nop")).Cpu()
+	cpu.SetRegisterSeed(1)
+	cpu.Reset()
+	assertRegEq(t, cpu, 0, 0)
+	assertRegEq(t, cpu, 1, 0x89025cc1)
+	assertRegEq(t, cpu, 2, 0x658eec67)
+	assertRegEq(t, cpu, 3, 0xfb32555e)
+	assertRegEq(t, cpu, 31, 0x12c5d084)
+
+	cpu.SetRegisterSeed(0)
+	cpu.Reset()
+	assertRegEq(t, cpu, 1, 0)
+}
+
+func TestPcRelativeBase(t *testing.T) {
+	cpu := NewDebugBoard(assemble(t, "nop")).Cpu()
+	// once compressed instructions exist pc won't always be 4 past the
+	// instruction, simulate a 2 byte advance
+	tests := []struct {
+		inst uint32
+		reg  uint8
+		v    uint32
+		pc   uint32
+	}{
+		// auipc a0, 1
+		{0x00001517, RegA0, 0x1200, 0x202},
+		// jal ra, 8
+		{0x008000ef, RegRA, 0x202, 0x208},
+		// beq x0, x0, -4
+		{0xfe000ee3, 0, 0, 0x1fc},
+	}
+	for _, test := range tests {
+		cpu.instPc = 0x200
+		cpu.pc = 0x202
+		cpu.decode(test.inst)
+		if test.reg != 0 {
+			assertRegEq(t, cpu, test.reg, test.v)
+		}
+		if cpu.pc != test.pc {
+			t.Errorf("expected pc 0x%08x after 0x%08x got 0x%08x",
+				test.pc, test.inst, cpu.pc)
+		}
+	}
+}
+
+func TestAMO(t *testing.T) {
+	tests := []struct {
+		op      string
+		mem     uint32
+		rs2     uint32
+		newMem  uint32
+		rdValue uint32
+	}{
+		{"amoswap.w", 5, 7, 7, 5},
+		{"amoadd.w", 5, 7, 12, 5},
+		{"amoxor.w", 0x0f, 0xff, 0xf0, 0x0f},
+		{"amoand.w", 0x0f, 0xfc, 0x0c, 0x0f},
+		{"amoor.w", 0x0f, 0xf0, 0xff, 0x0f},
+		{"amomin.w", 0xffffffff, 1, 0xffffffff, 0xffffffff},
+		{"amomax.w", 0xffffffff, 1, 1, 0xffffffff},
+		{"amominu.w", 0xffffffff, 1, 1, 0xffffffff},
+		{"amomaxu.w", 0xffffffff, 1, 0xffffffff, 0xffffffff},
+	}
+	for _, test := range tests {
+		prog := NewProgTemplate(`
+		la t0, data
+		li t1, {{.rs2}}
+		{{.op}} t2, t1, (t0)
+		lw a3, 0(t0)
+		li t1, 1
+		csrrw x0, 0x3ff, t1
+		data:
+		.word {{.mem}}
+		`).Execute(ProgArgs{"op": test.op, "mem": test.mem, "rs2": test.rs2})
+		t.Log("prog: ", prog)
+		cpu := NewDebugBoard(assembleArch(t, prog, _Rv32A)).Cpu()
+		cpu.Execute()
+		assertRegEq(t, cpu, RegT2, test.rdValue)
+		assertRegEq(t, cpu, RegA3, test.newMem)
+	}
+}
+
+func TestAMOLoadFault(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li s0, 0x10000
+	li a0, 1
+	amoadd.w a1, a0, (s0)
+	nop
+	handler:
+	csrrs a2, mcause, x0
+	csrrs a3, mtval, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assembleArch(t, prog, _Rv32A)).board
+	data := NewRam(4)
+	// the load half of the amo faults, the store half would not
+	if err := board.Mmu().AddRangePerm(0x10000, 4, data, PermW); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	cpu := board.Cpu()
+	cpu.Execute()
+	assertRegEq(t, cpu, RegA2, ExceptionStoreAccessFault)
+	assertRegEq(t, cpu, RegA3, 0x10000)
+	if v := data.LoadWord(0); v != 0 {
+		t.Errorf("expected the memory to be left alone got 0x%08x", v)
+	}
+}
+
+func TestSpinlock(t *testing.T) {
+	prog := NewProgTemplate(`
+	la s0, lock
+	la s1, counter
+	li s2, 5
+	loop:
+	acquire:
+	lr.w t0, (s0)
+	bnez t0, acquire
+	li t1, 1
+	sc.w t2, t1, (s0)
+	bnez t2, acquire
+	lw t3, 0(s1)
+	addi t3, t3, 1
+	sw t3, 0(s1)
+	amoswap.w x0, x0, (s0)
+	addi s2, s2, -1
+	bnez s2, loop
+	lw a0, 0(s0)
+	lw a1, 0(s1)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	lock:
+	.word 0
+	counter:
+	.word 0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assembleArch(t, prog, _Rv32A)).Cpu()
+	cpu.Execute()
+	if cpu.LastFault() != nil {
+		t.Fatalf("unexpected exception: %s", cpu.LastFault())
+	}
+	assertRegEq(t, cpu, RegA0, 0)
+	assertRegEq(t, cpu, RegA1, 5)
+}
+
+func TestSCWithoutReservation(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, data
+	la t3, other
+	lr.w t1, (t3)
+	li t1, 7
+	sc.w t2, t1, (t0)
+	lw a0, 0(t0)
+	sc.w a1, t1, (t3)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	data:
+	.word 3
+	other:
+	.word 0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assembleArch(t, prog, _Rv32A)).Cpu()
+	cpu.Execute()
+	// the reservation is for another address
+	assertRegEq(t, cpu, RegT2, 1)
+	assertRegEq(t, cpu, RegA0, 3)
+	// the failed sc.w cleared the reservation
+	assertRegEq(t, cpu, RegA1, 1)
+}
+
+func TestTrapClearsReservation(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	la t0, data
+	lr.w t1, (t0)
+	ecall
+	resume:
+	li t1, 7
+	sc.w t2, t1, (t0)
+	lw a0, 0(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	handler:
+	j resume
+	data:
+	.word 3
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assembleArch(t, prog, _Rv32A)).Cpu()
+	cpu.Execute()
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionEcallM)
+	assertRegEq(t, cpu, RegT2, 1)
+	assertRegEq(t, cpu, RegA0, 3)
+}
+
+func TestMRET(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	li a0, 1
+	ecall
+	addi a0, a0, 1
+	csrrs s2, mstatus, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	handler:
+	csrrs s1, mstatus, x0
+	addi a1, a1, 1
+	csrrs t0, mepc, x0
+	addi t0, t0, 4
+	csrrw x0, mepc, t0
+	mret
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	assertRegEq(t, cpu, RegA0, 2)
+	assertRegEq(t, cpu, RegA1, 1)
+	// the handler ran with interrupts disabled and MIE was restored
+	assertRegEq(t, cpu, RegS1, MstatusMPIE|PrivMachine<<MstatusMPPShift)
+	assertRegEq(t, cpu, RegS2, MstatusMIE|MstatusMPIE)
+}
+
+func TestMstatus(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, -1
+	csrrw x0, mstatus, t0
+	csrrs a0, mstatus, x0
+	li t0, 0x1000
+	csrrw x0, mstatus, t0
+	csrrs a1, mstatus, x0
+	li t0, 0x800
+	csrrw x0, mstatus, t0
+	csrrs a2, mstatus, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.Execute()
+	// reserved bits read as zero
+	assertRegEq(t, cpu, RegA0, MstatusSIE|MstatusMIE|MstatusSPIE|
+		MstatusMPIE|MstatusSPP|MstatusMPP|MstatusSUM|MstatusMXR)
+	// the reserved mode 2 isn't taken
+	assertRegEq(t, cpu, RegA1, MstatusMPP)
+	assertRegEq(t, cpu, RegA2, PrivSupervisor<<MstatusMPPShift)
+}
+
+func TestMretToUser(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	la t0, user
+	csrrw x0, mepc, t0
+	mret
+	user:
+	csrrs a0, mscratch, x0
+	handler:
+	csrrs s1, mstatus, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.Execute()
+	// MPP was user mode after reset so mret dropped to it and the
+	// machine mode csr access trapped back
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+	assertRegEq(t, cpu, RegS1, PrivUser<<MstatusMPPShift)
+	if cpu.priv != PrivMachine {
+		t.Errorf("expected the handler to run in machine mode got %d", cpu.priv)
+	}
+}
+
+func TestNestedTrap(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li t0, 8
+	csrrw x0, mstatus, t0
+	first:
+	ecall
+	csrrs s8, mstatus, x0
+	la s9, first
+	la s10, second
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	handler:
+	bnez s0, nested
+	li s0, 1
+	csrrs s3, mepc, x0
+	csrrs s4, mstatus, x0
+	second:
+	ebreak
+	csrrs s7, mstatus, x0
+	csrrs s11, mepc, x0
+	csrrw x0, mstatus, s4
+	addi t0, s3, 4
+	csrrw x0, mepc, t0
+	mret
+	nested:
+	csrrs s5, mstatus, x0
+	csrrs s6, mepc, x0
+	csrrs a1, mcause, x0
+	addi t0, s6, 4
+	csrrw x0, mepc, t0
+	mret
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	first, second := cpu.GetReg(RegS9), cpu.GetReg(RegS10)
+	mpp := uint32(PrivMachine << MstatusMPPShift)
+	assertRegEq(t, cpu, RegS3, first)
+	assertRegEq(t, cpu, RegS4, MstatusMPIE|mpp)
+	// the nested trap stacked the disabled MIE over MPIE
+	assertRegEq(t, cpu, RegS5, mpp)
+	assertRegEq(t, cpu, RegS6, second)
+	assertRegEq(t, cpu, RegA1, ExceptionBreakpoint)
+	// the inner mret left interrupts disabled, set MPIE and dropped MPP
+	// to user mode, the handler restores its saved mstatus
+	assertRegEq(t, cpu, RegS7, MstatusMPIE)
+	// mepc still holds the nested return address, the handler returns
+	// through its saved copy
+	assertRegEq(t, cpu, RegS11, second+4)
+	assertRegEq(t, cpu, RegS8, MstatusMIE|MstatusMPIE)
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionBreakpoint)
+}
+
+func TestSetPrivilege(t *testing.T) {
+	prog := NewProgTemplate(`
+	csrrs a0, mscratch, x0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetCsr(CsrScratch|CsrM, 5)
+	if err := cpu.SetPrivilege(2); err != ErrInvalidPrivilege {
+		t.Errorf("expected ErrInvalidPrivilege for the reserved mode got %v", err)
+	}
+
+	if err := cpu.SetPrivilege(PrivUser); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if mode := cpu.GetPrivilege(); mode != PrivUser {
+		t.Errorf("expected mode %d got %d", PrivUser, mode)
+	}
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+	assertRegEq(t, cpu, RegA0, 0)
+
+	cpu.SetCsr(CsrCause|CsrM, 0)
+	cpu.SetPc(cpu.initialAddr)
+	if err := cpu.SetPrivilege(PrivMachine); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+	assertRegEq(t, cpu, RegA0, 5)
+}
+
+func TestPcRelativeGlobal(t *testing.T) {
+	prog := NewProgTemplate(`
+	1:
+	auipc t0, %pcrel_hi(value)
+	addi t0, t0, %pcrel_lo(1b)
+	lw t1, 0(t0)
+	addi t1, t1, 2
+	sw t1, 0(t0)
+	lla a1, value
+	lw a0, 0(a1)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	value:
+	.word 40
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.Execute()
+	assertRegEq(t, cpu, RegA0, 42)
+	assertRegEq(t, cpu, RegA1, cpu.GetReg(RegT0))
+}
+
+func TestMisalignedTrap(t *testing.T) {
+	tests := []struct {
+		inst  string
+		cause uint32
+		tval  uint32
+	}{
+		{"lw x1, 1(x0)", ExceptionLoadAddressMisaligned, 1},
+		{"lh x1, 3(x0)", ExceptionLoadAddressMisaligned, 3},
+		{"lhu x1, 5(x0)", ExceptionLoadAddressMisaligned, 5},
+		{"sw x1, 2(x0)", ExceptionStoreAddressMisaligned, 2},
+		{"sh x1, 7(x0)", ExceptionStoreAddressMisaligned, 7},
+	}
+	for _, test := range tests {
+		t.Log("prog: ", test.inst)
+		cpu := NewDebugBoard(assemble(t, test.inst)).Cpu()
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, test.cause)
+		assertCsrEq(t, cpu, CsrTval|CsrM, test.tval)
+		assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr)
+	}
+
+	// byte accesses are never misaligned
+	cpu := NewDebugBoard(assemble(t, "lb x1, 0x101(x0)")).Cpu()
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, 0)
+}
+
+func TestAllowedOpcodes(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 5
+	add a0, a0, a0
+	ecall
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetAllowedOpcodes(OP_IMM, OP)
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	assertRegEq(t, cpu, RegA0, 10)
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionIllegalInstruction)
+	assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.initialAddr+8)
+
+	cpu.Reset()
+	cpu.SetAllowedOpcodes()
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionEcallM)
+}
+
+func TestUnmappedAccessFault(t *testing.T) {
+	tests := []struct {
+		inst  string
+		cause uint32
+		tval  uint32
+	}{
+		{"lw x1, 0x10(x0)", ExceptionLoadAccessFault, 0x10},
+		{"lbu x1, 0x11(x0)", ExceptionLoadAccessFault, 0x11},
+		{"sw x1, 0x10(x0)", ExceptionStoreAccessFault, 0x10},
+		{"sb x1, 0x13(x0)", ExceptionStoreAccessFault, 0x13},
+		// the program is 4 bytes long so this is past its end
+		{"lh x1, 0x104(x0)", ExceptionLoadAccessFault, 0x104},
+	}
+	for _, test := range tests {
+		t.Log("prog: ", test.inst)
+		cpu := NewDebugBoard(assemble(t, test.inst)).Cpu()
+		cpu.SetReg(1, 0x1234)
+		cpu.Step()
+		assertCsrEq(t, cpu, CsrCause|CsrM, test.cause)
+		assertCsrEq(t, cpu, CsrTval|CsrM, test.tval)
+		assertRegEq(t, cpu, 1, 0x1234)
+	}
+}
+
+func TestRegNames(t *testing.T) {
+	tests := map[int]string{
+		RegZero: "zero",
+		RegRA:   "ra",
+		RegS0:   "s0",
+		RegS1:   "s1",
+		RegA0:   "a0",
+		RegA7:   "a7",
+		RegS2:   "s2",
+		RegS11:  "s11",
+		28:      "t3",
+		31:      "t6",
+	}
+	if len(_RegNames) != 32 {
+		t.Fatalf("expected 32 register names, got %d", len(_RegNames))
+	}
+	for idx, name := range tests {
+		if _RegNames[idx] != name {
+			t.Errorf("x%d: expected %s, got %s", idx, name, _RegNames[idx])
+		}
+	}
+}
+
+func TestOverflowHook(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, -1
+	srli a0, a0, 1
+	addi a1, a0, -1
+	addi a0, a0, 1
+	sub a2, a0, a1
+	add a3, a1, a1
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	var pcs []uint32
+	cpu.SetOverflowHook(func(pc, inst uint32) {
+		pcs = append(pcs, pc)
+	})
+	cpu.Execute()
+	assertRegEq(t, cpu, RegA0, 0x80000000)
+	assertRegEq(t, cpu, RegA2, 0x00000002)
+	assertRegEq(t, cpu, RegA3, 0xfffffffc)
+	expected := []uint32{
+		cpu.initialAddr + 12,
+		cpu.initialAddr + 16,
+		cpu.initialAddr + 20,
+	}
+	if !reflect.DeepEqual(pcs, expected) {
+		t.Errorf("expected overflows at %x got %x", expected, pcs)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import "fmt"
+
+// Format is the encoding format of an instruction
+type Format int
+
+const (
+	FormatR Format = iota
+	FormatI
+	FormatS
+	FormatB
+	FormatU
+	FormatJ
+)
+
+func (f Format) String() string {
+	return "RISBUJ"[f : f+1]
+}
+
+var _Formats = map[uint32]Format{
+	OP:        FormatR,
+	OP_AMO:    FormatR,
+	OP_IMM:    FormatI,
+	OP_LOAD:   FormatI,
+	OP_JALR:   FormatI,
+	OP_FENCE:  FormatI,
+	OP_SYSTEM: FormatI,
+	OP_STORE:  FormatS,
+	OP_BRANCH: FormatB,
+	OP_LUI:    FormatU,
+	OP_AUIPC:  FormatU,
+	OP_JAL:    FormatJ,
+}
+
+// mnemonicKey is the fields that pick the mnemonic of an instruction.
+// funct is the part of the encoding past funct3 that tells instructions
+// apart: funct7 for OP and the immediate shifts, funct5 for the atomics
+// and funct12 for the privileged instructions. Opcodes without a funct3
+// use 0 for it.
+type mnemonicKey struct {
+	opcode, funct3, funct uint32
+}
+
+var _Mnemonics = map[mnemonicKey]string{
+	{OP_LUI, 0, 0}:   "lui",
+	{OP_AUIPC, 0, 0}: "auipc",
+	{OP_JAL, 0, 0}:   "jal",
+	{OP_JALR, 0, 0}:  "jalr",
+
+	{OP_BRANCH, FUNCT_BEQ, 0}:  "beq",
+	{OP_BRANCH, FUNCT_BNE, 0}:  "bne",
+	{OP_BRANCH, FUNCT_BLT, 0}:  "blt",
+	{OP_BRANCH, FUNCT_BGE, 0}:  "bge",
+	{OP_BRANCH, FUNCT_BLTU, 0}: "bltu",
+	{OP_BRANCH, FUNCT_BGEU, 0}: "bgeu",
+
+	{OP_LOAD, 0, 0}:  "lb",
+	{OP_LOAD, 1, 0}:  "lh",
+	{OP_LOAD, 2, 0}:  "lw",
+	{OP_LOAD, 4, 0}:  "lbu",
+	{OP_LOAD, 5, 0}:  "lhu",
+	{OP_STORE, 0, 0}: "sb",
+	{OP_STORE, 1, 0}: "sh",
+	{OP_STORE, 2, 0}: "sw",
+
+	{OP_IMM, FUNCT_ADDI, 0}:      "addi",
+	{OP_IMM, FUNCT_SLTI, 0}:      "slti",
+	{OP_IMM, FUNCT_SLTUI, 0}:     "sltiu",
+	{OP_IMM, FUNCT_XORI, 0}:      "xori",
+	{OP_IMM, FUNCT_ORI, 0}:       "ori",
+	{OP_IMM, FUNCT_ANDI, 0}:      "andi",
+	{OP_IMM, FUNCT_SLLI, 0}:      "slli",
+	{OP_IMM, FUNCT_SRXI, 0}:      "srli",
+	{OP_IMM, FUNCT_SRXI, 0x20}:   "srai",
+	{OP, FUNCT_ADD_SUB, 0}:       "add",
+	{OP, FUNCT_ADD_SUB, 0x20}:    "sub",
+	{OP, FUNCT_SLL, 0}:           "sll",
+	{OP, FUNCT_SLT, 0}:           "slt",
+	{OP, FUNCT_SLTU, 0}:          "sltu",
+	{OP, FUNCT_XOR, 0}:           "xor",
+	{OP, FUNCT_SRX, 0}:           "srl",
+	{OP, FUNCT_SRX, 0x20}:        "sra",
+	{OP, FUNCT_OR, 0}:            "or",
+	{OP, FUNCT_AND, 0}:           "and",
+	{OP_FENCE, FUNCT_FENCE, 0}:   "fence",
+	{OP_FENCE, FUNCT_FENCE_I, 0}: "fence.i",
+
+	{OP_AMO, FUNCT_AMO_W, FUNCT_LR}:      "lr.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_SC}:      "sc.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOADD}:  "amoadd.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOSWAP}: "amoswap.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOXOR}:  "amoxor.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOOR}:   "amoor.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOAND}:  "amoand.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOMIN}:  "amomin.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOMAX}:  "amomax.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOMINU}: "amominu.w",
+	{OP_AMO, FUNCT_AMO_W, FUNCT_AMOMAXU}: "amomaxu.w",
+
+	{OP_SYSTEM, FUNCT_CSRRW, 0}:                   "csrrw",
+	{OP_SYSTEM, FUNCT_CSRRS, 0}:                   "csrrs",
+	{OP_SYSTEM, FUNCT_CSRRC, 0}:                   "csrrc",
+	{OP_SYSTEM, FUNCT_CSRRWI, 0}:                  "csrrwi",
+	{OP_SYSTEM, FUNCT_CSRRSI, 0}:                  "csrrsi",
+	{OP_SYSTEM, FUNCT_CSRRCI, 0}:                  "csrrci",
+	{OP_SYSTEM, FUNCT_PRIV, PRIV_ECALL}:           "ecall",
+	{OP_SYSTEM, FUNCT_PRIV, PRIV_EBREAK}:          "ebreak",
+	{OP_SYSTEM, FUNCT_PRIV, PRIV_SRET}:            "sret",
+	{OP_SYSTEM, FUNCT_PRIV, PRIV_MRET}:            "mret",
+	{OP_SYSTEM, FUNCT_PRIV, PRIV_WFI}:             "wfi",
+	{OP_SYSTEM, FUNCT_PRIV, PRIV_SFENCE_VMA << 5}: "sfence.vma",
+}
+
+// keyOf extracts the fields of inst that pick its mnemonic
+func keyOf(inst uint32) mnemonicKey {
+	opcode := inst & 0x7f
+	funct3 := bitrange(inst, 12, 3)
+	switch opcode {
+	case OP_LUI, OP_AUIPC, OP_JAL:
+		// funct3 is part of the immediate
+		return mnemonicKey{opcode, 0, 0}
+	case OP:
+		return mnemonicKey{opcode, funct3, bitrange(inst, 25, 7)}
+	case OP_IMM:
+		if funct3 == FUNCT_SLLI || funct3 == FUNCT_SRXI {
+			return mnemonicKey{opcode, funct3, bitrange(inst, 25, 7)}
+		}
+	case OP_AMO:
+		// the low bits of funct7 are the aq/rl ordering bits
+		return mnemonicKey{opcode, funct3, bitrange(inst, 27, 5)}
+	case OP_SYSTEM:
+		if funct3 != FUNCT_PRIV {
+			break
+		}
+		// sfence.vma has its operands where the others have funct12
+		if bitrange(inst, 25, 7) == PRIV_SFENCE_VMA {
+			if bitrange(inst, 7, 5) != 0 {
+				return mnemonicKey{opcode, funct3, ^uint32(0)}
+			}
+			return mnemonicKey{opcode, funct3, PRIV_SFENCE_VMA << 5}
+		}
+		return mnemonicKey{opcode, funct3, bitrange(inst, 20, 12)}
+	}
+	return mnemonicKey{opcode, funct3, 0}
+}
+
+// Instruction is a decoded instruction. Fields the format doesn't have
+// are left zero, Imm is sign extended except for the U format where it
+// holds the upper 20 bits unshifted. A compressed instruction is decoded
+// as the instruction it expands to, with Raw holding its parcel and a
+// Length of 2.
+type Instruction struct {
+	Raw      uint32
+	Length   uint8
+	Opcode   uint8
+	Format   Format
+	Mnemonic string
+	Rd       uint8
+	Rs1      uint8
+	Rs2      uint8
+	Imm      uint32
+}
+
+// Decode decodes inst without executing it. When its low parcel is a
+// compressed instruction the high one is ignored.
+func Decode(inst uint32) (Instruction, error) {
+	if inst&0x3 != 0x3 {
+		expanded, ok := expandCompressed(uint16(inst))
+		if !ok {
+			return Instruction{}, fmt.Errorf("illegal instruction 0x%04x", inst&0xffff)
+		}
+		d, err := Decode(expanded)
+		d.Raw = inst & 0xffff
+		d.Length = 2
+		return d, err
+	}
+	mnemonic, ok := _Mnemonics[keyOf(inst)]
+	if !ok {
+		return Instruction{}, fmt.Errorf("illegal instruction 0x%08x", inst)
+	}
+	if mnemonic == "fence" && bitrange(inst, 28, 4) == 0x8 &&
+		bitrange(inst, 20, 8) == 0x33 {
+		mnemonic = "fence.tso"
+	}
+
+	d := Instruction{
+		Raw:      inst,
+		Length:   4,
+		Format:   _Formats[inst&0x7f],
+		Mnemonic: mnemonic,
+	}
+	switch d.Format {
+	case FormatR:
+		d.Opcode, d.Rd, _, d.Rs1, d.Rs2, _ = rtype(inst)
+	case FormatI:
+		d.Opcode, d.Rd, _, d.Rs1, d.Imm = itype(inst)
+	case FormatS:
+		d.Opcode, _, d.Rs1, d.Rs2, d.Imm = stype(inst)
+	case FormatB:
+		d.Opcode, _, d.Rs1, d.Rs2, d.Imm = btype(inst)
+	case FormatU:
+		d.Opcode, d.Rd, d.Imm = utype(inst)
+	case FormatJ:
+		d.Opcode, d.Rd, d.Imm = jtype(inst)
+	}
+	return d, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		raw  uint32
+		inst Instruction
+	}{
+		// add x3, x1, x2
+		{0x002081b3, Instruction{Opcode: OP, Format: FormatR,
+			Mnemonic: "add", Rd: 3, Rs1: 1, Rs2: 2}},
+		// addi x1, x2, -4
+		{0xffc10093, Instruction{Opcode: OP_IMM, Format: FormatI,
+			Mnemonic: "addi", Rd: 1, Rs1: 2, Imm: 0xfffffffc}},
+		// sw x5, 8(x6)
+		{0x00532423, Instruction{Opcode: OP_STORE, Format: FormatS,
+			Mnemonic: "sw", Rs1: 6, Rs2: 5, Imm: 8}},
+		// beq x3, x4, 8
+		{0x00418463, Instruction{Opcode: OP_BRANCH, Format: FormatB,
+			Mnemonic: "beq", Rs1: 3, Rs2: 4, Imm: 8}},
+		// lui x5, 0x12345
+		{0x123452b7, Instruction{Opcode: OP_LUI, Format: FormatU,
+			Mnemonic: "lui", Rd: 5, Imm: 0x12345}},
+		// jal x1, 16
+		{0x010000ef, Instruction{Opcode: OP_JAL, Format: FormatJ,
+			Mnemonic: "jal", Rd: 1, Imm: 16}},
+	}
+	for _, test := range tests {
+		test.inst.Raw = test.raw
+		test.inst.Length = 4
+		inst, err := Decode(test.raw)
+		if err != nil {
+			t.Errorf("unexpected error for 0x%08x: %s", test.raw, err)
+		}
+		if inst != test.inst {
+			t.Errorf("0x%08x: expected %+v got %+v", test.raw, test.inst, inst)
+		}
+	}
+}
+
+func TestDecodeIllegal(t *testing.T) {
+	if _, err := Decode(0xffffffff); err == nil {
+		t.Errorf("expected an error decoding an illegal instruction")
+	}
+	// mul x3, x1, x2, slli x1, x1, 32 and an sfence.vma with rd set
+	for _, raw := range []uint32{0x022081b3, 0x02009093, 0x120000f3} {
+		if _, err := Decode(raw); err == nil {
+			t.Errorf("expected an error decoding 0x%08x", raw)
+		}
+	}
+	// the all zero parcel is reserved
+	if _, err := Decode(0x0000); err == nil {
+		t.Errorf("expected an error decoding an illegal compressed instruction")
+	}
+}
+
+func TestDecodeCompressed(t *testing.T) {
+	// c.addi a0, -1 in the low parcel, the high one is ignored
+	inst, err := Decode(0xffff157d)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := Instruction{Raw: 0x157d, Length: 2, Opcode: OP_IMM,
+		Format: FormatI, Mnemonic: "addi", Rd: RegA0, Rs1: RegA0, Imm: 0xffffffff}
+	if inst != expected {
+		t.Errorf("expected %+v got %+v", expected, inst)
+	}
+}
+
+func TestDecodeMnemonic(t *testing.T) {
+	tests := []struct {
+		raw      uint32
+		mnemonic string
+	}{
+		{0x4020d093, "srai"},
+		{0x0020d093, "srli"},
+		{0x402081b3, "sub"},
+		{0x12000073, "sfence.vma"},
+		{0x8330000f, "fence.tso"},
+		{0x0ff0000f, "fence"},
+		{0x0000100f, "fence.i"},
+		{0x100122af, "lr.w"},
+		{0x0c3122af, "amoswap.w"},
+		{0x30200073, "mret"},
+		{0x10500073, "wfi"},
+		{0x3400d073, "csrrwi"},
+	}
+	for _, test := range tests {
+		inst, err := Decode(test.raw)
+		if err != nil {
+			t.Errorf("unexpected error for 0x%08x: %s", test.raw, err)
+			continue
+		}
+		if inst.Mnemonic != test.mnemonic {
+			t.Errorf("0x%08x: expected %s got %s", test.raw, test.mnemonic, inst.Mnemonic)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+func regName(idx uint8) string {
+	return _RegNames[idx]
+}
+
+// fenceSet renders the i/o/r/w bits of a fence predecessor or successor
+func fenceSet(bits uint32) string {
+	res := ""
+	for i, c := range "iorw" {
+		if bits&(8>>uint(i)) != 0 {
+			res += string(c)
+		}
+	}
+	return res
+}
+
+// disassemble renders a single instruction located at pc as assembly text
+func disassemble(inst uint32, pc uint32) (string, error) {
+	d, err := Decode(inst)
+	if err != nil {
+		return "", err
+	}
+	return render(&d, pc), nil
+}
+
+// render renders the decoded instruction d located at pc as assembly text
+func render(d *Instruction, pc uint32) string {
+	switch d.Opcode {
+	case OP_IMM:
+		switch d.Mnemonic {
+		case "slli", "srli", "srai":
+			return fmt.Sprintf("%s %s, %s, %d",
+				d.Mnemonic, regName(d.Rd), regName(d.Rs1), d.Imm&0x1f)
+		}
+		return fmt.Sprintf("%s %s, %s, %d",
+			d.Mnemonic, regName(d.Rd), regName(d.Rs1), int32(d.Imm))
+	case OP_LUI, OP_AUIPC:
+		return fmt.Sprintf("%s %s, 0x%x", d.Mnemonic, regName(d.Rd), d.Imm)
+	case OP:
+		return fmt.Sprintf("%s %s, %s, %s",
+			d.Mnemonic, regName(d.Rd), regName(d.Rs1), regName(d.Rs2))
+	case OP_JAL:
+		return fmt.Sprintf("jal %s, 0x%x", regName(d.Rd), pc+d.Imm)
+	case OP_JALR, OP_LOAD:
+		return fmt.Sprintf("%s %s, %d(%s)",
+			d.Mnemonic, regName(d.Rd), int32(d.Imm), regName(d.Rs1))
+	case OP_BRANCH:
+		return fmt.Sprintf("%s %s, %s, 0x%x",
+			d.Mnemonic, regName(d.Rs1), regName(d.Rs2), pc+d.Imm)
+	case OP_STORE:
+		return fmt.Sprintf("%s %s, %d(%s)",
+			d.Mnemonic, regName(d.Rs2), int32(d.Imm), regName(d.Rs1))
+	case OP_AMO:
+		if d.Mnemonic == "lr.w" {
+			return fmt.Sprintf("lr.w %s, (%s)", regName(d.Rd), regName(d.Rs1))
+		}
+		return fmt.Sprintf("%s %s, %s, (%s)",
+			d.Mnemonic, regName(d.Rd), regName(d.Rs2), regName(d.Rs1))
+	case OP_FENCE:
+		pred := bitrange(d.Raw, 24, 4)
+		succ := bitrange(d.Raw, 20, 4)
+		if d.Mnemonic != "fence" || pred == 0xf && succ == 0xf {
+			return d.Mnemonic
+		}
+		return fmt.Sprintf("fence %s, %s", fenceSet(pred), fenceSet(succ))
+	case OP_SYSTEM:
+		switch d.Mnemonic {
+		case "csrrw", "csrrs", "csrrc":
+			return fmt.Sprintf("%s %s, %s, %s",
+				d.Mnemonic, regName(d.Rd), CsrName(d.Imm&0xfff), regName(d.Rs1))
+		case "csrrwi", "csrrsi", "csrrci":
+			// the immediate is encoded in the rs1 field
+			return fmt.Sprintf("%s %s, %s, %d",
+				d.Mnemonic, regName(d.Rd), CsrName(d.Imm&0xfff), d.Rs1)
+		}
+		if d.Mnemonic == "sfence.vma" {
+			return fmt.Sprintf("sfence.vma %s, %s",
+				regName(d.Rs1), regName(uint8(d.Imm&0x1f)))
+		}
+	}
+	return d.Mnemonic
+}
+
+// Disassemble renders the instruction located at pc as assembly text
+// using ABI register names and the common pseudo instructions, anything
+// that doesn't decode is rendered as a .half or .word directive
+func Disassemble(inst uint32, pc uint32) string {
+	d, err := Decode(inst)
+	if err != nil {
+		if inst&0x3 != 0x3 {
+			return fmt.Sprintf(".half 0x%04x", inst&0xffff)
+		}
+		return fmt.Sprintf(".word 0x%08x", inst)
+	}
+	switch {
+	case d.Mnemonic == "addi" && d.Rd == RegZero && d.Rs1 == RegZero && d.Imm == 0:
+		return "nop"
+	case d.Mnemonic == "addi" && d.Imm == 0:
+		return fmt.Sprintf("mv %s, %s", regName(d.Rd), regName(d.Rs1))
+	case d.Mnemonic == "jal" && d.Rd == RegZero:
+		return fmt.Sprintf("j 0x%x", pc+d.Imm)
+	case d.Mnemonic == "jalr" && d.Rd == RegZero && d.Rs1 == RegRA && d.Imm == 0:
+		return "ret"
+	}
+	return render(&d, pc)
+}
+
+// PeekInstruction returns the instruction at addr and its disassembly
+// without executing it or otherwise changing the cpu state. A compressed
+// instruction is returned as its 16-bit parcel. Only plain memory can be
+// peeked, as reading a device may have side effects.
+func (cpu *Cpu) PeekInstruction(addr uint32) (uint32, string, error) {
+	inst, ok := cpu.peekParcel(addr)
+	if ok && inst&0x3 == 0x3 {
+		var high uint32
+		high, ok = cpu.peekParcel(addr + 2)
+		inst |= high << 16
+	}
+	if !ok {
+		return 0, "", fmt.Errorf("no memory to peek at 0x%08x", addr)
+	}
+	text, err := disassemble(inst, addr)
+	return inst, text, err
+}
+
+// peekParcel reads the half word at addr through PeekByte
+func (cpu *Cpu) peekParcel(addr uint32) (uint32, bool) {
+	lo, ok := cpu.PeekByte(addr)
+	if !ok {
+		return 0, false
+	}
+	hi, ok := cpu.PeekByte(addr + 1)
+	return uint32(lo) | uint32(hi)<<8, ok
+}
+
+// disassembleCode writes a line per instruction of code, which is located
+// at addr, along with its source line if there is one in sources. Parcels
+// that don't end with 0b11 are compressed instructions.
+func disassembleCode(w io.Writer, code []uint8, addr uint32, sources *SourceMap) {
+	for off := 0; off < len(code); {
+		pc := addr + uint32(off)
+		if off+2 <= len(code) {
+			parcel := binary.LittleEndian.Uint16(code[off:])
+			if parcel&0x3 != 0x3 {
+				line := fmt.Sprintf("%08x: %-8s  %s", pc, fmt.Sprintf("%04x", parcel),
+					Disassemble(uint32(parcel), pc))
+				fmt.Fprintln(w, sources.annotate(line, pc))
+				off += 2
+				continue
+			}
+		}
+		if off+4 > len(code) {
+			// a truncated instruction at the end
+			for ; off < len(code); off++ {
+				fmt.Fprintf(w, "%08x: %-8s  .byte 0x%02x\n",
+					addr+uint32(off), fmt.Sprintf("%02x", code[off]), code[off])
+			}
+			break
+		}
+		inst := binary.LittleEndian.Uint32(code[off:])
+		line := fmt.Sprintf("%08x: %08x  %s", pc, inst, Disassemble(inst, pc))
+		fmt.Fprintln(w, sources.annotate(line, pc))
+		off += 4
+	}
+}
+
+// disasmImage is the disasm subcommand, it disassembles a flat image or
+// the executable segments of an elf
+func disasmImage(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	listingPath := flags.String("listing", "",
+		"an assembler listing to show the source lines of instructions from")
+	if err := flags.Parse(args[1:]); err == flag.ErrHelp {
+		return 0, nil
+	} else if err != nil {
+		return 2, nil
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1, nil
+	}
+	image, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return 1, err
+	}
+	sources, err := loadListingFile(*listingPath, image)
+	if err != nil {
+		return 1, err
+	}
+	if !isElf(image) {
+		disassembleCode(stdout, image, BoardInitialAddr, sources)
+		return 0, nil
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return 1, err
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		code := make([]uint8, prog.Filesz)
+		if _, err := io.ReadFull(prog.Open(), code); err != nil {
+			return 1, err
+		}
+		disassembleCode(stdout, code, uint32(prog.Vaddr), sources)
+	}
+	return 0, nil
+}
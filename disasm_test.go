@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPeekInstruction(t *testing.T) {
+	prog := NewProgTemplate(`
+	addi x1, x2, -4
+	beq x3, x4, target
+	sw x5, 8(x6)
+	target:
+	lw x7, 12(x8)
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	cpu := board.Cpu()
+	cpu.SetReg(RegA0, 0x1234)
+	before := cpu.getState()
+	statsBefore := board.board.Mmu().Stats()
+	tests := []struct {
+		addr   uint32
+		raw    uint32
+		disasm string
+	}{
+		{cpu.initialAddr, 0xffc10093, "addi ra, sp, -4"},
+		{cpu.initialAddr + 4, 0x00418463, "beq gp, tp, 0x10c"},
+		{cpu.initialAddr + 8, 0x00532423, "sw t0, 8(t1)"},
+		{cpu.initialAddr + 12, 0x00c42383, "lw t2, 12(s0)"},
+	}
+	for _, test := range tests {
+		raw, disasm, err := cpu.PeekInstruction(test.addr)
+		if err != nil {
+			t.Errorf("unexpected error at 0x%08x: %s", test.addr, err)
+		}
+		if raw != test.raw {
+			t.Errorf("expected raw 0x%08x at 0x%08x got 0x%08x",
+				test.raw, test.addr, raw)
+		}
+		if disasm != test.disasm {
+			t.Errorf("expected %q at 0x%08x got %q",
+				test.disasm, test.addr, disasm)
+		}
+	}
+	if _, _, err := cpu.PeekInstruction(0xfffffff0); err == nil {
+		t.Errorf("expected an error peeking unmapped memory")
+	}
+	if !reflect.DeepEqual(cpu.getState(), before) {
+		t.Errorf("peeking changed the cpu state")
+	}
+	if cpu.pageFault || cpu.walkFault || cpu.splitFault ||
+		board.board.Mmu().TakeFault() {
+		t.Errorf("peeking set the fault flags")
+	}
+	if stats := board.board.Mmu().Stats(); stats != statsBefore {
+		t.Errorf("peeking changed the access stats from %+v to %+v",
+			statsBefore, stats)
+	}
+}
+
+func TestPeekCompressed(t *testing.T) {
+	// c.nop followed by c.li a0, 5
+	cpu := NewDebugBoard([]uint8{0x01, 0x00, 0x15, 0x45}).Cpu()
+	tests := []struct {
+		addr   uint32
+		raw    uint32
+		disasm string
+	}{
+		{cpu.initialAddr, 0x0001, "addi zero, zero, 0"},
+		{cpu.initialAddr + 2, 0x4515, "addi a0, zero, 5"},
+	}
+	for _, test := range tests {
+		raw, disasm, err := cpu.PeekInstruction(test.addr)
+		if err != nil {
+			t.Fatalf("unexpected error at 0x%08x: %s", test.addr, err)
+		}
+		if raw != test.raw {
+			t.Errorf("expected raw 0x%04x got 0x%08x", test.raw, raw)
+		}
+		if disasm != test.disasm {
+			t.Errorf("expected %q got %q", test.disasm, disasm)
+		}
+	}
+}
+
+func TestDisassembleCsrName(t *testing.T) {
+	tests := []struct {
+		inst   uint32
+		disasm string
+	}{
+		// csrrw a0, mtvec, a1
+		{0x30559573, "csrrw a0, mtvec, a1"},
+		// csrrsi zero, mstatus, 8
+		{0x30046073, "csrrsi zero, mstatus, 8"},
+		// csrrw zero, 0x3ff, t1
+		{0x3ff31073, "csrrw zero, 0x3ff, t1"},
+	}
+	for _, test := range tests {
+		disasm, err := disassemble(test.inst, 0)
+		if err != nil {
+			t.Errorf("unexpected error for 0x%08x: %s", test.inst, err)
+		}
+		if disasm != test.disasm {
+			t.Errorf("expected %q got %q", test.disasm, disasm)
+		}
+	}
+}
+
+func TestDisassembleFence(t *testing.T) {
+	tests := []struct {
+		inst   uint32
+		disasm string
+	}{
+		{0x0330000f, "fence rw, rw"},
+		{0x8330000f, "fence.tso"},
+		{0x0840000f, "fence i, o"},
+		{0x0ff0000f, "fence"},
+		{0x0000100f, "fence.i"},
+	}
+	for _, test := range tests {
+		disasm, err := disassemble(test.inst, 0)
+		if err != nil {
+			t.Errorf("unexpected error for 0x%08x: %s", test.inst, err)
+		}
+		if disasm != test.disasm {
+			t.Errorf("expected %q got %q", test.disasm, disasm)
+		}
+	}
+}
+
+func TestDisassembleAMO(t *testing.T) {
+	tests := []struct {
+		inst   uint32
+		disasm string
+	}{
+		{0x100522af, "lr.w t0, (a0)"},
+		{0x186523af, "sc.w t2, t1, (a0)"},
+		{0x006523af, "amoadd.w t2, t1, (a0)"},
+		{0x0805202f, "amoswap.w zero, zero, (a0)"},
+	}
+	for _, test := range tests {
+		disasm, err := disassemble(test.inst, 0)
+		if err != nil {
+			t.Errorf("unexpected error for 0x%08x: %s", test.inst, err)
+		}
+		if disasm != test.disasm {
+			t.Errorf("expected %q got %q", test.disasm, disasm)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	tests := []struct {
+		inst   uint32
+		disasm string
+	}{
+		{0xffc58513, "addi a0, a1, -4"},
+		{0x02940263, "beq s0, s1, 0x124"},
+		{0xff1ff0ef, "jal ra, 0xf0"},
+		{0x00000013, "nop"},
+		{0x00058513, "mv a0, a1"},
+		{0x0080006f, "j 0x108"},
+		{0x00008067, "ret"},
+		{0x000580e7, "jalr ra, 0(a1)"},
+		{0xffffffff, ".word 0xffffffff"},
+	}
+	for _, test := range tests {
+		disasm := Disassemble(test.inst, 0x100)
+		if disasm != test.disasm {
+			t.Errorf("0x%08x: expected %q got %q", test.inst, test.disasm, disasm)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var ErrNotRiscv32Elf = errors.New("not a 32 bit little endian RISC-V elf")
+var ErrElfSegmentTooLarge = errors.New("elf segment is too large to load")
+
+// the largest segment loadElf allocates memory for
+const _ElfMaxSegmentSize = 256 << 20
+
+// isElf tells if image starts with the elf magic
+func isElf(image []uint8) bool {
+	return bytes.HasPrefix(image, []uint8(elf.ELFMAG))
+}
+
+// loadElf maps the loadable segments of an executable into mmu at their
+// virtual addresses and returns its entry point, the part of a segment
+// that isn't backed by the file is zeroed. Segments permit the accesses
+// their flags allow.
+func loadElf(r io.ReaderAt, mmu *Mmu) (uint32, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if f.Class != elf.ELFCLASS32 || f.Data != elf.ELFDATA2LSB ||
+		f.Machine != elf.EM_RISCV {
+		return 0, ErrNotRiscv32Elf
+	}
+
+	loaded := false
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		if prog.Filesz > prog.Memsz || prog.Vaddr+prog.Memsz > 1<<32 {
+			return 0, errors.New("malformed elf segment")
+		}
+		if prog.Memsz > _ElfMaxSegmentSize {
+			return 0, ErrElfSegmentTooLarge
+		}
+		mem := make([]uint8, prog.Memsz)
+		if _, err := io.ReadFull(prog.Open(), mem[:prog.Filesz]); err != nil {
+			return 0, err
+		}
+		err := mmu.AddRangePerm(uint32(prog.Vaddr), uint32(prog.Memsz),
+			NewRamFromBuffer(mem), elfPerm(prog.Flags))
+		if err != nil {
+			return 0, err
+		}
+		loaded = true
+	}
+	if !loaded {
+		return 0, errors.New("elf has no loadable segments")
+	}
+	return uint32(f.Entry), nil
+}
+
+// elfPerm returns the accesses a segment with the given flags permits
+func elfPerm(flags elf.ProgFlag) Perm {
+	var perm Perm
+	if flags&elf.PF_R != 0 {
+		perm |= PermR
+	}
+	if flags&elf.PF_W != 0 {
+		perm |= PermW
+	}
+	if flags&elf.PF_X != 0 {
+		perm |= PermX
+	}
+	return perm
+}
+
+// infoImage is the info subcommand, it prints the headers and segments of
+// an elf, flat images have neither
+func infoImage(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	if err := flags.Parse(args[1:]); err == flag.ErrHelp {
+		return 0, nil
+	} else if err != nil {
+		return 2, nil
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1, nil
+	}
+	image, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return 1, err
+	}
+	if !isElf(image) {
+		fmt.Fprintf(stdout, "flat image of %d bytes loaded at 0x%08x\n",
+			len(image), BoardInitialAddr)
+		return 0, nil
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return 1, err
+	}
+	defer f.Close()
+	fmt.Fprintf(stdout, "class:   %s\n", f.Class)
+	fmt.Fprintf(stdout, "data:    %s\n", f.Data)
+	fmt.Fprintf(stdout, "type:    %s\n", f.Type)
+	fmt.Fprintf(stdout, "machine: %s\n", f.Machine)
+	fmt.Fprintf(stdout, "entry:   0x%08x\n", f.Entry)
+	fmt.Fprintln(stdout, "segments:")
+	for _, prog := range f.Progs {
+		fmt.Fprintf(stdout, "  %-10s vaddr 0x%08x filesz 0x%06x memsz 0x%06x %s\n",
+			prog.Type, prog.Vaddr, prog.Filesz, prog.Memsz, prog.Flags)
+	}
+	return 0, nil
+}
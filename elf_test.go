@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestElfBoard(t *testing.T) {
+	prog := `
+	.global _start
+	.option norelax
+	.text
+	nop
+	_start:
+	la a0, value
+	lw a0, 0(a0)
+	la a1, buffer
+	lw a1, 60(a1)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	.data
+	value:
+	.word 42
+	.bss
+	buffer:
+	.space 64
+	`
+	t.Log("prog: ", prog)
+	path := assembleElf(t, t.TempDir(), prog, 0x1000)
+	image, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isElf(image) {
+		t.Fatal("expected the elf magic")
+	}
+
+	board, err := NewElfBoard(bytes.NewReader(image), nil, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cpu := board.Cpu()
+	assertPcEq(t, cpu, 0x1004)
+	if v := cpu.LoadWord(0x1000); v != 0x00000013 {
+		t.Errorf("expected a nop at 0x1000 got 0x%08x", v)
+	}
+	cpu.Execute()
+	assertRegEq(t, cpu, RegA0, 42)
+	assertRegEq(t, cpu, RegA1, 0)
+	if cpu.LastFault() != nil {
+		t.Errorf("unexpected exception: %s", cpu.LastFault())
+	}
+}
+
+func TestElfBoardRejectsObjects(t *testing.T) {
+	f, err := os.Open("/proc/self/exe")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	if _, err := NewElfBoard(f, nil, nil); err != ErrNotRiscv32Elf {
+		t.Errorf("expected ErrNotRiscv32Elf got %v", err)
+	}
+	if isElf([]uint8(strings.Repeat("\x13\x00\x00\x00", 4))) {
+		t.Errorf("a flat image was detected as an elf")
+	}
+}
+
+// buildElf renders an executable with the given segments, their contents
+// are zero
+func buildElf(progs []elf.Prog32) []uint8 {
+	var out bytes.Buffer
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     0x1000,
+		Phoff:     _CoreElfHeaderSize,
+		Ehsize:    _CoreElfHeaderSize,
+		Phentsize: _CoreProgHeaderSize,
+		Phnum:     uint16(len(progs)),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = uint8(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = uint8(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = uint8(elf.EV_CURRENT)
+	binary.Write(&out, binary.LittleEndian, header)
+	binary.Write(&out, binary.LittleEndian, progs)
+	out.Write(make([]uint8, 64))
+	return out.Bytes()
+}
+
+func TestElfSegmentPerm(t *testing.T) {
+	image := buildElf([]elf.Prog32{
+		{Type: uint32(elf.PT_LOAD), Vaddr: 0x1000, Memsz: 0x10,
+			Flags: uint32(elf.PF_R | elf.PF_X)},
+		{Type: uint32(elf.PT_LOAD), Vaddr: 0x2000, Memsz: 0x10,
+			Flags: uint32(elf.PF_R | elf.PF_W)},
+	})
+	mmu := NewMmu()
+	if _, err := loadElf(bytes.NewReader(image), mmu); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for addr, perm := range map[uint32]Perm{0x1000: PermR | PermX, 0x2000: PermR | PermW} {
+		r, _ := mmu.findRange(addr)
+		if r == nil || r.Perm != perm {
+			t.Errorf("expected 0x%08x to permit %v got %+v", addr, perm, r)
+		}
+	}
+}
+
+func TestElfSegmentTooLarge(t *testing.T) {
+	image := buildElf([]elf.Prog32{
+		{Type: uint32(elf.PT_LOAD), Vaddr: 0x1000, Memsz: 0xf0000000,
+			Flags: uint32(elf.PF_R | elf.PF_W)},
+	})
+	if _, err := loadElf(bytes.NewReader(image), NewMmu()); err != ErrElfSegmentTooLarge {
+		t.Errorf("expected ErrElfSegmentTooLarge got %v", err)
+	}
+}
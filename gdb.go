@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// the target description gdb needs to pick the 32 bit register layout
+const _GdbTargetXml = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0"><architecture>riscv:rv32</architecture></target>`
+
+// the largest packet the stub accepts, it is reported to gdb in hex
+const _GdbPacketSize = 0x4000
+
+// how many steps to run between checks for an interrupt from gdb
+const _GdbInterruptCheck = 1024
+
+type gdbPacket struct {
+	data string
+	// the checksum matched
+	ok bool
+}
+
+// GdbStub serves the gdb remote serial protocol so guest programs can be
+// debugged with gdb. The stub drives the cpu with Step, nothing else may
+// run it while it is serving.
+type GdbStub struct {
+	cpu *Cpu
+
+	packets    chan gdbPacket
+	interrupts chan struct{}
+	done       chan struct{}
+	readErr    error
+}
+
+func NewGdbStub(cpu *Cpu) *GdbStub {
+	return &GdbStub{cpu: cpu}
+}
+
+// Serve handles the packets read from conn until gdb detaches or kills
+// the target, or the connection is closed. A killed target is halted.
+func (s *GdbStub) Serve(conn io.ReadWriter) error {
+	s.packets = make(chan gdbPacket)
+	s.interrupts = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	defer close(s.done)
+	go s.read(bufio.NewReader(conn))
+
+	for packet := range s.packets {
+		if !packet.ok {
+			if _, err := io.WriteString(conn, "-"); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.WriteString(conn, "+"); err != nil {
+			return err
+		}
+		if packet.data == "k" {
+			// kill has no reply
+			s.cpu.Halt()
+			return nil
+		}
+		reply, stop := s.handle(packet.data)
+		if err := writeGdbPacket(conn, reply); err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	if s.readErr == io.EOF {
+		return nil
+	}
+	return s.readErr
+}
+
+// read splits the stream from gdb to packets and interrupt requests,
+// acknowledgments are ignored
+func (s *GdbStub) read(r *bufio.Reader) {
+	defer close(s.packets)
+	// a closed interrupt channel stops a running continue
+	defer close(s.interrupts)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		switch c {
+		case 0x03:
+			select {
+			case s.interrupts <- struct{}{}:
+			default:
+			}
+		case '$':
+			data, err := r.ReadString('#')
+			if err != nil {
+				s.readErr = err
+				return
+			}
+			data = data[:len(data)-1]
+			var sum [2]byte
+			if _, err := io.ReadFull(r, sum[:]); err != nil {
+				s.readErr = err
+				return
+			}
+			expected, err := strconv.ParseUint(string(sum[:]), 16, 8)
+			packet := gdbPacket{data, err == nil && uint8(expected) == gdbChecksum(data)}
+			select {
+			case s.packets <- packet:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func writeGdbPacket(w io.Writer, data string) error {
+	_, err := fmt.Fprintf(w, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+// handle runs a single command and returns the reply, stop is set when
+// the session is over
+func (s *GdbStub) handle(data string) (reply string, stop bool) {
+	if data == "" {
+		return "", false
+	}
+	args := data[1:]
+	switch data[0] {
+	case '?':
+		return s.stopReason(), false
+	case 'g':
+		return s.readRegisters(), false
+	case 'G':
+		return s.writeRegisters(args), false
+	case 'p':
+		return s.readRegister(args), false
+	case 'P':
+		return s.writeRegister(args), false
+	case 'm':
+		return s.readMemory(args), false
+	case 'M':
+		return s.writeMemory(args), false
+	case 's':
+		if !s.resumeAt(args) {
+			return "E01", false
+		}
+		s.cpu.Step()
+		return s.stopReason(), false
+	case 'c':
+		if !s.resumeAt(args) {
+			return "E01", false
+		}
+		return s.cont(), false
+	case 'Z', 'z':
+		return s.breakpoint(data[0] == 'Z', args), false
+	case 'q':
+		return s.query(args), false
+	case 'H':
+		// there is a single thread
+		return "OK", false
+	case 'D':
+		s.cpu.ClearWatchpointHit()
+		s.cpu.ClearBreakpointHit()
+		return "OK", true
+	}
+	// an empty reply tells gdb the packet isn't supported
+	return "", false
+}
+
+// resumeAt prepares to resume execution, optionally from the address in
+// args
+func (s *GdbStub) resumeAt(args string) bool {
+	if args != "" {
+		addr, err := strconv.ParseUint(args, 16, 32)
+		if err != nil {
+			return false
+		}
+		s.cpu.SetPc(uint32(addr))
+	}
+	s.cpu.ClearWatchpointHit()
+	s.cpu.ClearBreakpointHit()
+	return true
+}
+
+func (s *GdbStub) cont() string {
+	for i := 1; !s.cpu.halt; i++ {
+		if i%_GdbInterruptCheck == 0 {
+			select {
+			case <-s.interrupts:
+				return "S02"
+			default:
+			}
+		}
+		s.cpu.Step()
+	}
+	return s.stopReason()
+}
+
+var _GdbWatchNames = map[WatchKind]string{
+	WatchWrite:  "watch",
+	WatchRead:   "rwatch",
+	WatchAccess: "awatch",
+}
+
+func (s *GdbStub) stopReason() string {
+	if hit := s.cpu.WatchpointHit(); hit != nil {
+		return fmt.Sprintf("T05%s:%x;",
+			_GdbWatchNames[hit.Watchpoint.Kind], hit.Addr)
+	}
+	if !s.cpu.halt || s.cpu.BreakpointHit() {
+		return "S05"
+	}
+	if s.cpu.LastFault() != nil {
+		return "S0b"
+	}
+	// the guest exited
+	code, _ := s.cpu.GetCsr(CsrHalt)
+	return fmt.Sprintf("W%02x", uint8(code))
+}
+
+func gdbHex32(v uint32) string {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return hex.EncodeToString(buf[:])
+}
+
+// gdb numbers x0-x31 as 0-31 and pc as 32
+func (s *GdbStub) getRegister(n uint64) uint32 {
+	if n == 32 {
+		return s.cpu.Pc()
+	}
+	return s.cpu.GetReg(uint8(n))
+}
+
+func (s *GdbStub) setRegister(n uint64, v uint32) {
+	if n == 32 {
+		s.cpu.SetPc(v)
+	} else if n != RegZero {
+		s.cpu.SetReg(uint8(n), v)
+	}
+}
+
+func (s *GdbStub) readRegisters() string {
+	var sb strings.Builder
+	for n := uint64(0); n <= 32; n++ {
+		sb.WriteString(gdbHex32(s.getRegister(n)))
+	}
+	return sb.String()
+}
+
+func (s *GdbStub) writeRegisters(args string) string {
+	buf, err := hex.DecodeString(args)
+	if err != nil || len(buf) < 33*4 {
+		return "E01"
+	}
+	for n := uint64(0); n <= 32; n++ {
+		s.setRegister(n, binary.LittleEndian.Uint32(buf[n*4:]))
+	}
+	return "OK"
+}
+
+func (s *GdbStub) readRegister(args string) string {
+	n, err := strconv.ParseUint(args, 16, 8)
+	if err != nil || n > 32 {
+		return "E01"
+	}
+	return gdbHex32(s.getRegister(n))
+}
+
+func (s *GdbStub) writeRegister(args string) string {
+	parts := strings.SplitN(args, "=", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+	n, err := strconv.ParseUint(parts[0], 16, 8)
+	buf, hexErr := hex.DecodeString(parts[1])
+	if err != nil || hexErr != nil || n > 32 || len(buf) != 4 {
+		return "E01"
+	}
+	s.setRegister(n, binary.LittleEndian.Uint32(buf))
+	return "OK"
+}
+
+// parseGdbRange parses the addr,length argument of memory accesses
+func parseGdbRange(args string) (uint32, uint32, bool) {
+	parts := strings.SplitN(args, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	addr, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(addr), uint32(length), true
+}
+
+func (s *GdbStub) readMemory(args string) string {
+	addr, length, ok := parseGdbRange(args)
+	if !ok {
+		return "E01"
+	}
+	// each byte takes two hex digits, gdb handles a shorter reply
+	if length > _GdbPacketSize/2 {
+		length = _GdbPacketSize / 2
+	}
+	buf := make([]byte, 0, length)
+	for i := uint32(0); i < length; i++ {
+		v, ok := s.cpu.PeekByte(addr + i)
+		if !ok {
+			if i == 0 {
+				return "E01"
+			}
+			// a partial read is fine
+			break
+		}
+		buf = append(buf, v)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (s *GdbStub) writeMemory(args string) string {
+	parts := strings.SplitN(args, ":", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+	addr, length, ok := parseGdbRange(parts[0])
+	buf, err := hex.DecodeString(parts[1])
+	if !ok || err != nil || uint32(len(buf)) != length {
+		return "E01"
+	}
+	for i, v := range buf {
+		if !s.cpu.PokeByte(addr+uint32(i), v) {
+			return "E01"
+		}
+	}
+	return "OK"
+}
+
+// breakpoint inserts or removes a breakpoint or a watchpoint, args is
+// type,addr,kind where kind is the size for watchpoints
+func (s *GdbStub) breakpoint(insert bool, args string) string {
+	parts := strings.SplitN(args, ",", 2)
+	if len(parts) != 2 {
+		return "E01"
+	}
+	addr, size, ok := parseGdbRange(parts[1])
+	if !ok {
+		return "E01"
+	}
+
+	var kind WatchKind
+	switch parts[0] {
+	case "0", "1":
+		// software and hardware breakpoints are the same to us
+		if insert {
+			s.cpu.AddBreakpoint(addr)
+		} else {
+			s.cpu.RemoveBreakpoint(addr)
+		}
+		return "OK"
+	case "2":
+		kind = WatchWrite
+	case "3":
+		kind = WatchRead
+	case "4":
+		kind = WatchAccess
+	default:
+		return ""
+	}
+	w := Watchpoint{Addr: addr, Size: size, Kind: kind}
+	if insert {
+		s.cpu.AddWatchpoint(w)
+	} else {
+		s.cpu.RemoveWatchpoint(w)
+	}
+	return "OK"
+}
+
+func (s *GdbStub) query(args string) string {
+	switch {
+	case strings.HasPrefix(args, "Supported"):
+		return fmt.Sprintf("PacketSize=%x;qXfer:features:read+", _GdbPacketSize)
+	case args == "Attached":
+		return "1"
+	case args == "C":
+		return "QC1"
+	case strings.HasPrefix(args, "Xfer:features:read:target.xml:"):
+		offset, length, ok := parseGdbRange(
+			strings.TrimPrefix(args, "Xfer:features:read:target.xml:"))
+		if !ok {
+			return "E01"
+		}
+		if offset >= uint32(len(_GdbTargetXml)) {
+			return "l"
+		}
+		rest := _GdbTargetXml[offset:]
+		if uint32(len(rest)) > length {
+			return "m" + rest[:length]
+		}
+		return "l" + rest
+	case strings.HasPrefix(args, "Rcmd,"):
+		cmd, err := hex.DecodeString(strings.TrimPrefix(args, "Rcmd,"))
+		if err != nil {
+			return "E01"
+		}
+		out, err := s.cpu.MonitorCommand(string(cmd))
+		if err != nil {
+			out = err.Error() + "\n"
+		}
+		return hex.EncodeToString([]byte(out))
+	}
+	return ""
+}
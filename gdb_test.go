@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// gdbClient plays the part of gdb in tests
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startGdbStub(t *testing.T, cpu *Cpu) *gdbClient {
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewGdbStub(cpu).Serve(server)
+		server.Close()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	})
+	return &gdbClient{t, client, bufio.NewReader(client)}
+}
+
+// command sends a packet and returns the reply
+func (c *gdbClient) command(data string) string {
+	c.t.Helper()
+	if err := writeGdbPacket(c.conn, data); err != nil {
+		c.t.Fatal(err)
+	}
+	if ack, err := c.r.ReadByte(); err != nil || ack != '+' {
+		c.t.Fatalf("expected an ack for %q got %q %v", data, ack, err)
+	}
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	reply, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	reply = reply[:len(reply)-1]
+	var sum [2]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if string(sum[:]) != fmt.Sprintf("%02x", gdbChecksum(reply)) {
+		c.t.Errorf("bad checksum for %q", reply)
+	}
+	return reply
+}
+
+func (c *gdbClient) expect(data, reply string) {
+	c.t.Helper()
+	if got := c.command(data); got != reply {
+		c.t.Errorf("%s: expected %q got %q", data, reply, got)
+	}
+}
+
+// gdbRegister extracts register n from the reply to g
+func gdbRegister(t *testing.T, regs string, n int) uint32 {
+	t.Helper()
+	if len(regs) != 33*8 {
+		t.Fatalf("expected 33 registers got %q", regs)
+	}
+	buf, err := hex.DecodeString(regs[n*8 : n*8+8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return binary.LittleEndian.Uint32(buf)
+}
+
+func TestGdbStub(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 5
+	addi a0, a0, 1
+	la a1, value
+	sw a0, 0(a1)
+	li t1, 42
+	csrrw x0, 0x3ff, t1
+	value:
+	.word 0x12345678
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	gdb := startGdbStub(t, cpu)
+
+	gdb.expect("?", "S05")
+	regs := gdb.command("g")
+	if pc := gdbRegister(t, regs, 32); pc != cpu.initialAddr {
+		t.Errorf("expected pc 0x%08x got 0x%08x", cpu.initialAddr, pc)
+	}
+
+	gdb.expect("s", "S05")
+	regs = gdb.command("g")
+	if a0 := gdbRegister(t, regs, RegA0); a0 != 5 {
+		t.Errorf("expected a0 5 got %d", a0)
+	}
+	if pc := gdbRegister(t, regs, 32); pc != cpu.initialAddr+4 {
+		t.Errorf("expected pc 0x%08x got 0x%08x", cpu.initialAddr+4, pc)
+	}
+	gdb.expect("pa", "05000000")
+	gdb.expect("Pa=07000000", "OK")
+	assertRegEq(t, cpu, RegA0, 7)
+
+	value := cpu.initialAddr + 28
+	gdb.expect(fmt.Sprintf("m%x,4", value), "78563412")
+	gdb.expect("m10000000,4", "E01")
+
+	// stop once a1 holds the address of value
+	gdb.expect(fmt.Sprintf("Z0,%x,4", cpu.initialAddr+16), "OK")
+	gdb.expect("c", "S05")
+	assertPcEq(t, cpu, cpu.initialAddr+16)
+	gdb.expect(fmt.Sprintf("z0,%x,4", cpu.initialAddr+16), "OK")
+
+	gdb.expect(fmt.Sprintf("Z2,%x,4", value), "OK")
+	gdb.expect("c", fmt.Sprintf("T05watch:%x;", value))
+	gdb.expect(fmt.Sprintf("m%x,4", value), "08000000")
+	gdb.expect(fmt.Sprintf("z2,%x,4", value), "OK")
+
+	gdb.expect("qRcmd,"+hex.EncodeToString([]byte("csr mscratch 0x10")),
+		hex.EncodeToString([]byte("mscratch = 0x00000010\n")))
+
+	gdb.expect("c", "W2a")
+	gdb.expect("D", "OK")
+}
+
+func TestGdbMemoryAccess(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 5
+	li a0, 6
+	value:
+	.word 0x12345678
+	.space 0x3000
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	cpu := board.Cpu()
+	cpu.EnableJournal(4)
+	gdb := startGdbStub(t, cpu)
+
+	// reads are capped to what fits a packet
+	reply := gdb.command(fmt.Sprintf("m%x,4000", cpu.initialAddr))
+	if len(reply) != _GdbPacketSize {
+		t.Errorf("expected a %d byte reply got %d", _GdbPacketSize, len(reply))
+	}
+	// devices aren't accessed
+	gdb.expect(fmt.Sprintf("m%x,1", BoardSerialAddr), "E01")
+	gdb.expect(fmt.Sprintf("M%x,1:41", BoardSerialAddr), "E01")
+	board.board.serial.Flush()
+	if out := board.output.String(); out != "" {
+		t.Errorf("expected no serial output got %q", out)
+	}
+
+	// a write isn't undone along with the step it follows
+	value := cpu.initialAddr + 8
+	gdb.expect("s", "S05")
+	gdb.expect(fmt.Sprintf("M%x,4:efbeadde", value), "OK")
+	if err := cpu.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	gdb.expect(fmt.Sprintf("m%x,4", value), "efbeadde")
+	gdb.expect("D", "OK")
+}
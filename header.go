@@ -0,0 +1,62 @@
+package main
+
+//go:generate go run . -gen-header runtime/emu.h
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// cName turns a human readable name into a C identifier
+func cName(prefix, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	return prefix + name
+}
+
+// writeRuntimeHeader emits the C header guests include to talk to the
+// emulator so the runtime never drifts from the Go definitions
+func writeRuntimeHeader(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("// Code generated by riscv -gen-header; DO NOT EDIT.\n")
+	sb.WriteString("#ifndef TT_EMU_H\n#define TT_EMU_H\n\n")
+	fmt.Fprintf(&sb, "#define EMU_SERIAL_ADDR 0x%08x\n", BoardSerialAddr)
+	fmt.Fprintf(&sb, "#define EMU_MSIP_ADDR 0x%08x\n", BoardClintAddr+ClintMsip)
+	fmt.Fprintf(&sb, "#define EMU_MTIMECMP_ADDR 0x%08x\n", BoardClintAddr+ClintMtimecmp)
+	fmt.Fprintf(&sb, "#define EMU_MTIME_ADDR 0x%08x\n", BoardClintAddr+ClintMtime)
+	fmt.Fprintf(&sb, "#define EMU_COUNTERS_ADDR 0x%08x\n\n", BoardCountersAddr)
+
+	fmt.Fprintf(&sb, "#define CSR_HALT 0x%03x\n", CsrHalt)
+	var csrs []uint32
+	for csr := range _CsrNames {
+		csrs = append(csrs, csr)
+	}
+	sort.Slice(csrs, func(i, j int) bool { return csrs[i] < csrs[j] })
+	for _, csr := range csrs {
+		fmt.Fprintf(&sb, "#define %s 0x%03x\n", cName("CSR_", _CsrNames[csr]), csr)
+	}
+	sb.WriteString("\n")
+
+	var causes []uint32
+	for cause := range _ExceptionNames {
+		causes = append(causes, cause)
+	}
+	sort.Slice(causes, func(i, j int) bool { return causes[i] < causes[j] })
+	for _, cause := range causes {
+		fmt.Fprintf(&sb, "#define %s %d\n",
+			cName("EXC_", _ExceptionNames[cause]), cause)
+	}
+
+	sb.WriteString("\n#endif // TT_EMU_H\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
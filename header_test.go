@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeHeader(t *testing.T) {
+	var sb strings.Builder
+	if err := writeRuntimeHeader(&sb); err != nil {
+		t.Fatal(err)
+	}
+	header := sb.String()
+	for _, line := range []string{
+		fmt.Sprintf("#define CSR_HALT 0x%03x\n", CsrHalt),
+		fmt.Sprintf("#define EMU_SERIAL_ADDR 0x%08x\n", BoardSerialAddr),
+		fmt.Sprintf("#define EXC_ILLEGAL_INSTRUCTION %d\n", ExceptionIllegalInstruction),
+	} {
+		if !strings.Contains(header, line) {
+			t.Errorf("expected header to contain %q", line)
+		}
+	}
+
+	committed, err := ioutil.ReadFile("runtime/emu.h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(committed) != header {
+		t.Errorf("runtime/emu.h is out of date, run go generate")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+const icacheLines = 4096
+
+// icacheLine holds an instruction as decode takes it, compressed ones
+// already expanded, along with the length of its encoding
+type icacheLine struct {
+	addr   uint32
+	inst   uint32
+	length uint8
+	valid  bool
+}
+
+// icache is a direct mapped cache of decoded instructions keyed by their
+// physical address. It relies on code only changing through stores made
+// by the cpu, which invalidate the lines they overlap.
+type icache struct {
+	lines [icacheLines]icacheLine
+}
+
+func (c *icache) line(addr uint32) *icacheLine {
+	return &c.lines[(addr>>1)%icacheLines]
+}
+
+// invalidate drops the lines of the instructions overlapping the n bytes
+// at addr, instructions start at any half word
+func (c *icache) invalidate(addr uint32, n int) {
+	last := (addr + uint32(n) - 1) &^ 1
+	for a := addr&^1 - 2; a != last+2; a += 2 {
+		if l := c.line(a); l.valid && l.addr == a {
+			l.valid = false
+		}
+	}
+}
+
+func (c *icache) flush() {
+	c.lines = [icacheLines]icacheLine{}
+}
+
+// EnableInstructionCache makes the cpu cache the instructions it fetches
+// so hot loops don't go through the memory map on every step
+func (cpu *Cpu) EnableInstructionCache(enable bool) {
+	cpu.icache = nil
+	if enable {
+		cpu.icache = &icache{}
+	}
+}
+
+// fetchCached looks up the instruction at addr in the icache, it is only
+// used when addr is a physical address
+func (cpu *Cpu) fetchCached(addr uint32) (inst uint32, length uint8, ok bool) {
+	// misaligned instructions can't be executed anyway
+	if addr%2 != 0 {
+		return 0, 0, false
+	}
+	l := cpu.icache.line(addr)
+	if l.valid && l.addr == addr {
+		return l.inst, l.length, true
+	}
+	return 0, 0, false
+}
+
+// fill caches inst as the instruction at addr, failed fetches aren't cached
+func (c *icache) fill(addr, inst uint32, length uint8) {
+	if addr%2 != 0 {
+		return
+	}
+	*c.line(addr) = icacheLine{addr, inst, length, true}
+}
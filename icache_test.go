@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInstructionCacheSelfModifyingCode(t *testing.T) {
+	prog := `
+	la t0, target
+	la t2, replacement
+	lw t1, 0(t2)
+	li a1, 0
+	again:
+	target:
+	addi a0, a0, 1
+	bnez a1, done
+	sw t1, 0(t0)
+	fence.i
+	li a1, 1
+	j again
+	done:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	replacement:
+	addi a0, a0, 16
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.EnableInstructionCache(true)
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	assertRegEq(t, cpu, RegA0, 17)
+}
+
+func TestInstructionCacheStoreInvalidates(t *testing.T) {
+	// no fence.i, the store alone has to drop the cached instruction
+	prog := `
+	la t0, target
+	la t2, replacement
+	lw t1, 0(t2)
+	li a1, 0
+	again:
+	target:
+	addi a0, a0, 1
+	bnez a1, done
+	sw t1, 0(t0)
+	li a1, 1
+	j again
+	done:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	replacement:
+	addi a0, a0, 16
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.EnableInstructionCache(true)
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	assertRegEq(t, cpu, RegA0, 17)
+}
+
+func benchmarkLoop(b *testing.B, cached bool) {
+	prog := assemble(b, `
+	loop:
+	addi t0, t0, 1
+	j loop
+	`)
+	cpu := NewDebugBoard(prog).Cpu()
+	cpu.EnableInstructionCache(cached)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cpu.Step()
+	}
+}
+
+func BenchmarkLoop(b *testing.B) {
+	benchmarkLoop(b, false)
+}
+
+func BenchmarkLoopInstructionCache(b *testing.B) {
+	benchmarkLoop(b, true)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+)
+
+var ErrJournalEmpty = errors.New("no journaled steps to undo")
+
+// RamPeeker gives side effect free access to the plain memory behind a
+// memory map, stores to anything else can't be undone
+type RamPeeker interface {
+	PeekByte(addr uint32) (uint8, bool)
+	PokeByte(addr uint32, v uint8) bool
+}
+
+func (mmu *Mmu) PeekByte(addr uint32) (uint8, bool) {
+	r, addr := mmu.findRange(addr)
+	if r == nil || !r.isRam {
+		return 0, false
+	}
+	return r.Memory.LoadByte(addr), true
+}
+
+// PokeByte writes to plain memory regardless of the permissions of its
+// range, a rom is written through to its contents
+func (mmu *Mmu) PokeByte(addr uint32, v uint8) bool {
+	r, addr := mmu.findRange(addr)
+	if r == nil || !r.isRam {
+		return false
+	}
+	if rom, ok := r.Memory.(*Rom); ok {
+		rom.ram.StoreByte(addr, v)
+		return true
+	}
+	r.Memory.StoreByte(addr, v)
+	return true
+}
+
+// PeekByte reads the byte at the virtual address addr for a debugger.
+// Unlike LoadByte it has no side effects, so only plain memory can be
+// read.
+func (cpu *Cpu) PeekByte(addr uint32) (uint8, bool) {
+	if cpu.peeker == nil {
+		return 0, false
+	}
+	paddr, ok := cpu.peekTranslate(addr)
+	if !ok {
+		return 0, false
+	}
+	return cpu.peeker.PeekByte(paddr)
+}
+
+// PokeByte writes v to the virtual address addr for a debugger. Unlike
+// StoreByte the store isn't journaled and doesn't trigger watchpoints,
+// and only plain memory can be written.
+func (cpu *Cpu) PokeByte(addr uint32, v uint8) bool {
+	if cpu.peeker == nil {
+		return false
+	}
+	paddr, ok := cpu.peekTranslate(addr)
+	if !ok || !cpu.peeker.PokeByte(paddr, v) {
+		return false
+	}
+	if cpu.icache != nil {
+		cpu.icache.invalidate(paddr, 1)
+	}
+	return true
+}
+
+type journalStore struct {
+	addr uint32
+	old  uint8
+}
+
+// journalEntry holds what is needed to undo a single step
+type journalEntry struct {
+	state  CpuState
+	stores []journalStore
+}
+
+// journal is a ring buffer of the last steps
+type journal struct {
+	entries []journalEntry
+	// the index of the newest entry
+	head  int
+	count int
+}
+
+// EnableJournal records the last steps executed so they can be undone
+// with StepBack, 0 disables journaling
+func (cpu *Cpu) EnableJournal(steps int) {
+	if steps == 0 {
+		cpu.journal = nil
+		return
+	}
+	cpu.journal = &journal{entries: make([]journalEntry, steps), head: -1}
+}
+
+func (cpu *Cpu) journalStep() {
+	j := cpu.journal
+	j.head = (j.head + 1) % len(j.entries)
+	if j.count < len(j.entries) {
+		j.count++
+	}
+	entry := &j.entries[j.head]
+	entry.state = cpu.getState()
+	entry.stores = entry.stores[:0]
+}
+
+// journalStore remembers the old value of the n bytes at addr
+func (cpu *Cpu) journalStore(addr uint32, n int) {
+	if cpu.journal == nil || cpu.journal.count == 0 || cpu.peeker == nil {
+		return
+	}
+	entry := &cpu.journal.entries[cpu.journal.head]
+	for i := 0; i < n; i++ {
+		if old, ok := cpu.peeker.PeekByte(addr + uint32(i)); ok {
+			entry.stores = append(entry.stores,
+				journalStore{addr + uint32(i), old})
+		}
+	}
+}
+
+// StepBack undoes the last journaled step, stores to memory mapped
+// devices are not undone
+func (cpu *Cpu) StepBack() error {
+	j := cpu.journal
+	if j == nil || j.count == 0 {
+		return ErrJournalEmpty
+	}
+
+	entry := &j.entries[j.head]
+	for i := len(entry.stores) - 1; i >= 0; i-- {
+		cpu.peeker.PokeByte(entry.stores[i].addr, entry.stores[i].old)
+	}
+	if cpu.icache != nil {
+		cpu.icache.flush()
+	}
+	cpu.setState(&entry.state)
+	j.head = (j.head - 1 + len(j.entries)) % len(j.entries)
+	j.count--
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStepBack(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, 0x1000
+	li t1, 0x11223344
+	sw t1, 0(t0)
+	addi t1, t1, 1
+	sb t1, 5(t0)
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	ram := NewRam(0x100)
+	ram.StoreWord(0, 0xdeadbeef)
+	board.board.Mmu().AddRange(0x1000, 0x100, ram)
+	cpu := board.Cpu()
+	cpu.EnableJournal(4)
+
+	var states []CpuState
+	var words [][2]uint32
+	for i := 0; i < 6; i++ {
+		states = append(states, cpu.getState())
+		words = append(words, [2]uint32{ram.LoadWord(0), ram.LoadWord(4)})
+		cpu.Step()
+	}
+	// only the last 4 steps are kept
+	for i := len(states) - 1; i >= len(states)-4; i-- {
+		if err := cpu.StepBack(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cpu.getState(), states[i]) {
+			t.Errorf("step %d: expected state %+v got %+v",
+				i, states[i], cpu.getState())
+		}
+		if w := [2]uint32{ram.LoadWord(0), ram.LoadWord(4)}; w != words[i] {
+			t.Errorf("step %d: expected memory %x got %x", i, words[i], w)
+		}
+	}
+	if err := cpu.StepBack(); err != ErrJournalEmpty {
+		t.Errorf("expected ErrJournalEmpty got %v", err)
+	}
+}
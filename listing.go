@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SourceLine is a line of assembly source
+type SourceLine struct {
+	Line int
+	Text string
+}
+
+// SourceMap maps instruction addresses back to the assembly source lines
+// they were assembled from
+type SourceMap struct {
+	lines map[uint32]SourceLine
+}
+
+// a listing line that emitted code, the line number, the offset into the
+// section, the bytes and the source. Continuation lines for long
+// encodings have no offset nor source and are skipped.
+var _ListingLine = regexp.MustCompile(
+	`^\s*(\d+) ([0-9a-fA-F]+) [0-9a-fA-F]+\s*\t(.*)$`)
+
+// LoadListing reads a GNU as listing as written by the -al option, the
+// offsets in it are into the text section which is loaded at base
+func LoadListing(r io.Reader, base uint32) (*SourceMap, error) {
+	m := &SourceMap{lines: make(map[uint32]SourceLine)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := _ListingLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		line, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseUint(match[2], 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		m.lines[base+uint32(offset)] = SourceLine{
+			Line: line,
+			Text: strings.TrimSpace(match[3]),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Lookup returns the source line that starts at addr, the instructions a
+// pseudo instruction expands to other than the first have none
+func (m *SourceMap) Lookup(addr uint32) (SourceLine, bool) {
+	if m == nil {
+		return SourceLine{}, false
+	}
+	line, ok := m.lines[addr]
+	return line, ok
+}
+
+// annotate appends the source line at addr to s as a comment
+func (m *SourceMap) annotate(s string, addr uint32) string {
+	if line, ok := m.Lookup(addr); ok {
+		return s + "  # " + line.Text
+	}
+	return s
+}
+
+// listingBase is where the text section of image is loaded, flat images
+// are assumed to start with it
+func listingBase(image []uint8) uint32 {
+	if !isElf(image) {
+		return BoardInitialAddr
+	}
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	if text := f.Section(".text"); text != nil {
+		return uint32(text.Addr)
+	}
+	return 0
+}
+
+// loadListingFile loads the listing at path for image, there is no map
+// when path is empty
+func loadListingFile(path string, image []uint8) (*SourceMap, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadListing(f, listingBase(image))
+}
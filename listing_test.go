@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const _Listing = `GAS LISTING prog.s 			page 1
+
+
+   1              	.global _start
+   2              	_start:
+   3 0000 13051000 		li a0, 1
+   4 0004 97020000 		la t0, data
+   4      93820200
+   5 000c 0545     		c.li a0, 1
+   6              	data:
+`
+
+func TestLoadListing(t *testing.T) {
+	sources, err := LoadListing(strings.NewReader(_Listing), 0x100)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	tests := []struct {
+		addr uint32
+		line SourceLine
+		ok   bool
+	}{
+		{0x100, SourceLine{3, "li a0, 1"}, true},
+		{0x104, SourceLine{4, "la t0, data"}, true},
+		// the second instruction of la
+		{0x108, SourceLine{}, false},
+		{0x10c, SourceLine{5, "c.li a0, 1"}, true},
+		{0x0, SourceLine{}, false},
+	}
+	for _, test := range tests {
+		line, ok := sources.Lookup(test.addr)
+		if line != test.line || ok != test.ok {
+			t.Errorf("0x%x: expected %+v, %v got %+v, %v",
+				test.addr, test.line, test.ok, line, ok)
+		}
+	}
+}
+
+// assembleListing writes the assembler's listing of prog to dir
+func assembleListing(t *testing.T, dir string, prog string) string {
+	t.Helper()
+	requireTool(t, _AS)
+	srcPath := filepath.Join(dir, "listing.s")
+	lstPath := filepath.Join(dir, "listing.lst")
+	if err := ioutil.WriteFile(srcPath, []byte(prog), 0444); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(_AS,
+		"-al="+lstPath,
+		"-o", filepath.Join(dir, "listing.o"),
+		"-march="+_Rv32.march,
+		"-mabi="+_Rv32.mabi,
+		srcPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("listing failed (%s) %s", err, out)
+	}
+	if _, err := os.Stat(lstPath); err != nil {
+		t.Skip("the assembler didn't write a listing")
+	}
+	return lstPath
+}
+
+func TestTraceListing(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 1
+	addi a0, a0, 2
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	dir := t.TempDir()
+	lstPath := assembleListing(t, dir, prog)
+	path := filepath.Join(dir, "prog.bin")
+	if err := ioutil.WriteFile(path, assemble(t, prog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := run([]string{"riscv", "trace", "-listing", lstPath, path},
+		strings.NewReader(""), &stdout, &stderr)
+	if err != nil || code != 1 {
+		t.Fatalf("expected exit code 1 got %d, %v", code, err)
+	}
+	trace := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	expected := []string{
+		"0x00000100 x10=0x00000001  # li a0, 1",
+		"0x00000104 x10=0x00000003  # addi a0, a0, 2",
+		"0x00000108 x6=0x00000001  # li t1, 1",
+	}
+	if len(trace) < len(expected) {
+		t.Fatalf("expected at least %d trace lines got %q", len(expected), trace)
+	}
+	for i, line := range expected {
+		if trace[i] != line {
+			t.Errorf("expected %q got %q", line, trace[i])
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"sort"
+	"strings"
 )
 
 const (
@@ -20,6 +26,17 @@ const (
 	OP_LOAD   = 0x03
 	OP_STORE  = 0x23
 	OP_SYSTEM = 0x73
+	OP_FENCE  = 0x0f
+	OP_AMO    = 0x2f
+
+	// floating point, not supported
+	OP_LOAD_FP  = 0x07
+	OP_STORE_FP = 0x27
+	OP_FP       = 0x53
+	OP_FMADD    = 0x43
+	OP_FMSUB    = 0x47
+	OP_FNMSUB   = 0x4b
+	OP_FNMADD   = 0x4f
 )
 
 // OP_IMM
@@ -56,18 +73,48 @@ const (
 	FUNCT_BGEU = 7
 )
 
+// FENCE
+const (
+	FUNCT_FENCE   = 0
+	FUNCT_FENCE_I = 1
+)
+
+// AMO, the operation is in funct5, the top bits of funct7
+const (
+	FUNCT_AMO_W   = 2
+	FUNCT_AMOADD  = 0x00
+	FUNCT_AMOSWAP = 0x01
+	FUNCT_LR      = 0x02
+	FUNCT_SC      = 0x03
+	FUNCT_AMOXOR  = 0x04
+	FUNCT_AMOOR   = 0x08
+	FUNCT_AMOAND  = 0x0c
+	FUNCT_AMOMIN  = 0x10
+	FUNCT_AMOMAX  = 0x14
+	FUNCT_AMOMINU = 0x18
+	FUNCT_AMOMAXU = 0x1c
+)
+
 // SYSTEM
 const (
-	FUNCT_CSRRW = 1
-	FUNCT_CSRRS = 2
-	FUNCT_CSRRC = 3
-	FUNCT_PRIV  = 0
+	FUNCT_CSRRW  = 1
+	FUNCT_CSRRS  = 2
+	FUNCT_CSRRC  = 3
+	FUNCT_CSRRWI = 5
+	FUNCT_CSRRSI = 6
+	FUNCT_CSRRCI = 7
+	FUNCT_PRIV   = 0
 )
 
 // SYSTEM PRIV
 const (
 	PRIV_EBREAK = 0x1
 	PRIV_ECALL  = 0x00
+	PRIV_SRET   = 0x102
+	PRIV_MRET   = 0x302
+	PRIV_WFI    = 0x105
+	// the funct7 of sfence.vma, its rs2 is encoded in the immediate too
+	PRIV_SFENCE_VMA = 0x09
 )
 
 // CSRs
@@ -77,28 +124,190 @@ const (
 	CsrU = 0x000
 
 	CsrStatus   = 0x000
+	CsrIsa      = 0x001
+	CsrEdeleg   = 0x002
+	CsrIdeleg   = 0x003
 	CsrIe       = 0x004
 	CsrTvec     = 0x005
 	CsrScratch  = 0x040
 	CsrEpc      = 0x041
 	CsrCause    = 0x042
 	CsrTval     = 0x043
+	CsrIp       = 0x044
+	CsrAtp      = 0x080
 	CsrCycle    = 0xc00
 	CsrCycleh   = 0xc80
 	CsrTime     = 0xc01
 	CsrTimeh    = 0xc81
 	CsrInstret  = 0xc02
 	CsrInstreth = 0xc82
+	CsrVendorid = 0xc11
+	CsrArchid   = 0xc12
+	CsrImpid    = 0xc13
+	CsrHartid   = 0xc14
 	CsrHalt     = 0x3ff
 )
 
+var _CsrNames = map[uint32]string{
+	CsrStatus | CsrM:   "mstatus",
+	CsrIsa | CsrM:      "misa",
+	CsrIe | CsrM:       "mie",
+	CsrTvec | CsrM:     "mtvec",
+	CsrScratch | CsrM:  "mscratch",
+	CsrEpc | CsrM:      "mepc",
+	CsrCause | CsrM:    "mcause",
+	CsrTval | CsrM:     "mtval",
+	CsrIp | CsrM:       "mip",
+	CsrVendorid | CsrM: "mvendorid",
+	CsrArchid | CsrM:   "marchid",
+	CsrImpid | CsrM:    "mimpid",
+	CsrHartid | CsrM:   "mhartid",
+	CsrEdeleg | CsrM:   "medeleg",
+	CsrIdeleg | CsrM:   "mideleg",
+	CsrStatus | CsrS:   "sstatus",
+	CsrIe | CsrS:       "sie",
+	CsrTvec | CsrS:     "stvec",
+	CsrScratch | CsrS:  "sscratch",
+	CsrEpc | CsrS:      "sepc",
+	CsrCause | CsrS:    "scause",
+	CsrTval | CsrS:     "stval",
+	CsrIp | CsrS:       "sip",
+	CsrAtp | CsrS:      "satp",
+	CsrCycle:           "cycle",
+	CsrCycleh:          "cycleh",
+	CsrTime:            "time",
+	CsrTimeh:           "timeh",
+	CsrInstret:         "instret",
+	CsrInstreth:        "instreth",
+}
+
+// CsrName returns the assembler name of csr or its number in hex if it
+// has no name
+func CsrName(csr uint32) string {
+	if name, ok := _CsrNames[csr]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%03x", csr)
+}
+
+// CsrByName is the inverse of CsrName
+func CsrByName(name string) (uint32, bool) {
+	for csr, csrName := range _CsrNames {
+		if csrName == name {
+			return csr, true
+		}
+	}
+	return 0, false
+}
+
+// Privilege modes
+const (
+	PrivUser       = 0
+	PrivSupervisor = 1
+	PrivMachine    = 3
+)
+
+// mstatus fields
+const (
+	MstatusSIE  = 1 << 1
+	MstatusMIE  = 1 << 3
+	MstatusSPIE = 1 << 5
+	MstatusMPIE = 1 << 7
+	// the privilege mode a supervisor trap was taken from, user or
+	// supervisor
+	MstatusSPP = 1 << 8
+	// the privilege mode a trap was taken from
+	MstatusMPP      = 3 << MstatusMPPShift
+	MstatusMPPShift = 11
+	// supervisor mode may load and store user pages
+	MstatusSUM = 1 << 18
+	// loads from executable pages are allowed
+	MstatusMXR = 1 << 19
+)
+
+// misa fields, every extension has the bit of its letter
+const (
+	MisaA     = 1 << ('A' - 'A')
+	MisaC     = 1 << ('C' - 'A')
+	MisaI     = 1 << ('I' - 'A')
+	MisaS     = 1 << ('S' - 'A')
+	MisaU     = 1 << ('U' - 'A')
+	MisaMXL32 = 1 << 30
+)
+
+// the extensions and privilege modes implemented
+const _Misa = MisaMXL32 | MisaA | MisaC | MisaI | MisaS | MisaU
+
+// mie/mip fields
+const (
+	MieSSIE = 1 << InterruptSupervisorSoftware
+	MieSTIE = 1 << InterruptSupervisorTimer
+	MieSEIE = 1 << InterruptSupervisorExternal
+	MieMSIE = 1 << InterruptMachineSoftware
+	MieMTIE = 1 << InterruptMachineTimer
+	MieMEIE = 1 << InterruptMachineExternal
+	MipSSIP = 1 << InterruptSupervisorSoftware
+	MipSTIP = 1 << InterruptSupervisorTimer
+	MipSEIP = 1 << InterruptSupervisorExternal
+	MipMSIP = 1 << InterruptMachineSoftware
+	MipMTIP = 1 << InterruptMachineTimer
+	MipMEIP = 1 << InterruptMachineExternal
+)
+
+// Interrupts
+const (
+	InterruptSupervisorSoftware = 1
+	InterruptSupervisorTimer    = 5
+	InterruptSupervisorExternal = 9
+	InterruptMachineSoftware    = 3
+	InterruptMachineTimer       = 7
+	InterruptMachineExternal    = 11
+
+	CauseInterrupt = 0x80000000
+)
+
 // Exceptions
 const (
-	ExceptionIllegalInstruction = 2
-	ExceptionBreakpoint         = 3
-	ExceptionEcallM             = 11
+	ExceptionInstructionAddressMisaligned = 0
+	ExceptionInstructionAccessFault       = 1
+	ExceptionIllegalInstruction           = 2
+	ExceptionBreakpoint                   = 3
+	ExceptionLoadAddressMisaligned        = 4
+	ExceptionLoadAccessFault              = 5
+	ExceptionStoreAddressMisaligned       = 6
+	ExceptionStoreAccessFault             = 7
+	ExceptionEcallU                       = 8
+	ExceptionEcallS                       = 9
+	ExceptionEcallM                       = 11
+	ExceptionInstructionPageFault         = 12
+	ExceptionLoadPageFault                = 13
+	ExceptionStorePageFault               = 15
 )
 
+var _ExceptionNames = map[uint32]string{
+	ExceptionInstructionAddressMisaligned: "instruction address misaligned",
+	ExceptionInstructionAccessFault:       "instruction access fault",
+	ExceptionIllegalInstruction:           "illegal instruction",
+	ExceptionBreakpoint:                   "breakpoint",
+	ExceptionLoadAddressMisaligned:        "load address misaligned",
+	ExceptionLoadAccessFault:              "load access fault",
+	ExceptionStoreAddressMisaligned:       "store address misaligned",
+	ExceptionStoreAccessFault:             "store access fault",
+	ExceptionEcallU:                       "environment call from U-mode",
+	ExceptionEcallS:                       "environment call from S-mode",
+	ExceptionEcallM:                       "environment call from M-mode",
+	ExceptionInstructionPageFault:         "instruction page fault",
+	ExceptionLoadPageFault:                "load page fault",
+	ExceptionStorePageFault:               "store page fault",
+}
+
+func ExceptionName(cause uint32) string {
+	if name, ok := _ExceptionNames[cause]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown exception %d", cause)
+}
+
 const (
 	RegZero = 0
 	RegRA   = 1
@@ -144,31 +353,30 @@ var _RegNames []string = []string{
 	"t0",
 	"t1",
 	"t2",
-	"FP",
-	"S0",
-	"S1",
-	"A0",
-	"A1",
-	"A2",
-	"A3",
-	"A4",
-	"A5",
-	"A6",
-	"A7",
-	"S2",
-	"S3",
-	"S4",
-	"S5",
-	"S6",
-	"S7",
-	"S8",
-	"S9",
-	"S10",
-	"S11",
-	"ST3",
-	"ST4",
-	"ST5",
-	"ST6",
+	"s0",
+	"s1",
+	"a0",
+	"a1",
+	"a2",
+	"a3",
+	"a4",
+	"a5",
+	"a6",
+	"a7",
+	"s2",
+	"s3",
+	"s4",
+	"s5",
+	"s6",
+	"s7",
+	"s8",
+	"s9",
+	"s10",
+	"s11",
+	"t3",
+	"t4",
+	"t5",
+	"t6",
 }
 
 type Memory interface {
@@ -182,6 +390,8 @@ type Memory interface {
 
 type Ram struct {
 	memory []uint8
+	// data accesses are big endian, instructions are always little endian
+	bigEndian bool
 }
 
 func NewRam(size uint32) *Ram {
@@ -189,14 +399,38 @@ func NewRam(size uint32) *Ram {
 }
 
 func NewRamFromBuffer(buf []uint8) *Ram {
-	return &Ram{buf}
+	return &Ram{memory: buf}
+}
+
+// SetBigEndian switches data accesses to big endian, instruction fetches
+// stay little endian as the spec requires
+func (mem *Ram) SetBigEndian(bigEndian bool) {
+	mem.bigEndian = bigEndian
+}
+
+func (mem *Ram) FetchWord(addr uint32) uint32 {
+	if uint64(addr)+2 > uint64(len(mem.memory)) {
+		// nothing fits, the Mmu faults before getting here
+		return 0
+	}
+	if uint64(addr)+4 > uint64(len(mem.memory)) {
+		// a compressed instruction at the end of the memory
+		return uint32(binary.LittleEndian.Uint16(mem.memory[addr : addr+2]))
+	}
+	return binary.LittleEndian.Uint32(mem.memory[addr : addr+4])
 }
 
 func (mem *Ram) LoadWord(addr uint32) uint32 {
+	if mem.bigEndian {
+		return binary.BigEndian.Uint32(mem.memory[addr : addr+4])
+	}
 	return binary.LittleEndian.Uint32(mem.memory[addr : addr+4])
 }
 
 func (mem *Ram) LoadHalfWord(addr uint32) uint16 {
+	if mem.bigEndian {
+		return binary.BigEndian.Uint16(mem.memory[addr : addr+2])
+	}
 	return binary.LittleEndian.Uint16(mem.memory[addr : addr+2])
 }
 
@@ -205,10 +439,18 @@ func (mem *Ram) LoadByte(addr uint32) uint8 {
 }
 
 func (mem *Ram) StoreWord(addr uint32, v uint32) {
+	if mem.bigEndian {
+		binary.BigEndian.PutUint32(mem.memory[addr:addr+4], v)
+		return
+	}
 	binary.LittleEndian.PutUint32(mem.memory[addr:addr+4], v)
 }
 
 func (mem *Ram) StoreHalfWord(addr uint32, v uint16) {
+	if mem.bigEndian {
+		binary.BigEndian.PutUint16(mem.memory[addr:addr+2], v)
+		return
+	}
 	binary.LittleEndian.PutUint16(mem.memory[addr:addr+2], v)
 }
 
@@ -216,84 +458,397 @@ func (mem *Ram) StoreByte(addr uint32, v uint8) {
 	mem.memory[addr] = v
 }
 
+// Snapshot returns a copy of the contents of the memory
+func (mem *Ram) Snapshot() []uint8 {
+	return append([]uint8(nil), mem.memory...)
+}
+
+// Restore brings back contents captured by Snapshot of the same Ram
+func (mem *Ram) Restore(snapshot []uint8) {
+	if len(snapshot) != len(mem.memory) {
+		panic("snapshot size doesn't match the memory")
+	}
+	copy(mem.memory, snapshot)
+}
+
 type Range struct {
 	Addr, Size uint32
 	Memory     Memory
+	// accesses the range doesn't permit fault
+	Perm Perm
+	// plain memory as opposed to a memory mapped device
+	isRam bool
+}
+
+// Perm is the set of accesses a range permits
+type Perm uint8
+
+const (
+	PermR Perm = 1 << iota
+	PermW
+	PermX
+)
+
+// AccessStats counts the data accesses that hit plain memory versus
+// memory mapped devices, instruction fetches are not counted
+type AccessStats struct {
+	RamLoads   uint64
+	RamStores  uint64
+	MmioLoads  uint64
+	MmioStores uint64
+}
+
+// InstructionFetcher is implemented by memories that want to tell
+// instruction fetches apart from data loads
+type InstructionFetcher interface {
+	FetchWord(addr uint32) uint32
+}
+
+// ParcelFetcher is implemented by fetchers that can fetch the 16 bit
+// halves of an instruction on their own
+type ParcelFetcher interface {
+	FetchHalfWord(addr uint32) uint16
+}
+
+// AccessFaulter is implemented by memories that can refuse an access,
+// TakeFault reports if the last access faulted and clears the fault
+type AccessFaulter interface {
+	TakeFault() bool
 }
 
 type Mmu struct {
+	// sorted by address, empty ranges come before a range at the same
+	// address
 	ranges []Range
+	// write protected regions
+	protected []Range
+	fault     bool
+	stats     AccessStats
+	// coalesced and sorted, nil when writes aren't recorded
+	writes    []Range
+	recording bool
 }
 
 func NewMmu() *Mmu {
 	return &Mmu{}
 }
 
-func (mmu *Mmu) AddRange(addr, size uint32, mem Memory) {
-	//@todo: sanity checks
-	mmu.ranges = append(mmu.ranges, Range{addr, size, mem})
+var ErrRangeOverlap = errors.New("the range overlaps a mapped range")
+var ErrRangeWraps = errors.New("the range wraps past the end of the address space")
+
+// AddRange maps mem at the size bytes from addr, they must not be mapped
+// already. Memory may be read, written and executed, a Rom may only be
+// read and executed and devices may only be read and written.
+func (mmu *Mmu) AddRange(addr, size uint32, mem Memory) error {
+	perm := PermR | PermW
+	switch mem.(type) {
+	case *Ram, *LazyRam, *SparseRam:
+		perm |= PermX
+	case *Rom:
+		perm = PermR | PermX
+	}
+	return mmu.AddRangePerm(addr, size, mem, perm)
 }
 
-func (mmu *Mmu) findRange(addr uint32) (*Range, uint32) {
+// AddRangePerm is AddRange with the accesses the range permits given
+// explicitly
+func (mmu *Mmu) AddRangePerm(addr, size uint32, mem Memory, perm Perm) error {
+	end := uint64(addr) + uint64(size)
+	if end > 1<<32 {
+		return ErrRangeWraps
+	}
 	for _, r := range mmu.ranges {
-		if addr >= r.Addr && addr < (r.Addr+r.Size) {
-			return &r, addr - r.Addr
+		if uint64(addr) < uint64(r.Addr)+uint64(r.Size) && uint64(r.Addr) < end {
+			return ErrRangeOverlap
+		}
+	}
+	var isRam bool
+	switch mem.(type) {
+	case *Ram, *LazyRam, *SparseRam, *Rom:
+		isRam = true
+	}
+	i := sort.Search(len(mmu.ranges), func(i int) bool {
+		r := mmu.ranges[i]
+		return r.Addr > addr || r.Addr == addr && r.Size > size
+	})
+	mmu.ranges = append(mmu.ranges, Range{})
+	copy(mmu.ranges[i+1:], mmu.ranges[i:])
+	mmu.ranges[i] = Range{addr, size, mem, perm, isRam}
+	return nil
+}
+
+func (mmu *Mmu) Stats() AccessStats {
+	return mmu.stats
+}
+
+func (mmu *Mmu) ResetStats() {
+	mmu.stats = AccessStats{}
+}
+
+func (mmu *Mmu) countLoad(r *Range) {
+	if r.isRam {
+		mmu.stats.RamLoads++
+	} else {
+		mmu.stats.MmioLoads++
+	}
+}
+
+func (mmu *Mmu) countStore(r *Range) {
+	if r.isRam {
+		mmu.stats.RamStores++
+	} else {
+		mmu.stats.MmioStores++
+	}
+}
+
+// SetWriteProtect toggles write protection for [addr, addr+size), stores
+// to a protected region fault
+func (mmu *Mmu) SetWriteProtect(addr, size uint32, protected bool) {
+	var regions []Range
+	end := uint64(addr) + uint64(size)
+	// cut the region out of the existing ones so we never have overlaps
+	for _, r := range mmu.protected {
+		rend := uint64(r.Addr) + uint64(r.Size)
+		if rend <= uint64(addr) || uint64(r.Addr) >= end {
+			regions = append(regions, r)
+			continue
+		}
+		if r.Addr < addr {
+			regions = append(regions, Range{Addr: r.Addr, Size: addr - r.Addr})
+		}
+		if rend > end {
+			regions = append(regions, Range{Addr: uint32(end), Size: uint32(rend - end)})
+		}
+	}
+	if protected {
+		regions = append(regions, Range{Addr: addr, Size: size})
+	}
+	mmu.protected = regions
+}
+
+func (mmu *Mmu) isWriteProtected(addr, size uint32) bool {
+	end := uint64(addr) + uint64(size)
+	for _, r := range mmu.protected {
+		if uint64(r.Addr) < end && uint64(addr) < uint64(r.Addr)+uint64(r.Size) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordWrites starts accumulating the set of written addresses, any
+// previously recorded writes are dropped
+func (mmu *Mmu) RecordWrites(record bool) {
+	mmu.recording = record
+	mmu.writes = nil
+}
+
+// WrittenRanges returns the coalesced ranges written since recording
+// started
+func (mmu *Mmu) WrittenRanges() []Range {
+	return append([]Range(nil), mmu.writes...)
+}
+
+func (mmu *Mmu) recordWrite(addr, size uint32) {
+	if !mmu.recording {
+		return
+	}
+
+	start, end := uint64(addr), uint64(addr)+uint64(size)
+	// find the ranges that overlap or touch the write and merge them
+	i := sort.Search(len(mmu.writes), func(i int) bool {
+		return uint64(mmu.writes[i].Addr)+uint64(mmu.writes[i].Size) >= start
+	})
+	j := i
+	for ; j < len(mmu.writes) && uint64(mmu.writes[j].Addr) <= end; j++ {
+		if uint64(mmu.writes[j].Addr) < start {
+			start = uint64(mmu.writes[j].Addr)
+		}
+		if wend := uint64(mmu.writes[j].Addr) + uint64(mmu.writes[j].Size); wend > end {
+			end = wend
+		}
+	}
+	merged := Range{Addr: uint32(start), Size: uint32(end - start)}
+	mmu.writes = append(mmu.writes[:i], append([]Range{merged}, mmu.writes[j:]...)...)
+}
+
+func (mmu *Mmu) TakeFault() bool {
+	fault := mmu.fault
+	mmu.fault = false
+	return fault
+}
+
+// contains tells if the n bytes at offset are inside the range, unmapped
+// memory is a nil range that contains nothing
+func (r *Range) contains(offset, n uint32) bool {
+	return r != nil && uint64(offset)+uint64(n) <= uint64(r.Size)
+}
+
+// findRange binary searches for the range that contains addr, it is done
+// on every access. The range returned is the one stored in the mmu, not a
+// copy of it, so changes made through it stick.
+func (mmu *Mmu) findRange(addr uint32) (*Range, uint32) {
+	lo, hi := 0, len(mmu.ranges)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		r := &mmu.ranges[mid]
+		if addr < r.Addr {
+			hi = mid
+		} else if addr-r.Addr >= r.Size {
+			lo = mid + 1
+		} else {
+			return r, addr - r.Addr
 		}
 	}
 	return nil, 0
 }
 
-func (mmu *Mmu) LoadWord(addr uint32) uint32 {
+func (mmu *Mmu) FetchWord(addr uint32) uint32 {
 	r, addr := mmu.findRange(addr)
-	if r != nil {
-		return r.Memory.LoadWord(addr)
+	mmu.fault = !r.contains(addr, 2) || r.Perm&PermX == 0
+	if mmu.fault {
+		return 0
 	}
-
-	return 0
+	// memories with their own fetch read instructions as little endian
+	// whatever the endianness of their data
+	f, ok := r.Memory.(InstructionFetcher)
+	if !r.contains(addr, 4) {
+		// only a compressed instruction fits at the end of the range
+		var parcel uint32
+		if ok {
+			parcel = f.FetchWord(addr) & 0xffff
+		} else {
+			parcel = uint32(r.Memory.LoadHalfWord(addr))
+		}
+		mmu.fault = parcel&0x3 == 0x3
+		if mmu.fault {
+			return 0
+		}
+		return parcel
+	}
+	if ok {
+		return f.FetchWord(addr)
+	}
+	return r.Memory.LoadWord(addr)
 }
 
-func (mmu *Mmu) LoadHalfWord(addr uint32) uint16 {
+// FetchHalfWord fetches a single parcel of an instruction, whatever its
+// length
+func (mmu *Mmu) FetchHalfWord(addr uint32) uint16 {
 	r, addr := mmu.findRange(addr)
-	if r != nil {
-		return r.Memory.LoadHalfWord(addr)
+	mmu.fault = !r.contains(addr, 2) || r.Perm&PermX == 0
+	if mmu.fault {
+		return 0
+	}
+	if f, ok := r.Memory.(InstructionFetcher); ok {
+		return uint16(f.FetchWord(addr))
+	}
+	return r.Memory.LoadHalfWord(addr)
+}
+
+func (mmu *Mmu) LoadWord(addr uint32) uint32 {
+	r, offset := mmu.findRange(addr)
+	mmu.fault = !r.contains(offset, 4) || r.Perm&PermR == 0
+	if mmu.fault {
+		return 0
 	}
+	mmu.countLoad(r)
+	return r.Memory.LoadWord(offset)
+}
 
-	return 0
+func (mmu *Mmu) LoadHalfWord(addr uint32) uint16 {
+	r, offset := mmu.findRange(addr)
+	mmu.fault = !r.contains(offset, 2) || r.Perm&PermR == 0
+	if mmu.fault {
+		return 0
+	}
+	mmu.countLoad(r)
+	return r.Memory.LoadHalfWord(offset)
 }
 
 func (mmu *Mmu) LoadByte(addr uint32) uint8 {
-	r, addr := mmu.findRange(addr)
-	if r != nil {
-		return r.Memory.LoadByte(addr)
+	r, offset := mmu.findRange(addr)
+	mmu.fault = !r.contains(offset, 1) || r.Perm&PermR == 0
+	if mmu.fault {
+		return 0
 	}
-
-	return 0
+	mmu.countLoad(r)
+	return r.Memory.LoadByte(offset)
 }
 
 func (mmu *Mmu) StoreWord(addr uint32, v uint32) {
-	r, addr := mmu.findRange(addr)
-	if r != nil {
-		r.Memory.StoreWord(addr, v)
+	r, offset := mmu.findRange(addr)
+	mmu.fault = !r.contains(offset, 4) || r.Perm&PermW == 0 ||
+		mmu.isWriteProtected(addr, 4)
+	if mmu.fault {
+		return
 	}
+	mmu.countStore(r)
+	mmu.recordWrite(addr, 4)
+	r.Memory.StoreWord(offset, v)
 }
 
 func (mmu *Mmu) StoreHalfWord(addr uint32, v uint16) {
-	r, addr := mmu.findRange(addr)
-	if r != nil {
-		r.Memory.StoreHalfWord(addr, v)
+	r, offset := mmu.findRange(addr)
+	mmu.fault = !r.contains(offset, 2) || r.Perm&PermW == 0 ||
+		mmu.isWriteProtected(addr, 2)
+	if mmu.fault {
+		return
 	}
+	mmu.countStore(r)
+	mmu.recordWrite(addr, 2)
+	r.Memory.StoreHalfWord(offset, v)
 }
 
 func (mmu *Mmu) StoreByte(addr uint32, v uint8) {
-	r, addr := mmu.findRange(addr)
-	if r != nil {
-		r.Memory.StoreByte(addr, v)
+	r, offset := mmu.findRange(addr)
+	mmu.fault = !r.contains(offset, 1) || r.Perm&PermW == 0 ||
+		mmu.isWriteProtected(addr, 1)
+	if mmu.fault {
+		return
 	}
+	mmu.countStore(r)
+	mmu.recordWrite(addr, 1)
+	r.Memory.StoreByte(offset, v)
 }
 
 type MmioSerial struct {
 	w io.Writer
 	r io.Reader
+	// when input interrupts are enabled the input is read in the
+	// background so we can tell if a byte is available
+	input chan uint8
+	// output beyond limit bytes is dropped, 0 means no limit
+	limit    int
+	written  int
+	overflow bool
+}
+
+// EnableInputInterrupt makes the serial raise an interrupt whenever an
+// input byte is available, reading with no input available returns 0
+// instead of blocking
+func (s *MmioSerial) EnableInputInterrupt() {
+	if s.input != nil || s.r == nil {
+		return
+	}
+
+	s.input = make(chan uint8, 64)
+	go func() {
+		var b [1]uint8
+		for {
+			n, err := s.r.Read(b[:])
+			if n > 0 {
+				s.input <- b[0]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (s *MmioSerial) InterruptPending() bool {
+	return s.input != nil && len(s.input) > 0
 }
 
 func (s *MmioSerial) LoadWord(addr uint32) uint32 {
@@ -305,14 +860,37 @@ func (s *MmioSerial) LoadHalfWord(addr uint32) uint16 {
 }
 
 func (s *MmioSerial) LoadByte(addr uint32) uint8 {
+	b, _ := s.GetChar()
+	return b
+}
+
+// GetChar reads an input byte, it isn't ok when there is no input
+func (s *MmioSerial) GetChar() (uint8, bool) {
 	if s.r == nil {
-		return 0
+		return 0, false
+	}
+
+	if s.input != nil {
+		select {
+		case b := <-s.input:
+			return b, true
+		default:
+			return 0, false
+		}
 	}
 
+	// the read may block, whatever the guest wrote before, like a
+	// prompt, has to be seen first
+	s.Flush()
 	var b [1]uint8
-	s.r.Read(b[:])
+	n, _ := s.r.Read(b[:])
+
+	return b[0], n == 1
+}
 
-	return b[0]
+// PutChar writes an output byte, it is subject to the output limit
+func (s *MmioSerial) PutChar(c uint8) {
+	s.StoreByte(0, c)
 }
 
 func (s *MmioSerial) StoreWord(addr uint32, v uint32) {
@@ -327,18 +905,35 @@ func (s *MmioSerial) StoreByte(addr uint32, v uint8) {
 	if s.w == nil {
 		return
 	}
+	if s.limit > 0 && s.written >= s.limit {
+		s.overflow = true
+		return
+	}
+	s.written++
 	b := []uint8{v}
 	s.w.Write(b)
+	if v == '\n' {
+		s.Flush()
+	}
+}
+
+// Flush writes out any buffered output
+func (s *MmioSerial) Flush() error {
+	if f, ok := s.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 type Cpu struct {
 	initialAddr uint32
-	registers   [32]uint32
+	registers   RegisterFile[uint32]
 	pc          uint32
 	memory      Memory
 	halt        bool
 	cycles      uint64
 	ticks       uint64
+	timebase    uint64
 	instret     uint64
 	mtvec       uint32
 	mcause      uint32
@@ -346,39 +941,315 @@ type Cpu struct {
 	mtval       uint32
 	mscratch    uint32
 	haltValue   uint32
+	priv        uint32
+	userHalt    bool
+	mstatus     uint32
+	mie         uint32
+	mip         uint32
+	// devices connected to the machine external interrupt
+	externalIrqs    []InterruptLine
+	faulter         AccessFaulter
+	fetcher         InstructionFetcher
+	haltOnException bool
+	// the most steps ExecuteN takes, 0 for no cap
+	stepCap     uint64
+	lastFault   *Fault
+	customCsrs  map[uint32]customCsr
+	sbi         SbiHandler
+	x0WriteHook func(pc, inst uint32)
+	// misaligned accesses are split into byte accesses
+	emulateMisaligned bool
+	// a fault in one of the bytes of a split store
+	splitFault bool
+	// the last access had no valid translation
+	pageFault bool
+	// the page table of the last access couldn't be read
+	walkFault bool
+	satp      uint32
+	journal   *journal
+	peeker    RamPeeker
+	// interrupts raised by the schedule that weren't taken yet
+	schedule []ScheduledInterrupt
+	injected uint32
+	// the timer interrupt is pending while ticks >= mtimecmp
+	mtimecmp uint64
+	// the supervisor timer interrupt is pending while ticks >= stimecmp,
+	// it is set through the SBI which stands in for the firmware that
+	// would forward the machine timer
+	stimecmp uint64
+	// the software interrupt is pending while msip is set
+	msip bool
+	// supervisor interrupts raised by writes to mip or sip
+	softIp   uint32
+	medeleg  uint32
+	mideleg  uint32
+	stvec    uint32
+	sepc     uint32
+	scause   uint32
+	stval    uint32
+	sscratch uint32
+	// the guest halted itself through the halt csr
+	guestHalt bool
+	// a bit per register written since reset, x0 always counts as written
+	written       uint32
+	uninitHook    func(pc uint32, reg uint8)
+	executingStep bool
+	// when not 0 reset fills the registers with values generated from it
+	registerSeed uint64
+	hartId       uint32
+	icache       *icache
+	watchpoints  []Watchpoint
+	watchHit     *WatchpointHit
+	watchCb      WatchpointCallback
+	// the address of the executing instruction, pc already points to
+	// the next one
+	instPc uint32
+	// the instruction at instPc couldn't be fetched, fetchCause is the
+	// exception to raise for it
+	fetchFault bool
+	fetchCause uint32
+	// illegal instruction traps since reset
+	illegalInstructions uint64
+	// the address reserved by LR.W, there is a single hart so only the
+	// hart's own SC.W can break it
+	reservation uint32
+	reserved    bool
+	traceHook   TraceHook
+	// when set only the opcodes in it may execute
+	allowedOpcodes map[uint32]bool
+	profiler       *Profiler
+	overflowHook   OverflowHook
+	stepHook       StepHook
+	trapHook       TrapHook
+	breakpoints    map[uint32]bool
+	callbacks      map[uint32]BreakpointCallback
+	breakHit       bool
+	// step over a breakpoint at the pc
+	resuming bool
+}
+
+// ScheduledInterrupt is an interrupt raised once instret reaches Instret
+type ScheduledInterrupt struct {
+	Instret   uint64
+	Interrupt uint32
+}
+
+type customCsr struct {
+	read  func() uint32
+	write func(uint32)
+}
+
+// InterruptLine is implemented by devices that can raise an interrupt
+type InterruptLine interface {
+	InterruptPending() bool
 }
 
 func New(memory Memory, initialAddr uint32) *Cpu {
 	cpu := &Cpu{}
 	cpu.initialAddr = initialAddr
+	cpu.timebase = 1
 	cpu.memory = memory
+	cpu.faulter, _ = memory.(AccessFaulter)
+	cpu.fetcher, _ = memory.(InstructionFetcher)
+	cpu.peeker, _ = memory.(RamPeeker)
 	cpu.Reset()
 	return cpu
 }
 
+// beforeStore does the bookkeeping for a store of the n bytes of v at addr,
+// which was translated to paddr
+func (cpu *Cpu) beforeStore(addr, paddr uint32, n int, v uint32) {
+	cpu.journalStore(paddr, n)
+	if cpu.icache != nil {
+		cpu.icache.invalidate(paddr, n)
+	}
+	if len(cpu.watchpoints) != 0 {
+		cpu.watch(addr, n, WatchWrite, v)
+	}
+}
+
 func (cpu *Cpu) LoadWord(addr uint32) uint32 {
-	return cpu.memory.LoadWord(addr)
+	if len(cpu.watchpoints) != 0 {
+		cpu.watch(addr, 4, WatchRead, 0)
+	}
+	if cpu.emulateMisaligned && addr%4 != 0 {
+		return cpu.loadBytes(addr, 4)
+	}
+	paddr, ok := cpu.translate(addr, accessLoad)
+	if !ok {
+		return 0
+	}
+	return cpu.memory.LoadWord(paddr)
 }
 func (cpu *Cpu) LoadHalfWord(addr uint32) uint16 {
-	return cpu.memory.LoadHalfWord(addr)
+	if len(cpu.watchpoints) != 0 {
+		cpu.watch(addr, 2, WatchRead, 0)
+	}
+	if cpu.emulateMisaligned && addr%2 != 0 {
+		return uint16(cpu.loadBytes(addr, 2))
+	}
+	paddr, ok := cpu.translate(addr, accessLoad)
+	if !ok {
+		return 0
+	}
+	return cpu.memory.LoadHalfWord(paddr)
 }
 func (cpu *Cpu) LoadByte(addr uint32) uint8 {
-	return cpu.memory.LoadByte(addr)
+	if len(cpu.watchpoints) != 0 {
+		cpu.watch(addr, 1, WatchRead, 0)
+	}
+	paddr, ok := cpu.translate(addr, accessLoad)
+	if !ok {
+		return 0
+	}
+	return cpu.memory.LoadByte(paddr)
 }
 func (cpu *Cpu) StoreWord(addr uint32, v uint32) {
-	cpu.memory.StoreWord(addr, v)
+	if cpu.emulateMisaligned && addr%4 != 0 {
+		cpu.storeBytes(addr, 4, v)
+		return
+	}
+	paddr, ok := cpu.translate(addr, accessStore)
+	if !ok {
+		return
+	}
+	cpu.beforeStore(addr, paddr, 4, v)
+	cpu.memory.StoreWord(paddr, v)
 }
 func (cpu *Cpu) StoreHalfWord(addr uint32, v uint16) {
-	cpu.memory.StoreHalfWord(addr, v)
+	if cpu.emulateMisaligned && addr%2 != 0 {
+		cpu.storeBytes(addr, 2, uint32(v))
+		return
+	}
+	paddr, ok := cpu.translate(addr, accessStore)
+	if !ok {
+		return
+	}
+	cpu.beforeStore(addr, paddr, 2, uint32(v))
+	cpu.memory.StoreHalfWord(paddr, v)
 }
 func (cpu *Cpu) StoreByte(addr uint32, v uint8) {
-	cpu.memory.StoreByte(addr, v)
+	paddr, ok := cpu.translate(addr, accessStore)
+	if !ok {
+		return
+	}
+	cpu.beforeStore(addr, paddr, 1, uint32(v))
+	cpu.memory.StoreByte(paddr, v)
+}
+
+// SetMisalignedEmulation makes misaligned loads and stores get split
+// into byte accesses like cores that support misaligned access in
+// hardware do
+func (cpu *Cpu) SetMisalignedEmulation(emulate bool) {
+	cpu.emulateMisaligned = emulate
+}
+
+// misaligned tells if an access to addr with the width encoded in a load
+// or store's funct3 must trap, it never does when emulating misaligned
+// accesses
+func (cpu *Cpu) misaligned(addr uint32, width uint8) bool {
+	if cpu.emulateMisaligned {
+		return false
+	}
+	switch width {
+	case 1, 5: // LH, LHU and SH
+		return addr%2 != 0
+	case 2: // LW and SW
+		return addr%4 != 0
+	}
+	return false
+}
+
+// loadBytes and storeBytes split an access into byte accesses, the bytes
+// may be on different pages
+func (cpu *Cpu) loadBytes(addr uint32, n int) uint32 {
+	var v uint32
+	pageFault := false
+	for i := 0; i < n; i++ {
+		paddr, ok := cpu.translate(addr+uint32(i), accessLoad)
+		if !ok {
+			pageFault = pageFault || cpu.pageFault
+			cpu.splitFault = cpu.splitFault || cpu.walkFault
+			continue
+		}
+		v |= uint32(cpu.memory.LoadByte(paddr)) << (8 * uint(i))
+		if cpu.faulter != nil && cpu.faulter.TakeFault() {
+			cpu.splitFault = true
+		}
+	}
+	cpu.pageFault = pageFault
+	return v
+}
+
+func (cpu *Cpu) storeBytes(addr uint32, n int, v uint32) {
+	if len(cpu.watchpoints) != 0 {
+		cpu.watch(addr, n, WatchWrite, v)
+	}
+	pageFault := false
+	for i := 0; i < n; i++ {
+		paddr, ok := cpu.translate(addr+uint32(i), accessStore)
+		if !ok {
+			pageFault = pageFault || cpu.pageFault
+			cpu.splitFault = cpu.splitFault || cpu.walkFault
+			continue
+		}
+		cpu.journalStore(paddr, 1)
+		if cpu.icache != nil {
+			cpu.icache.invalidate(paddr, 1)
+		}
+		cpu.memory.StoreByte(paddr, uint8(v>>(8*uint(i))))
+		// the memory only remembers the last access so collect the
+		// faults of all the bytes
+		if cpu.faulter != nil && cpu.faulter.TakeFault() {
+			cpu.splitFault = true
+		}
+	}
+	cpu.pageFault = pageFault
+}
+
+// memoryFault reports if the last memory access faulted, either on the
+// access or on its translation
+func (cpu *Cpu) memoryFault() bool {
+	fault := cpu.splitFault || cpu.pageFault || cpu.walkFault
+	cpu.splitFault = false
+	cpu.pageFault = false
+	cpu.walkFault = false
+	if cpu.faulter != nil && cpu.faulter.TakeFault() {
+		fault = true
+	}
+	return fault
+}
+
+// RegisterCSR adds a csr implemented by the read and write callbacks, it
+// takes precedence over any built-in csr with the same number. A nil
+// read makes the csr read as zero and a nil write makes it read-only.
+// Like any other csr the privilege required to access it is encoded in
+// bits 9:8 of its number.
+func (cpu *Cpu) RegisterCSR(num uint32, read func() uint32, write func(uint32)) {
+	if cpu.customCsrs == nil {
+		cpu.customCsrs = make(map[uint32]customCsr)
+	}
+	if read == nil {
+		read = func() uint32 { return 0 }
+	}
+	cpu.customCsrs[num&0xfff] = customCsr{read, write}
+}
+
+func (cpu *Cpu) isReadOnlyCsr(csr uint32) bool {
+	if c, ok := cpu.customCsrs[csr]; ok {
+		return c.write == nil
+	}
+	// the top quarter of the csr space is read-only
+	return csr&0xc00 == 0xc00
 }
 
 func (cpu *Cpu) IsValidCsr(csr uint32) bool {
 	if csr == CsrHalt {
 		return true
 	}
+	if _, ok := cpu.customCsrs[csr]; ok {
+		return true
+	}
 	priv := csr & ^uint32(0xcff) // save priv
 	csr &= 0xcff                 // ignore priv
 	switch csr {
@@ -391,11 +1262,24 @@ func (cpu *Cpu) IsValidCsr(csr uint32) bool {
 
 		return true
 	}
+	if priv == CsrS {
+		return isSupervisorCsr(csr)
+	}
 	if priv != CsrM {
 		return false
 	}
 	switch csr {
-	case CsrTvec,
+	case CsrStatus,
+		CsrIsa,
+		CsrVendorid,
+		CsrArchid,
+		CsrImpid,
+		CsrHartid,
+		CsrEdeleg,
+		CsrIdeleg,
+		CsrIe,
+		CsrIp,
+		CsrTvec,
 		CsrTval,
 		CsrCause,
 		CsrEpc,
@@ -406,61 +1290,134 @@ func (cpu *Cpu) IsValidCsr(csr uint32) bool {
 	return false
 }
 
-func (cpu *Cpu) GetCsr(csr uint32) uint32 {
+// CanAccessCsr checks if csr can be accessed from the current privilege
+// mode, the required mode is encoded in bits 9:8 of the csr number
+func (cpu *Cpu) CanAccessCsr(csr uint32) bool {
+	if csr == CsrHalt && cpu.userHalt {
+		return true
+	}
+	return (csr>>8)&0x3 <= cpu.priv
+}
+
+// AllowUserHalt lets code running below machine mode write the halt csr
+func (cpu *Cpu) AllowUserHalt(allow bool) {
+	cpu.userHalt = allow
+}
+
+// GetCsr reads csr, it isn't ok if there is no such csr
+func (cpu *Cpu) GetCsr(csr uint32) (uint32, bool) {
+	if c, ok := cpu.customCsrs[csr]; ok {
+		return c.read(), true
+	}
 	if csr == CsrHalt {
-		return cpu.haltValue
+		return cpu.haltValue, true
 	}
 	priv := csr & ^uint32(0xcff) // save priv
 	csr &= 0xcff                 // ignore priv
 	switch csr {
 	case CsrCycle:
-		return uint32(cpu.cycles)
+		return uint32(cpu.cycles), true
 	case CsrCycleh:
-		return uint32(cpu.cycles >> 32)
+		return uint32(cpu.cycles >> 32), true
 	case CsrTime:
-		return uint32(cpu.ticks)
+		return uint32(cpu.ticks), true
 	case CsrTimeh:
-		return uint32(cpu.ticks >> 32)
+		return uint32(cpu.ticks >> 32), true
 	case CsrInstret:
-		return uint32(cpu.instret)
+		return uint32(cpu.instret), true
 	case CsrInstreth:
-		return uint32(cpu.instret >> 32)
+		return uint32(cpu.instret >> 32), true
 	}
 
+	if priv == CsrS {
+		return cpu.getSupervisorCsr(csr), isSupervisorCsr(csr)
+	}
 	// we only have machine mode csrs for everything else
 	if priv != CsrM {
-		panic(fmt.Sprintf("invalid csr: 0x%03x\n", csr))
+		return 0, false
 	}
 
 	switch csr {
+	case CsrStatus:
+		return cpu.mstatus, true
+	case CsrIsa:
+		return _Misa, true
+	case CsrVendorid, CsrArchid, CsrImpid:
+		// not a commercial implementation
+		return 0, true
+	case CsrHartid:
+		return cpu.hartId, true
+	case CsrEdeleg:
+		return cpu.medeleg, true
+	case CsrIdeleg:
+		return cpu.mideleg, true
+	case CsrIe:
+		return cpu.mie, true
+	case CsrIp:
+		// reflect device writes made since the last step
+		cpu.updateInterrupts()
+		return cpu.mip, true
 	case CsrTvec:
-		return cpu.mtvec & 0xfffffffc
+		return cpu.mtvec & 0xfffffffc, true
 	case CsrTval:
-		return cpu.mtval
+		return cpu.mtval, true
 	case CsrCause:
-		return cpu.mcause
+		return cpu.mcause, true
 	case CsrEpc:
-		return cpu.mepc & 0xfffffffe
+		return cpu.mepc & 0xfffffffe, true
 	case CsrScratch:
-		return cpu.mscratch
-	default:
-		fmt.Printf("invalid csr: 0x%03x\n", csr)
+		return cpu.mscratch, true
 	}
-	return 0
+	return 0, false
 }
 
-func (cpu *Cpu) SetCsr(csr uint32, v uint32) {
+// SetCsr writes csr, it isn't ok if there is no such csr or it can't be
+// written
+func (cpu *Cpu) SetCsr(csr uint32, v uint32) bool {
+	if c, ok := cpu.customCsrs[csr]; ok {
+		if c.write != nil {
+			c.write(v)
+		}
+		return c.write != nil
+	}
 	if csr == CsrHalt {
 		cpu.halt = true
+		cpu.guestHalt = true
 		cpu.haltValue = v
-		return
+		return true
 	}
 	priv := csr & ^uint32(0xcff) // save priv
+	if priv == CsrS {
+		if !isSupervisorCsr(csr & 0xcff) {
+			return false
+		}
+		cpu.setSupervisorCsr(csr&0xcff, v)
+		return true
+	}
 	if priv != CsrM {
-		panic(fmt.Sprintf("invalid csr: 0x%03x\n", csr))
+		return false
 	}
 	csr &= 0xcff // ignore priv
 	switch csr {
+	case CsrStatus:
+		mpp := cpu.mstatus & MstatusMPP
+		// MPP is WARL, the reserved mode leaves it as is
+		if (v&MstatusMPP)>>MstatusMPPShift != 2 {
+			mpp = v & MstatusMPP
+		}
+		cpu.mstatus = v&(MstatusMIE|MstatusMPIE|_SstatusMask) | mpp
+	case CsrIsa:
+		// WARL, the extensions can't be turned off
+	case CsrEdeleg:
+		cpu.medeleg = v & _DelegableExceptions
+	case CsrIdeleg:
+		cpu.mideleg = v & _DelegableInterrupts
+	case CsrIe:
+		cpu.mie = v & _ImplementedInterrupts
+	case CsrIp:
+		// the supervisor bits can be raised by software, the rest are
+		// driven by devices
+		cpu.softIp = v & (MipSSIP | MipSTIP)
 	case CsrTvec:
 		cpu.mtvec = v & 0xfffffffc
 	case CsrCause:
@@ -471,16 +1428,26 @@ func (cpu *Cpu) SetCsr(csr uint32, v uint32) {
 		cpu.mscratch = v
 	case CsrEpc:
 		cpu.mepc = v & 0xfffffffe
+	default:
+		return false
 	}
-	// do nothing
+	return true
 }
 
 func (cpu *Cpu) Reset() {
-	for i, _ := range cpu.registers {
-		cpu.registers[i] = 0
+	cpu.registers = RegisterFile[uint32]{}
+	if cpu.registerSeed != 0 {
+		cpu.randomizeRegisters()
 	}
+	cpu.written = 1
 	cpu.pc = cpu.initialAddr
+	cpu.priv = PrivMachine
+	if cpu.sbi != nil {
+		cpu.priv = PrivSupervisor
+	}
 	cpu.halt = false
+	cpu.guestHalt = false
+	cpu.haltValue = 0
 	cpu.cycles = 0
 	cpu.ticks = 0
 	cpu.instret = 0
@@ -489,26 +1456,157 @@ func (cpu *Cpu) Reset() {
 	cpu.mepc = 0
 	cpu.mtval = 0
 	cpu.mscratch = 0
+	cpu.mstatus = 0
+	cpu.mie = 0
+	cpu.mip = 0
+	cpu.injected = 0
+	cpu.mtimecmp = ^uint64(0)
+	cpu.stimecmp = ^uint64(0)
+	cpu.msip = false
+	cpu.softIp = 0
+	cpu.medeleg = 0
+	cpu.mideleg = 0
+	if cpu.sbi != nil {
+		// like the firmware the handler stands in for, supervisor
+		// interrupts are left to the supervisor
+		cpu.mideleg = _DelegableInterrupts
+	}
+	cpu.stvec = 0
+	cpu.sepc = 0
+	cpu.scause = 0
+	cpu.stval = 0
+	cpu.sscratch = 0
+	cpu.satp = 0
+	cpu.lastFault = nil
+	cpu.watchHit = nil
+	cpu.breakHit = false
+	cpu.resuming = false
+	cpu.illegalInstructions = 0
+	cpu.reserved = false
 }
 
-func (cpu *Cpu) GetReg(idx uint8) uint32 {
-	if idx == 0 {
-		return 0
-	} else if idx > 0 && idx < 32 {
-		return cpu.registers[idx]
+// SetRegisterSeed makes Reset fill x1-x31 with pseudo-random values
+// generated from seed instead of zeroes, to find guests that depend on
+// the registers being zero at entry. A seed of 0 restores zeroing.
+func (cpu *Cpu) SetRegisterSeed(seed uint64) {
+	cpu.registerSeed = seed
+}
+
+func (cpu *Cpu) randomizeRegisters() {
+	// splitmix64, so the values only depend on the seed
+	state := cpu.registerSeed
+	for i := uint8(1); i < 32; i++ {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		cpu.registers.Set(i, uint32(z))
+	}
+}
+
+// SetAllowedOpcodes restricts the cpu to the given major opcodes, any
+// other instruction traps as illegal even if it is implemented. Calling
+// it with no opcodes lifts the restriction.
+func (cpu *Cpu) SetAllowedOpcodes(opcodes ...uint32) {
+	cpu.allowedOpcodes = nil
+	if len(opcodes) == 0 {
+		return
+	}
+	cpu.allowedOpcodes = map[uint32]bool{}
+	for _, opcode := range opcodes {
+		cpu.allowedOpcodes[opcode] = true
 	}
+}
+
+// OverflowHook is called with the address and encoding of an add, sub or
+// addi whose signed result overflowed
+type OverflowHook func(pc, inst uint32)
+
+// SetOverflowHook reports signed overflow of add, sub and addi to hook.
+// RISC-V doesn't trap on overflow, this is only a debugging aid and the
+// result is still the wrapped value.
+func (cpu *Cpu) SetOverflowHook(hook OverflowHook) {
+	cpu.overflowHook = hook
+}
+
+// SetHaltOnException makes the cpu halt when an exception is raised
+// instead of trapping to mtvec, the details are available from LastFault
+func (cpu *Cpu) SetHaltOnException(halt bool) {
+	cpu.haltOnException = halt
+}
 
-	panic(fmt.Sprint("invalid register ", idx))
+// SetX0WriteHook sets a function called before executing an instruction
+// that computes a result only to discard it by targeting x0, which is
+// usually a typo for another register
+func (cpu *Cpu) SetX0WriteHook(hook func(pc, inst uint32)) {
+	cpu.x0WriteHook = hook
+}
+
+// discardsResult tells if inst computes a value into x0, jumps, loads
+// and csr accesses to x0 are left out as they are done for side effects
+func discardsResult(inst uint32) bool {
+	if bitrange(inst, 7, 5) != 0 {
+		return false
+	}
+
+	switch inst & 0x7f {
+	case OP, OP_LUI, OP_AUIPC:
+		return true
+	case OP_IMM:
+		// nop is encoded as addi x0, x0, 0
+		return inst != OP_IMM
+	}
+
+	return false
+}
+
+// LastFault returns the last exception raised by the cpu or nil
+func (cpu *Cpu) LastFault() *Fault {
+	return cpu.lastFault
+}
+
+// ConnectExternalInterrupt makes line drive the machine external
+// interrupt, the interrupt is pending while any connected line is
+func (cpu *Cpu) ConnectExternalInterrupt(line InterruptLine) {
+	cpu.externalIrqs = append(cpu.externalIrqs, line)
+}
+
+// SetHartId sets the value of mhartid, it is 0 unless set. Like the
+// timebase it is configuration so Reset keeps it.
+func (cpu *Cpu) SetHartId(id uint32) {
+	cpu.hartId = id
+}
+
+// SetTimebase sets how many ticks of virtual time pass for every
+// executed instruction. This keeps time fully deterministic and lets
+// tests control exactly when a timer deadline is crossed.
+func (cpu *Cpu) SetTimebase(ticksPerInstret uint64) {
+	cpu.timebase = ticksPerInstret
+}
+
+func (cpu *Cpu) GetReg(idx uint8) uint32 {
+	if cpu.uninitHook != nil && cpu.executingStep && idx < 32 &&
+		cpu.written&(1<<idx) == 0 {
+		// only report the first read
+		cpu.written |= 1 << idx
+		cpu.uninitHook(cpu.instPc, idx)
+	}
+	return cpu.registers.Get(idx)
 }
 
 func (cpu *Cpu) SetReg(idx uint8, v uint32) {
-	if idx == 0 {
-		// do nothing
-	} else if idx > 0 && idx < 32 {
-		cpu.registers[idx] = v
-	} else {
-		panic(fmt.Sprint("invalid register ", idx))
+	if idx < 32 {
+		cpu.written |= 1 << idx
 	}
+	cpu.registers.Set(idx, v)
+}
+
+// SetUninitializedReadHook sets a function called the first time the
+// guest reads a register that wasn't written since reset, relying on
+// the reset value of a register is usually a bug
+func (cpu *Cpu) SetUninitializedReadHook(hook func(pc uint32, reg uint8)) {
+	cpu.uninitHook = hook
 }
 
 func (cpu *Cpu) Execute() {
@@ -517,10 +1615,148 @@ func (cpu *Cpu) Execute() {
 	}
 }
 
+// ExecuteN executes until the cpu halts or max instructions retired and
+// returns how many retired, steps that trap don't retire an instruction.
+// It also stops once the step cap set with SetStepCap is reached.
+func (cpu *Cpu) ExecuteN(max uint64) (executed uint64, halted bool) {
+	start := cpu.instret
+	for steps := uint64(0); !cpu.halt && cpu.instret-start < max; steps++ {
+		if cpu.stepCap != 0 && steps == cpu.stepCap {
+			break
+		}
+		cpu.Step()
+	}
+	return cpu.instret - start, cpu.halt
+}
+
+// SetStepCap caps the steps a single ExecuteN takes, 0 removes the cap.
+// Steps that trap don't retire an instruction, so without a cap a guest
+// stuck trapping never exhausts the instruction budget.
+func (cpu *Cpu) SetStepCap(steps uint64) {
+	cpu.stepCap = steps
+}
+
+// ExecuteWithLimit is ExecuteN that returns ErrBudgetExhausted when the
+// cpu didn't halt within max instructions or the step cap
+func (cpu *Cpu) ExecuteWithLimit(max uint64) error {
+	if _, halted := cpu.ExecuteN(max); !halted {
+		return ErrBudgetExhausted
+	}
+	return nil
+}
+
 func (cpu *Cpu) Halt() {
 	cpu.halt = true
 }
 
+func (cpu *Cpu) Pc() uint32 {
+	return cpu.pc
+}
+
+func (cpu *Cpu) SetPc(pc uint32) {
+	cpu.pc = pc
+}
+
+// Cycles returns the value of the cycle csr
+func (cpu *Cpu) Cycles() uint64 {
+	return cpu.cycles
+}
+
+// Time returns the value of the time csr, it advances by the timebase on
+// every instruction and by Board.Tick
+func (cpu *Cpu) Time() uint64 {
+	return cpu.ticks
+}
+
+// Instret returns the value of the instret csr
+func (cpu *Cpu) Instret() uint64 {
+	return cpu.instret
+}
+
+// IsHalted tells if the cpu halted, either by the guest or the host
+func (cpu *Cpu) IsHalted() bool {
+	return cpu.halt
+}
+
+var ErrInvalidPrivilege = errors.New("invalid privilege mode")
+
+// GetPrivilege returns the current privilege mode, one of the Priv*
+// constants
+func (cpu *Cpu) GetPrivilege() uint32 {
+	return cpu.priv
+}
+
+// SetPrivilege forces the privilege mode, so tools can test mode
+// dependent behavior without going through a trap
+func (cpu *Cpu) SetPrivilege(mode uint32) error {
+	switch mode {
+	case PrivUser, PrivSupervisor, PrivMachine:
+		cpu.priv = mode
+		return nil
+	}
+	return ErrInvalidPrivilege
+}
+
+var ErrHalted = errors.New("cpu halted")
+var ErrBudgetExhausted = errors.New("instruction budget exhausted")
+
+// a return address no guest code lives at, reaching it means the
+// function called by CallFunction returned
+const _CallReturnSentinel = 0xfffffff0
+
+// CallFunction calls the guest function at addr following the calling
+// convention and returns its a0 once it returns. The stack pointer is
+// left as is so the caller must make sure it points to usable memory if
+// the function needs a stack. It gives up with ErrBudgetExhausted when
+// the function doesn't return within budget steps.
+func (cpu *Cpu) CallFunction(addr uint32, args []uint32, budget uint64) (uint32, error) {
+	if len(args) > 8 {
+		return 0, fmt.Errorf("too many arguments %d, at most 8 are passed in registers", len(args))
+	}
+
+	for i, arg := range args {
+		cpu.SetReg(RegA0+uint8(i), arg)
+	}
+	cpu.SetReg(RegRA, _CallReturnSentinel)
+	cpu.pc = addr
+	for i := uint64(0); cpu.pc != _CallReturnSentinel; i++ {
+		if cpu.halt {
+			return 0, ErrHalted
+		}
+		if i == budget {
+			return 0, ErrBudgetExhausted
+		}
+		cpu.Step()
+	}
+
+	return cpu.GetReg(RegA0), nil
+}
+
+// the encoding of ecall, it has no operands
+const _EcallInst = OP_SYSTEM
+
+// RunToEcall executes up to budget instructions stopping before the next
+// ecall without taking its trap, it returns the values of a0-a7 so the
+// host can handle the call. To resume, the host sets the results and
+// moves the pc past the ecall.
+func (cpu *Cpu) RunToEcall(budget uint64) ([]uint32, error) {
+	for i := uint64(0); i < budget; i++ {
+		if cpu.halt {
+			return nil, ErrHalted
+		}
+		if inst, _ := cpu.loadInstruction(cpu.pc); inst == _EcallInst {
+			args := make([]uint32, 8)
+			for j := range args {
+				args[j] = cpu.GetReg(RegA0 + uint8(j))
+			}
+			return args, nil
+		}
+		cpu.Step()
+	}
+
+	return nil, ErrBudgetExhausted
+}
+
 func (cpu *Cpu) Debug() string {
 	res := ""
 	for i := uint8(1); i < 32; i++ {
@@ -530,25 +1766,177 @@ func (cpu *Cpu) Debug() string {
 	return res
 }
 
-func (cpu *Cpu) fetch() uint32 {
-	inst := cpu.LoadWord(cpu.pc)
-	cpu.pc += 4
+// loadInstruction loads the instruction at addr, a compressed
+// instruction is in the low half and the high half should be ignored.
+// It isn't ok when there is no memory to fetch from.
+func (cpu *Cpu) loadInstruction(addr uint32) (uint32, bool) {
+	if cpu.paging() {
+		return cpu.loadTranslatedInstruction(addr)
+	}
+	if cpu.fetcher != nil {
+		inst := cpu.fetcher.FetchWord(addr)
+		return inst, !cpu.memoryFault()
+	}
+	// don't read past the end of the memory for a compressed instruction
+	parcel := cpu.LoadHalfWord(addr)
+	if cpu.memoryFault() {
+		return 0, false
+	}
+	if parcel&0x3 != 0x3 {
+		return uint32(parcel), true
+	}
+	inst := uint32(parcel) | uint32(cpu.LoadHalfWord(addr+2))<<16
+	return inst, !cpu.memoryFault()
+}
 
+func (cpu *Cpu) fetch() uint32 {
+	cpu.instPc = cpu.pc
+	// the cache is keyed by physical address, it is only used when the pc
+	// is one
+	cached := cpu.icache != nil && !cpu.paging()
+	if cached {
+		if inst, length, ok := cpu.fetchCached(cpu.pc); ok {
+			cpu.fetchFault = false
+			cpu.pc += uint32(length)
+			return inst
+		}
+	}
+	inst, ok := cpu.loadInstruction(cpu.pc)
+	// decode traps on it
+	cpu.fetchFault = !ok
+	if !ok {
+		cpu.fetchCause = ExceptionInstructionAccessFault
+		if cpu.pageFault {
+			cpu.fetchCause = ExceptionInstructionPageFault
+		}
+		cpu.memoryFault()
+	}
+	var length uint8 = 4
+	if inst&0x3 != 0x3 {
+		length = 2
+		if expanded, ok := expandCompressed(uint16(inst)); ok {
+			inst = expanded
+		} else {
+			// no 32 bit opcode has low bits other than 0b11 so this is
+			// decoded as an illegal instruction
+			inst &= 0xffff
+		}
+	}
+	if cached && ok {
+		cpu.icache.fill(cpu.pc, inst, length)
+	}
+	cpu.pc += uint32(length)
 	return inst
 }
 
-func (cpu *Cpu) decode(inst uint32) {
+// Exception describes a trap taken while executing an instruction
+type Exception struct {
+	Cause uint32
+	Tval  uint32
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("exception %d (tval: 0x%08x)", e.Cause, e.Tval)
+}
+
+// Fault is a summary of an exception meant for reporting
+type Fault struct {
+	Cause     uint32
+	CauseName string
+	Tval      uint32
+	Epc       uint32
+	Inst      uint32
+	Disasm    string
+	// the extension an illegal instruction belongs to if it is one the
+	// cpu doesn't implement
+	MissingExtension string
+}
+
+// missingExtension tells which unimplemented extension inst is from, if
+// any, so it can be told apart from a corrupt instruction
+func missingExtension(inst uint32) string {
+	var double bool
+	switch inst & 0x7f {
+	case OP_LOAD_FP, OP_STORE_FP:
+		// the width field, 2 for words and 3 for double words
+		double = bitrange(inst, 12, 3) == 3
+	case OP_FP, OP_FMADD, OP_FMSUB, OP_FNMSUB, OP_FNMADD:
+		// the fmt field, 0 for single and 1 for double precision
+		double = bitrange(inst, 25, 2) == 1
+	default:
+		return ""
+	}
+
+	if double {
+		return "D"
+	}
+	return "F"
+}
+
+func newFault(cause, tval, epc, inst uint32) *Fault {
+	disasm := Disassemble(inst, epc)
+	fault := &Fault{
+		Cause:     cause,
+		CauseName: ExceptionName(cause),
+		Tval:      tval,
+		Epc:       epc,
+		Inst:      inst,
+		Disasm:    disasm,
+	}
+	if cause == ExceptionIllegalInstruction {
+		fault.MissingExtension = missingExtension(inst)
+	}
+	return fault
+}
+
+func (f *Fault) String() string {
+	s := fmt.Sprintf("%s (cause: %d, tval: 0x%08x) at 0x%08x: %s",
+		f.CauseName, f.Cause, f.Tval, f.Epc, f.Disasm)
+	if f.MissingExtension != "" {
+		s += fmt.Sprintf(" (the %s extension is not supported, "+
+			"compile for rv32i to use soft-float)", f.MissingExtension)
+	}
+	if f.Cause == ExceptionInstructionAccessFault {
+		s += " (no executable memory is mapped there, did the program jump to a " +
+			"bad address or run off its end without halting?)"
+	}
+	return s
+}
+
+// decode executes inst and returns the exception it trapped with, if any
+func (cpu *Cpu) decode(inst uint32) *Exception {
+	var exception *Exception
 	// we are only allowed to trap in the decode phase
 	// this makes it so the trap function is only visible here
 	trap := func(cause uint32, value uint32) {
-		cpu.SetCsr(CsrTval|CsrM, value)
-		cpu.SetCsr(CsrEpc|CsrM, cpu.pc-4)
-		cpu.pc = cpu.GetCsr(CsrTvec | CsrM)
-		cpu.SetCsr(CsrCause|CsrM, cause)
+		exception = &Exception{cause, value}
+		cpu.lastFault = newFault(cause, value, cpu.instPc, inst)
+		if cause == ExceptionIllegalInstruction {
+			cpu.illegalInstructions++
+		}
+		if cpu.haltOnException {
+			// the hart stops at the faulting instruction
+			cpu.pc = cpu.instPc
+			cpu.halt = true
+			return
+		}
+		cpu.takeTrap(cause, value, cpu.instPc)
 		cpu.cycles += 1
-		cpu.ticks += 1
+		cpu.ticks += cpu.timebase
+	}
+	if cpu.fetchFault {
+		cpu.fetchFault = false
+		trap(cpu.fetchCause, cpu.instPc)
+		return exception
+	}
+	if cpu.x0WriteHook != nil && discardsResult(inst) {
+		cpu.x0WriteHook(cpu.instPc, inst)
 	}
 	opcode := inst & 0x7f
+	if cpu.allowedOpcodes != nil && !cpu.allowedOpcodes[opcode] {
+		trap(ExceptionIllegalInstruction, inst)
+		return exception
+	}
 decode:
 	switch opcode {
 	case OP_IMM:
@@ -558,6 +1946,9 @@ decode:
 		switch funct {
 		case FUNCT_ADDI:
 			res = rs1v + imm
+			if cpu.overflowHook != nil && addOverflows(rs1v, imm, res) {
+				cpu.overflowHook(cpu.instPc, inst)
+			}
 		case FUNCT_SLTI:
 			if int32(rs1v) < int32(imm) {
 				res = 1
@@ -577,8 +1968,19 @@ decode:
 		case FUNCT_ORI:
 			res = rs1v | imm
 		case FUNCT_SLLI:
-			res = rs1v << imm
+			// the shift amount is 5 bits on RV32, the bits above it
+			// are reserved
+			if (imm>>5)&0x7f != 0 {
+				trap(ExceptionIllegalInstruction, inst)
+				break decode
+			}
+			res = rs1v << (imm & 0x1f)
 		case FUNCT_SRXI:
+			// only the bit that picks the arithmetic shift may be set
+			if (imm>>5)&0x7f&^0x20 != 0 {
+				trap(ExceptionIllegalInstruction, inst)
+				break decode
+			}
 			if imm&0x400 != 0 {
 				// golang does arithmatic shift for ints
 				res = uint32(int32(rs1v) >> (imm & 0x1f))
@@ -595,7 +1997,7 @@ decode:
 		cpu.SetReg(rd, imm<<12)
 	case OP_AUIPC:
 		_, rd, imm := utype(inst)
-		cpu.SetReg(rd, cpu.pc+(imm<<12)-4)
+		cpu.SetReg(rd, cpu.instPc+(imm<<12))
 	case OP:
 		_, rd, funct3, rs1, rs2, funct7 := rtype(inst)
 		rs1v := cpu.GetReg(rs1)
@@ -603,10 +2005,16 @@ decode:
 		var res uint32
 		switch funct3 {
 		case FUNCT_ADD_SUB:
+			var overflow bool
 			if funct7&0x20 == 0 {
 				res = rs1v + rs2v
+				overflow = addOverflows(rs1v, rs2v, res)
 			} else {
 				res = rs1v - rs2v
+				overflow = subOverflows(rs1v, rs2v, res)
+			}
+			if cpu.overflowHook != nil && overflow {
+				cpu.overflowHook(cpu.instPc, inst)
 			}
 		case FUNCT_SLT:
 			if int32(rs1v) < int32(rs2v) {
@@ -641,11 +2049,17 @@ decode:
 		cpu.SetReg(rd, res)
 	case OP_JAL:
 		_, rd, imm := jtype(inst)
+		if cpu.profiler != nil {
+			cpu.profiler.jump(inst, cpu.instPc+imm, cpu.pc)
+		}
 		cpu.SetReg(rd, cpu.pc)
-		cpu.pc += imm - 4
+		cpu.pc = cpu.instPc + imm
 	case OP_JALR:
 		_, rd, _, rs1, imm := itype(inst)
 		rs1v := cpu.GetReg(rs1)
+		if cpu.profiler != nil {
+			cpu.profiler.jump(inst, (rs1v+imm)&0xfffffffe, cpu.pc)
+		}
 		cpu.SetReg(rd, cpu.pc)
 		cpu.pc = (rs1v + imm) & 0xfffffffe
 	case OP_BRANCH:
@@ -672,11 +2086,15 @@ decode:
 		}
 
 		if shouldBranch {
-			cpu.pc += imm - 4
+			cpu.pc = cpu.instPc + imm
 		}
 	case OP_LOAD:
 		_, dest, width, base, imm := itype(inst)
 		addr := cpu.GetReg(base) + imm
+		if cpu.misaligned(addr, width) {
+			trap(ExceptionLoadAddressMisaligned, addr)
+			break decode
+		}
 		var res uint32
 		switch width {
 		case 0: // LB
@@ -693,10 +2111,19 @@ decode:
 			trap(ExceptionIllegalInstruction, inst)
 			break decode
 		}
+		if cause, ok := cpu.accessException(accessLoad); ok {
+			trap(cause, addr)
+			break decode
+		}
 		cpu.SetReg(dest, res)
 	case OP_STORE:
 		_, funct, rs1, rs2, imm := stype(inst)
 		addr := cpu.GetReg(rs1) + imm
+		// funct 5 is not a store so leave it to trap as illegal
+		if funct != 5 && cpu.misaligned(addr, funct) {
+			trap(ExceptionStoreAddressMisaligned, addr)
+			break decode
+		}
 		rs2v := cpu.GetReg(rs2)
 		switch funct {
 		case 0: // SB
@@ -709,82 +2136,412 @@ decode:
 			trap(ExceptionIllegalInstruction, inst)
 			break decode
 		}
-	case OP_SYSTEM:
-		_, rd, funct3, rs1, imm := itype(inst)
-		switch funct3 {
-		case FUNCT_CSRRW, FUNCT_CSRRS, FUNCT_CSRRC:
-			csr := imm & 0xfff
-			if !cpu.IsValidCsr(csr) {
-				trap(ExceptionIllegalInstruction, inst)
-				break decode
+		if cause, ok := cpu.accessException(accessStore); ok {
+			trap(cause, addr)
+			break decode
+		}
+	case OP_AMO:
+		_, rd, funct3, rs1, rs2, funct7 := rtype(inst)
+		funct5 := funct7 >> 2
+		addr := cpu.GetReg(rs1)
+		rs2v := cpu.GetReg(rs2)
+		if funct3 != FUNCT_AMO_W || (funct5 == FUNCT_LR && rs2 != 0) {
+			trap(ExceptionIllegalInstruction, inst)
+			break decode
+		}
+		if addr%4 != 0 {
+			if funct5 == FUNCT_LR {
+				trap(ExceptionLoadAddressMisaligned, addr)
+			} else {
+				trap(ExceptionStoreAddressMisaligned, addr)
 			}
-
-			// check if we are trying to write to an RO csr
-			isReadOnly := csr > 0xc00
-			if isReadOnly && rs1 != 0 {
-				trap(ExceptionIllegalInstruction, inst)
+			break decode
+		}
+		switch funct5 {
+		case FUNCT_LR:
+			res := cpu.LoadWord(addr)
+			if cause, ok := cpu.accessException(accessLoad); ok {
+				trap(cause, addr)
 				break decode
 			}
-
-			csrv := cpu.GetCsr(csr)
-			rs1v := cpu.GetReg(rs1)
-			cpu.SetReg(rd, csrv)
-			if rs1 != 0 {
-				switch funct3 {
-				case FUNCT_CSRRW:
-					csrv = rs1v
-				case FUNCT_CSRRS:
-					csrv = csrv & rs1v
-				case FUNCT_CSRRC:
-					csrv = csrv & (^rs1v)
-				}
-				cpu.SetCsr(csr, csrv)
+			cpu.reservation = addr
+			cpu.reserved = true
+			cpu.SetReg(rd, res)
+		case FUNCT_SC:
+			var res uint32 = 1
+			if cpu.reserved && cpu.reservation == addr {
+				cpu.StoreWord(addr, rs2v)
+				res = 0
 			}
-		case FUNCT_PRIV:
-			switch imm {
-			case PRIV_ECALL:
-				trap(ExceptionEcallM, cpu.pc-4)
+			cpu.reserved = false
+			if cause, ok := cpu.accessException(accessStore); ok {
+				trap(cause, addr)
 				break decode
-			case PRIV_EBREAK:
-				trap(ExceptionBreakpoint, cpu.pc-4)
+			}
+			cpu.SetReg(rd, res)
+		case FUNCT_AMOSWAP, FUNCT_AMOADD, FUNCT_AMOXOR, FUNCT_AMOAND,
+			FUNCT_AMOOR, FUNCT_AMOMIN, FUNCT_AMOMAX, FUNCT_AMOMINU,
+			FUNCT_AMOMAXU:
+			old := cpu.LoadWord(addr)
+			// a fault of the load is reported as a store/AMO one
+			if cause, ok := cpu.accessException(accessStore); ok {
+				trap(cause, addr)
 				break decode
-			default:
-				trap(ExceptionIllegalInstruction, inst)
+			}
+			var res uint32
+			switch funct5 {
+			case FUNCT_AMOSWAP:
+				res = rs2v
+			case FUNCT_AMOADD:
+				res = old + rs2v
+			case FUNCT_AMOXOR:
+				res = old ^ rs2v
+			case FUNCT_AMOAND:
+				res = old & rs2v
+			case FUNCT_AMOOR:
+				res = old | rs2v
+			case FUNCT_AMOMIN:
+				res = old
+				if int32(rs2v) < int32(old) {
+					res = rs2v
+				}
+			case FUNCT_AMOMAX:
+				res = old
+				if int32(rs2v) > int32(old) {
+					res = rs2v
+				}
+			case FUNCT_AMOMINU:
+				res = old
+				if rs2v < old {
+					res = rs2v
+				}
+			case FUNCT_AMOMAXU:
+				res = old
+				if rs2v > old {
+					res = rs2v
+				}
+			}
+			cpu.StoreWord(addr, res)
+			if cause, ok := cpu.accessException(accessStore); ok {
+				trap(cause, addr)
 				break decode
 			}
+			cpu.SetReg(rd, old)
+		default:
+			trap(ExceptionIllegalInstruction, inst)
+		}
+	case OP_FENCE:
+		_, _, funct3, _, _ := itype(inst)
+		switch funct3 {
+		case FUNCT_FENCE:
+			// there is a single hart so there is nothing to order
+		case FUNCT_FENCE_I:
+			if cpu.icache != nil {
+				cpu.icache.flush()
+			}
 		default:
 			trap(ExceptionIllegalInstruction, inst)
 			break decode
 		}
-
+	case OP_SYSTEM:
+		cpu.system(inst, trap)
 	default:
 		trap(ExceptionIllegalInstruction, inst)
 	}
 
 	cpu.cycles += 1
-	cpu.ticks += 1
-	cpu.instret += 1
+	cpu.ticks += cpu.timebase
+	// an instruction that halted the hart with an exception didn't retire
+	if exception == nil || !cpu.haltOnException {
+		cpu.instret += 1
+	}
+
+	return exception
+}
+
+// system executes the SYSTEM opcode, funct3 selects either a csr
+// instruction or, when it is FUNCT_PRIV, a privileged instruction
+func (cpu *Cpu) system(inst uint32, trap func(cause, value uint32)) {
+	_, _, funct3, _, _ := itype(inst)
+	switch funct3 {
+	case FUNCT_CSRRW, FUNCT_CSRRS, FUNCT_CSRRC,
+		FUNCT_CSRRWI, FUNCT_CSRRSI, FUNCT_CSRRCI:
+		cpu.csrInstruction(inst, trap)
+	case FUNCT_PRIV:
+		cpu.privInstruction(inst, trap)
+	default:
+		trap(ExceptionIllegalInstruction, inst)
+	}
+}
+
+func (cpu *Cpu) csrInstruction(inst uint32, trap func(cause, value uint32)) {
+	_, rd, funct3, rs1, imm := itype(inst)
+	csr := imm & 0xfff
+	if !cpu.IsValidCsr(csr) || !cpu.CanAccessCsr(csr) {
+		trap(ExceptionIllegalInstruction, inst)
+		return
+	}
+
+	// csrrw and csrrwi always write, the set and clear forms don't when
+	// rs1 is x0 or the immediate is 0
+	write := funct3 == FUNCT_CSRRW || funct3 == FUNCT_CSRRWI || rs1 != 0
+
+	// check if we are trying to write to an RO csr
+	if cpu.isReadOnlyCsr(csr) && write {
+		trap(ExceptionIllegalInstruction, inst)
+		return
+	}
+
+	csrv, ok := cpu.GetCsr(csr)
+	if !ok {
+		trap(ExceptionIllegalInstruction, inst)
+		return
+	}
+	// the immediate forms encode a 5 bit immediate in place of rs1
+	rs1v := uint32(rs1)
+	if funct3 < FUNCT_CSRRWI {
+		rs1v = cpu.GetReg(rs1)
+	}
+	if write {
+		v := csrv
+		switch funct3 {
+		case FUNCT_CSRRW, FUNCT_CSRRWI:
+			v = rs1v
+		case FUNCT_CSRRS, FUNCT_CSRRSI:
+			v = csrv | rs1v
+		case FUNCT_CSRRC, FUNCT_CSRRCI:
+			v = csrv & (^rs1v)
+		}
+		// rd isn't written when the instruction traps
+		if !cpu.SetCsr(csr, v) {
+			trap(ExceptionIllegalInstruction, inst)
+			return
+		}
+	}
+	cpu.SetReg(rd, csrv)
+}
+
+// privInstruction executes the instructions encoded with FUNCT_PRIV,
+// they are told apart by the immediate
+func (cpu *Cpu) privInstruction(inst uint32, trap func(cause, value uint32)) {
+	_, rd, _, rs1, imm := itype(inst)
+	if imm>>5 == PRIV_SFENCE_VMA && rd == 0 {
+		if cpu.priv < PrivSupervisor {
+			trap(ExceptionIllegalInstruction, inst)
+		}
+		// there is no tlb, every access walks the page table
+		return
+	}
+	// none of them has register operands
+	if rd != 0 || rs1 != 0 {
+		trap(ExceptionIllegalInstruction, inst)
+		return
+	}
+
+	switch imm {
+	case PRIV_ECALL:
+		if cpu.priv == PrivSupervisor && cpu.sbi != nil {
+			cpu.callSbi()
+			return
+		}
+		trap(ExceptionEcallU+cpu.priv, cpu.instPc)
+	case PRIV_EBREAK:
+		trap(ExceptionBreakpoint, cpu.instPc)
+	case PRIV_MRET:
+		if cpu.priv < PrivMachine {
+			trap(ExceptionIllegalInstruction, inst)
+			return
+		}
+		cpu.leaveTrap()
+		cpu.pc = cpu.mepc
+	case PRIV_SRET:
+		if cpu.priv < PrivSupervisor {
+			trap(ExceptionIllegalInstruction, inst)
+			return
+		}
+		cpu.leaveSupervisorTrap()
+		cpu.pc = cpu.sepc
+	case PRIV_WFI:
+		// pending interrupts are taken before every step, so going on
+		// right away is a valid way to wait for one
+	default:
+		trap(ExceptionIllegalInstruction, inst)
+	}
+}
+
+// enterTrap stacks the interrupt enable bit and the privilege mode as
+// done on any trap, the handler runs in machine mode. The stack is a
+// single level deep, a trap taken inside a handler overwrites MPIE and
+// MPP as well as mepc, mcause and mtval. A handler that may trap again
+// has to save mstatus and mepc before it does so and restore them before
+// its own mret.
+func (cpu *Cpu) enterTrap() {
+	// don't let a reservation leak into the handler
+	cpu.reserved = false
+	cpu.mstatus &= ^uint32(MstatusMPIE | MstatusMPP)
+	if cpu.mstatus&MstatusMIE != 0 {
+		cpu.mstatus |= MstatusMPIE
+	}
+	cpu.mstatus &= ^uint32(MstatusMIE)
+	cpu.mstatus |= cpu.priv << MstatusMPPShift
+	cpu.priv = PrivMachine
+}
+
+// leaveTrap undoes enterTrap when returning from a handler, MPIE is left
+// set and MPP is left as user mode so a following mret without a trap in
+// between enables interrupts and drops to user mode
+func (cpu *Cpu) leaveTrap() {
+	cpu.reserved = false
+	cpu.mstatus &= ^uint32(MstatusMIE)
+	if cpu.mstatus&MstatusMPIE != 0 {
+		cpu.mstatus |= MstatusMIE
+	}
+	cpu.mstatus |= MstatusMPIE
+	cpu.priv = (cpu.mstatus & MstatusMPP) >> MstatusMPPShift
+	cpu.mstatus &= ^uint32(MstatusMPP)
+	cpu.mstatus |= PrivUser << MstatusMPPShift
+}
+
+func (cpu *Cpu) updateInterrupts() {
+	for len(cpu.schedule) > 0 && cpu.schedule[0].Instret <= cpu.instret {
+		cpu.injected |= 1 << cpu.schedule[0].Interrupt
+		cpu.schedule = cpu.schedule[1:]
+	}
+
+	cpu.mip = cpu.injected | cpu.softIp
+	if cpu.ticks >= cpu.mtimecmp {
+		cpu.mip |= MipMTIP
+	}
+	if cpu.ticks >= cpu.stimecmp {
+		cpu.mip |= MipSTIP
+	}
+	if cpu.msip {
+		cpu.mip |= MipMSIP
+	}
+	for _, line := range cpu.externalIrqs {
+		if line.InterruptPending() {
+			cpu.mip |= MipMEIP
+			break
+		}
+	}
+}
+
+// ScheduleInterrupt raises interrupt once instret reaches the given count,
+// it stays pending until it is taken. This makes interrupt handling
+// testable without depending on real devices or timing.
+func (cpu *Cpu) ScheduleInterrupt(instret uint64, interrupt uint32) {
+	i := sort.Search(len(cpu.schedule), func(i int) bool {
+		return cpu.schedule[i].Instret > instret
+	})
+	cpu.schedule = append(cpu.schedule, ScheduledInterrupt{})
+	copy(cpu.schedule[i+1:], cpu.schedule[i:])
+	cpu.schedule[i] = ScheduledInterrupt{instret, interrupt}
+}
+
+// checkInterrupts takes a pending and enabled interrupt, this is done
+// between instructions so epc points to the next instruction to execute
+func (cpu *Cpu) checkInterrupts() {
+	cpu.updateInterrupts()
+	pending := cpu.mip & cpu.mie
+	if pending == 0 {
+		return
+	}
+
+	// interrupts are always enabled for the modes below the one that
+	// handles them and depend on its enable bit when in that mode
+	var enabled uint32
+	if cpu.priv < PrivMachine || cpu.mstatus&MstatusMIE != 0 {
+		enabled |= pending &^ cpu.mideleg
+	}
+	if cpu.priv < PrivSupervisor ||
+		cpu.priv == PrivSupervisor && cpu.mstatus&MstatusSIE != 0 {
+		enabled |= pending & cpu.mideleg
+	}
+	for _, interrupt := range _InterruptPriority {
+		if enabled&(1<<interrupt) != 0 {
+			cpu.injected &= ^uint32(1 << interrupt)
+			cpu.takeTrap(CauseInterrupt|interrupt, 0, cpu.pc)
+			return
+		}
+	}
+}
+
+// takeTrap enters the handler of a trap, a trap taken below machine mode
+// whose cause is delegated in medeleg or mideleg goes to the supervisor
+func (cpu *Cpu) takeTrap(cause, tval, epc uint32) {
+	deleg := cpu.medeleg
+	if cause&CauseInterrupt != 0 {
+		deleg = cpu.mideleg
+	}
+	if cpu.priv < PrivMachine && deleg&(1<<(cause&0x1f)) != 0 {
+		cpu.enterSupervisorTrap()
+		cpu.stval = tval
+		cpu.sepc = epc & 0xfffffffe
+		cpu.scause = cause
+		cpu.pc = cpu.stvec
+	} else {
+		cpu.enterTrap()
+		cpu.SetCsr(CsrTval|CsrM, tval)
+		cpu.SetCsr(CsrEpc|CsrM, epc)
+		cpu.SetCsr(CsrCause|CsrM, cause)
+		cpu.pc, _ = cpu.GetCsr(CsrTvec | CsrM)
+	}
+	if cpu.trapHook != nil {
+		cpu.trapHook(cause, tval, epc)
+	}
 }
 
 func (cpu *Cpu) Step() {
 	if cpu.halt {
 		return
 	}
+	if (cpu.resuming || len(cpu.breakpoints) != 0) && cpu.checkBreakpoint() {
+		return
+	}
+	if len(cpu.callbacks) != 0 && cpu.runCallback() {
+		return
+	}
+
+	if cpu.journal != nil {
+		cpu.journalStep()
+	}
+
+	// only taken when tracing, so untraced steps don't allocate it
+	var before *CpuState
+	if cpu.traceHook != nil {
+		state := cpu.getState()
+		before = &state
+	}
+
+	cpu.checkInterrupts()
 
 	inst := cpu.fetch()
+	if cpu.stepHook != nil {
+		cpu.stepHook(cpu.instPc, inst)
+	}
+	cpu.executingStep = true
 	cpu.decode(inst)
+	cpu.executingStep = false
+
+	if cpu.traceHook != nil {
+		after := cpu.getState()
+		cpu.traceHook(cpu.instPc, before, &after)
+	}
 }
 
 func bitrange(inst uint32, fromBit, len uint) uint32 {
 	return (inst >> fromBit) & ((1 << len) - 1)
 }
 
-func signExtend(n uint32, bit uint) uint32 {
-	if n&(1<<bit) != 0 {
-		n |= ^((1 << bit) - 1)
-	}
+// addOverflows tells if res = a + b overflowed as a signed addition, that
+// is both operands have the same sign and the result doesn't
+func addOverflows(a, b, res uint32) bool {
+	return (a^res)&(b^res)&0x80000000 != 0
+}
 
-	return n
+// subOverflows tells if res = a - b overflowed as a signed subtraction
+func subOverflows(a, b, res uint32) bool {
+	return (a^b)&(a^res)&0x80000000 != 0
 }
 
 func btype(inst uint32) (opcode, funct3, rs1, rs2 uint8, imm uint32) {
@@ -846,13 +2603,20 @@ func stype(inst uint32) (opcode, funct3, rs1, rs2 uint8, imm uint32) {
 }
 
 type Board struct {
-	cpu *Cpu
+	cpu              *Cpu
+	mmu              *Mmu
+	serial           *MmioSerial
+	instructionLimit uint64
 }
 
 func (b *Board) Cpu() *Cpu {
 	return b.cpu
 }
 
+func (b *Board) Mmu() *Mmu {
+	return b.mmu
+}
+
 func (b *Board) Execute() {
 	b.cpu.Execute()
 }
@@ -861,31 +2625,395 @@ func (b *Board) Step() {
 	b.cpu.Step()
 }
 
+// Flush drains the device buffers, it should be called once the cpu
+// halts or the last output of the guest might be lost
+func (b *Board) Flush() error {
+	return b.serial.Flush()
+}
+
+// LastFault returns the last exception raised by the board's cpu or nil
+func (b *Board) LastFault() *Fault {
+	return b.cpu.LastFault()
+}
+
+// The value written to the halt csr to report success, anything else is a
+// failure code
+const HaltSuccess = 0
+
+// RunResult is the outcome of running a guest
+type RunResult struct {
+	// the guest halted itself as opposed to being stopped
+	Halted bool
+	Code   uint32
+	// the number of illegal instruction traps taken, well formed
+	// programs take none
+	IllegalInstructions uint64
+}
+
+// Success tells if the guest halted reporting success, a guest that
+// never halted didn't succeed whatever the halt csr holds
+func (r RunResult) Success() bool {
+	return r.Halted && r.Code == HaltSuccess
+}
+
+func (b *Board) Result() RunResult {
+	return RunResult{
+		Halted:              b.cpu.guestHalt,
+		Code:                b.cpu.haltValue,
+		IllegalInstructions: b.cpu.illegalInstructions,
+	}
+}
+
+// EnableSbi resets the board into supervisor mode with ecalls serviced
+// by a legacy SBI shim using the serial's console
+func (b *Board) EnableSbi() {
+	b.cpu.SetSbiHandler(NewLegacySbi(b.serial))
+	b.cpu.Reset()
+}
+
+// Tick advances the virtual time by n ticks without executing
+// instructions, so an external simulation can drive time
+func (b *Board) Tick(n uint64) {
+	b.cpu.ticks += n
+}
+
+// EnableSerialInterrupt connects the serial input to the machine
+// external interrupt so guests don't have to poll for input
+func (b *Board) EnableSerialInterrupt() {
+	b.serial.EnableInputInterrupt()
+	b.cpu.ConnectExternalInterrupt(b.serial)
+}
+
+var ErrOutputLimit = errors.New("output limit exceeded")
+
+// SetLimits caps the number of steps Run executes and the number
+// of bytes the guest may write to the serial, 0 means no limit
+func (b *Board) SetLimits(instructions uint64, output int) {
+	b.instructionLimit = instructions
+	b.serial.limit = output
+}
+
+// Run executes until the cpu halts or one of the limits is exceeded
+func (b *Board) Run() error {
+	for executed := uint64(0); !b.cpu.halt; executed++ {
+		if b.instructionLimit > 0 && executed >= b.instructionLimit {
+			return ErrBudgetExhausted
+		}
+		b.cpu.Step()
+		if b.serial.overflow {
+			return ErrOutputLimit
+		}
+	}
+
+	return nil
+}
+
 const BoardInitialAddr = 0x100
+const BoardSerialAddr = 0xfffffffe
 
-func NewBoard(prog []uint8, in io.Reader, out io.Writer) *Board {
+// newBoardMmu maps the flat image prog, the devices are added by newBoard
+func newBoardMmu(prog []uint8) *Mmu {
 	mmu := NewMmu()
 	mmu.AddRange(BoardInitialAddr, uint32(len(prog)), NewRamFromBuffer(prog))
-	mmu.AddRange(0xfffffffe, 1, &MmioSerial{r: in, w: out})
-	cpu := New(mmu, BoardInitialAddr)
+	return mmu
+}
+
+func newBoardSerial(in io.Reader, out io.Writer) *MmioSerial {
+	serial := &MmioSerial{r: in}
+	if out != nil {
+		serial.w = bufio.NewWriter(out)
+	}
+	return serial
+}
+
+// NewBoard creates a board running the flat image prog, it is loaded at
+// and starts from BoardInitialAddr. It panics if prog is so large it
+// overlaps the devices.
+func NewBoard(prog []uint8, in io.Reader, out io.Writer) *Board {
+	b, err := newBoard(newBoardMmu(prog), newBoardSerial(in, out), BoardInitialAddr)
+	if err != nil {
+		panic(fmt.Sprint("the image doesn't fit the memory map: ", err))
+	}
+	return b
+}
+
+// NewElfBoard creates a board running an elf executable, its segments are
+// loaded at their addresses and it starts from its entry point
+func NewElfBoard(r io.ReaderAt, in io.Reader, out io.Writer) (*Board, error) {
+	mmu := NewMmu()
+	entry, err := loadElf(r, mmu)
+	if err != nil {
+		return nil, err
+	}
+	return newBoard(mmu, newBoardSerial(in, out), entry)
+}
+
+// newBoard adds the devices to the memory map, it fails when the image
+// overlaps them
+func newBoard(mmu *Mmu, serial *MmioSerial, initialAddr uint32) (*Board, error) {
+	cpu := New(mmu, initialAddr)
+	b := &Board{
+		cpu:    cpu,
+		mmu:    mmu,
+		serial: serial,
+	}
+	devices := []struct {
+		addr, size uint32
+		dev        Memory
+	}{
+		{BoardSerialAddr, 1, serial},
+		{BoardClintAddr, ClintSize, NewClint(cpu)},
+		{BoardCountersAddr, CountersSize, NewCounters(cpu)},
+	}
+	for _, d := range devices {
+		if err := b.AddDevice(d.addr, d.size, d.dev); err != nil {
+			return nil, err
+		}
+	}
 	cpu.Reset()
-	return &Board{
-		cpu: cpu,
+	return b, nil
+}
+
+// AddDevice maps dev at addr, the addresses it sees are offsets into its
+// size bytes. It fails when the range overlaps memory or a device that is
+// already mapped.
+func (b *Board) AddDevice(addr, size uint32, dev Memory) error {
+	return b.mmu.AddRange(addr, size, dev)
+}
+
+// command is a subcommand of the program, args[0] is its name
+type command func(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+
+var _Commands = map[string]command{
+	"run": func(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		return runImage(args, stdin, stdout, stderr, false)
+	},
+	"trace": func(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		return runImage(args, stdin, stdout, stderr, true)
+	},
+	"disasm": disasmImage,
+	"info":   infoImage,
+}
+
+// run is the whole program, it returns the exit code instead of exiting
+// so it can be embedded and tested in-process. The first argument picks
+// a subcommand, without one the image is run.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if len(args) > 1 {
+		if cmd, ok := _Commands[args[1]]; ok {
+			return cmd(append([]string{args[0] + " " + args[1]}, args[2:]...),
+				stdin, stdout, stderr)
+		}
 	}
+	return runImage(args, stdin, stdout, stderr, false)
 }
 
-func main() {
-	flag.Parse()
-	if flag.NArg() != 1 {
-		flag.Usage()
-		flag.PrintDefaults()
-		os.Exit(1)
+// runImage runs an image, when trace is set every step is written to
+// stderr as formatted by FormatTraceLine
+func runImage(args []string, stdin io.Reader, stdout, stderr io.Writer, trace bool) (int, error) {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	serialIrq := flags.Bool("serial-irq", false,
+		"raise an external interrupt when serial input is available")
+	sbi := flags.Bool("sbi", false,
+		"boot in supervisor mode and service ecalls with an SBI shim")
+	warnX0Write := flags.Bool("warn-x0-write", false,
+		"warn about instructions that compute a result into x0")
+	symbolsPath := flags.String("symbols", "",
+		"an elf to annotate reported addresses with symbols from")
+	emulateMisaligned := flags.Bool("emulate-misaligned", false,
+		"split misaligned loads and stores into byte accesses")
+	maxInstructions := flags.Uint64("max-instructions", 0,
+		"stop after executing this many instructions, 0 means no limit")
+	maxOutput := flags.Int("max-output", 0,
+		"stop once the guest writes more than this many bytes, 0 means no limit")
+	corePath := flags.String("core", "",
+		"write an elf core dump here when -halt-on-exception stops on a fault")
+	rv64 := flags.Bool("rv64", false, "run the program on an RV64I hart")
+	warnUninit := flags.Bool("warn-uninit", false,
+		"warn when the guest reads a register it never wrote")
+	registerSeed := flags.Uint64("register-seed", 0,
+		"fill the registers with pseudo-random values from this seed at reset, 0 means zeroes")
+	haltOnException := flags.Bool("halt-on-exception", false,
+		"halt and report exceptions instead of trapping to mtvec")
+	bootrom := flags.Bool("bootrom", false,
+		"start from a boot rom that passes the hart id and -dtb to the program")
+	dtb := flags.Uint("dtb", 0, "the device tree address the boot rom passes in a1")
+	gdbAddr := flags.String("gdb", "",
+		"wait for gdb to connect on this tcp address before running")
+	listingPath := flags.String("listing", "",
+		"an assembler listing to annotate traced instructions with their source lines")
+	genHeader := flags.String("gen-header", "",
+		"write the guest runtime header to the given path and exit")
+	if err := flags.Parse(args[1:]); err == flag.ErrHelp {
+		return 0, nil
+	} else if err != nil {
+		return 2, nil
 	}
-	prog, err := ioutil.ReadFile(flag.Arg(0))
+	if *genHeader != "" {
+		f, err := os.Create(*genHeader)
+		if err != nil {
+			return 1, err
+		}
+		defer f.Close()
+		if err := writeRuntimeHeader(f); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1, nil
+	}
+	prog, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return 1, err
+	}
+	sources, err := loadListingFile(*listingPath, prog)
+	if err != nil {
+		return 1, err
+	}
+	symbols := &SymbolTable{}
+	if *symbolsPath != "" {
+		f, err := os.Open(*symbolsPath)
+		if err != nil {
+			return 1, err
+		}
+		symbols, err = LoadSymbols(f)
+		f.Close()
+		if err != nil {
+			return 1, err
+		}
+	}
+	if *rv64 {
+		// the RV64 hart is bare, it always halts on exceptions and
+		// none of the other options apply to it
+		var unsupported []string
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name != "rv64" && f.Name != "halt-on-exception" {
+				unsupported = append(unsupported, "-"+f.Name)
+			}
+		})
+		if len(unsupported) > 0 {
+			return 1, fmt.Errorf("%s not supported on RV64",
+				strings.Join(unsupported, ", "))
+		}
+		if isElf(prog) {
+			return 1, errors.New("elf executables are not supported on RV64")
+		}
+		if trace {
+			return 1, errors.New("tracing is not supported on RV64")
+		}
+		mmu := newBoardMmu(prog)
+		serial := newBoardSerial(stdin, stdout)
+		if err := mmu.AddRange(BoardSerialAddr, 1, serial); err != nil {
+			return 1, err
+		}
+		cpu := NewCpu64(mmu, BoardInitialAddr)
+		cpu.Execute()
+		serial.Flush()
+		if e := cpu.Exception(); e != nil {
+			fmt.Fprintln(stderr, e)
+			return 1, nil
+		}
+		return int(cpu.HaltValue()), nil
+	}
+	// flat images are told apart from elf executables by the elf magic
+	var board *Board
+	if isElf(prog) {
+		board, err = NewElfBoard(bytes.NewReader(prog), stdin, stdout)
+		if err != nil {
+			return 1, err
+		}
+	} else {
+		board = NewBoard(prog, stdin, stdout)
+	}
+	if *bootrom {
+		if err := board.EnableBootrom(uint32(*dtb)); err != nil {
+			return 1, err
+		}
+	}
+	if *serialIrq {
+		board.EnableSerialInterrupt()
+	}
+	if *sbi {
+		board.EnableSbi()
+	}
+	board.Cpu().SetHaltOnException(*haltOnException)
+	board.Cpu().SetMisalignedEmulation(*emulateMisaligned)
+	if *registerSeed != 0 {
+		board.Cpu().SetRegisterSeed(*registerSeed)
+		board.Cpu().Reset()
+	}
+	if *warnUninit {
+		board.Cpu().SetUninitializedReadHook(func(pc uint32, reg uint8) {
+			fmt.Fprintf(stderr,
+				"warning: read of uninitialized x%d at 0x%08x\n", reg, pc)
+		})
+	}
+	if *warnX0Write {
+		board.Cpu().SetX0WriteHook(func(pc, inst uint32) {
+			fmt.Fprintf(stderr, "warning: write to x0 at 0x%08x: %s\n",
+				pc, Disassemble(inst, pc))
+		})
+	}
+	if trace {
+		board.Cpu().SetTraceHook(func(pc uint32, before, after *CpuState) {
+			fmt.Fprintln(stderr, sources.annotate(FormatTraceLine(pc, before, after), pc))
+		})
+	}
+	board.SetLimits(*maxInstructions, *maxOutput)
+	if *gdbAddr != "" {
+		if err := serveGdb(*gdbAddr, board.Cpu(), stderr); err != nil {
+			return 1, err
+		}
+	}
+	err = board.Run()
+	board.Flush()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1, nil
+	}
+	if fault := board.LastFault(); *haltOnException && fault != nil {
+		fmt.Fprintln(stderr, fault)
+		fmt.Fprintln(stderr, "in", symbols.Annotate(fault.Epc))
+		if *corePath != "" {
+			f, err := os.Create(*corePath)
+			if err != nil {
+				return 1, err
+			}
+			defer f.Close()
+			if err := board.WriteCore(f); err != nil {
+				return 1, err
+			}
+		}
+		return 1, nil
+	}
+	code, _ := board.Cpu().GetCsr(CsrHalt)
+	return int(code), nil
+}
+
+// serveGdb waits for a single gdb connection and serves it, once gdb
+// detaches the program keeps running on its own
+func serveGdb(addr string, cpu *Cpu, stderr io.Writer) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stderr, "waiting for gdb on", l.Addr())
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return NewGdbStub(cpu).Serve(conn)
+}
+
+func main() {
+	code, err := run(os.Args, os.Stdin, os.Stdout, os.Stderr)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
 	}
-	board := NewBoard(prog, os.Stdin, os.Stdout)
-	board.Execute()
-	os.Exit(int(board.Cpu().GetCsr(CsrHalt)))
+	os.Exit(code)
 }
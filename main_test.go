@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	prog := `
+	li t0, {{.serial}}
+	li t1, 'h'
+	sb t1, 0(t0)
+	li t1, 42
+	csrrw x0, 0x3ff, t1
+	`
+	prog = NewProgTemplate(prog).Execute(ProgArgs{"serial": BoardSerialAddr})
+	t.Log("prog: ", prog)
+	path := filepath.Join(t.TempDir(), "prog.bin")
+	if err := ioutil.WriteFile(path, assemble(t, prog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := run([]string{"riscv", path}, strings.NewReader(""),
+		&stdout, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if code != 42 {
+		t.Errorf("expected exit code 42 got %d", code)
+	}
+	if stdout.String() != "h" {
+		t.Errorf("expected output %q got %q", "h", stdout.String())
+	}
+
+	code, err = run([]string{"riscv", filepath.Join(t.TempDir(), "missing")},
+		strings.NewReader(""), &stdout, &stderr)
+	if err == nil || code != 1 {
+		t.Errorf("expected an error for a missing image got %d, %v", code, err)
+	}
+}
+
+func TestRunDisasm(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 1
+	mv a1, a0
+	sw a1, 4(sp)
+	ret
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	path := filepath.Join(t.TempDir(), "prog.bin")
+	if err := ioutil.WriteFile(path, assemble(t, prog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := run([]string{"riscv", "disasm", path}, strings.NewReader(""),
+		&stdout, &stderr)
+	if err != nil || code != 0 {
+		t.Fatalf("expected success got %d, %v: %s", code, err, stderr.String())
+	}
+	expected := "" +
+		"00000100: 00100513  addi a0, zero, 1\n" +
+		"00000104: 00050593  mv a1, a0\n" +
+		"00000108: 00b12223  sw a1, 4(sp)\n" +
+		"0000010c: 00008067  ret\n"
+	if stdout.String() != expected {
+		t.Errorf("expected disassembly:\n%s\ngot:\n%s", expected, stdout.String())
+	}
+}
+
+func TestRunRv64UnsupportedFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.bin")
+	if err := ioutil.WriteFile(path, []uint8{0x13, 0, 0, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := run([]string{"riscv", "-rv64", "-sbi", "-max-output", "10", path},
+		strings.NewReader(""), &stdout, &stderr)
+	if err == nil || code != 1 {
+		t.Fatalf("expected an error for unsupported flags got %d, %v", code, err)
+	}
+	if expected := "-max-output, -sbi not supported on RV64"; err.Error() != expected {
+		t.Errorf("expected %q got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MonitorCommand runs a debugger monitor command and returns its output,
+// supported commands are:
+//
+//	csr <name> - print the value of a csr
+//	csr <name> <value> - set the value of a csr
+func (cpu *Cpu) MonitorCommand(cmd string) (string, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty monitor command")
+	}
+
+	switch args[0] {
+	case "csr":
+		return cpu.monitorCsr(args[1:])
+	}
+
+	return "", fmt.Errorf("unknown monitor command %q", args[0])
+}
+
+func (cpu *Cpu) monitorCsr(args []string) (string, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return "", fmt.Errorf("usage: csr <name> [value]")
+	}
+
+	csr, ok := CsrByName(args[0])
+	if !ok {
+		n, err := strconv.ParseUint(args[0], 0, 12)
+		if err != nil {
+			return "", fmt.Errorf("unknown csr %q", args[0])
+		}
+		csr = uint32(n)
+	}
+	if !cpu.IsValidCsr(csr) {
+		return "", fmt.Errorf("invalid csr %s", CsrName(csr))
+	}
+
+	if len(args) == 2 {
+		v, err := strconv.ParseUint(args[1], 0, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid value %q", args[1])
+		}
+		if !cpu.SetCsr(csr, uint32(v)) {
+			return "", fmt.Errorf("%s is read-only", CsrName(csr))
+		}
+	}
+
+	v, _ := cpu.GetCsr(csr)
+	return fmt.Sprintf("%s = 0x%08x\n", CsrName(csr), v), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMonitorCsr(t *testing.T) {
+	cpu := NewDebugBoard([]uint8{0x13, 0x00, 0x00, 0x00}).Cpu()
+	_, err := cpu.MonitorCommand("csr mscratch 0x1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := cpu.GetCsr(CsrScratch | CsrM); v != 0x1234 {
+		t.Errorf("expected mscratch to be 0x1234 got 0x%08x", v)
+	}
+	cpu.SetCsr(CsrTvec|CsrM, 0x100)
+	output, err := cpu.MonitorCommand("csr mtvec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "mtvec = 0x00000100\n"; output != expected {
+		t.Errorf("expected %q got %q", expected, output)
+	}
+	if _, err := cpu.MonitorCommand("csr nosuchcsr"); err == nil {
+		t.Errorf("expected an error for an unknown csr")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+// satp fields
+const (
+	SatpModeSv32 = 1 << 31
+	SatpPpn      = 0x3fffff
+)
+
+// Sv32 page table entry fields
+const (
+	PteV = 1 << 0
+	PteR = 1 << 1
+	PteW = 1 << 2
+	PteX = 1 << 3
+	PteU = 1 << 4
+	PteG = 1 << 5
+	PteA = 1 << 6
+	PteD = 1 << 7
+)
+
+const _PageSize = 4096
+
+type accessKind int
+
+const (
+	accessFetch accessKind = iota
+	accessLoad
+	accessStore
+	// a debugger access, any mapped page may be read and written
+	accessDebug
+)
+
+var _AccessFaults = [...]uint32{
+	accessFetch: ExceptionInstructionAccessFault,
+	accessLoad:  ExceptionLoadAccessFault,
+	accessStore: ExceptionStoreAccessFault,
+}
+
+var _PageFaults = [...]uint32{
+	accessFetch: ExceptionInstructionPageFault,
+	accessLoad:  ExceptionLoadPageFault,
+	accessStore: ExceptionStorePageFault,
+}
+
+// paging tells if addresses are translated, machine mode always uses
+// physical addresses
+func (cpu *Cpu) paging() bool {
+	return cpu.priv < PrivMachine && cpu.satp&SatpModeSv32 != 0
+}
+
+// translate maps the virtual address addr to a physical one for an access
+// of the given kind. When it fails pageFault is set, or walkFault if the
+// page table itself couldn't be read.
+func (cpu *Cpu) translate(addr uint32, kind accessKind) (uint32, bool) {
+	cpu.pageFault = false
+	cpu.walkFault = false
+	if !cpu.paging() {
+		return addr, true
+	}
+	paddr, ok := cpu.walk(addr, kind)
+	if !ok && !cpu.walkFault {
+		cpu.pageFault = true
+	}
+	return paddr, ok
+}
+
+// walk walks the two level Sv32 page table. The accessed and dirty bits
+// are never updated, a page that doesn't have them set faults and it is up
+// to the guest to set them.
+func (cpu *Cpu) walk(addr uint32, kind accessKind) (uint32, bool) {
+	return cpu.walkWith(addr, kind, cpu.loadPte)
+}
+
+// loadPte reads a page table entry for the walk, a faulting read sets
+// walkFault
+func (cpu *Cpu) loadPte(addr uint32) (uint32, bool) {
+	pte := cpu.memory.LoadWord(addr)
+	if cpu.faulter != nil && cpu.faulter.TakeFault() {
+		cpu.walkFault = true
+		return 0, false
+	}
+	return pte, true
+}
+
+// peekPte reads a page table entry through the peeker, without side
+// effects
+func (cpu *Cpu) peekPte(addr uint32) (uint32, bool) {
+	var pte uint32
+	for i := uint32(0); i < 4; i++ {
+		b, ok := cpu.peeker.PeekByte(addr + i)
+		if !ok {
+			return 0, false
+		}
+		pte |= uint32(b) << (8 * i)
+	}
+	return pte, true
+}
+
+// walkWith is walk reading the page table entries with load
+func (cpu *Cpu) walkWith(addr uint32, kind accessKind,
+	load func(uint32) (uint32, bool)) (uint32, bool) {
+	table := (cpu.satp & SatpPpn) * _PageSize
+	vpn := [2]uint32{(addr >> 12) & 0x3ff, addr >> 22}
+	for level := 1; level >= 0; level-- {
+		pte, ok := load(table + vpn[level]*4)
+		if !ok {
+			return 0, false
+		}
+		if pte&PteV == 0 || pte&(PteR|PteW) == PteW {
+			return 0, false
+		}
+		ppn := pte >> 10
+		if pte&(PteR|PteX) == 0 {
+			// a pointer to the next level
+			table = ppn * _PageSize
+			continue
+		}
+		if !cpu.pagePermits(pte, kind) {
+			return 0, false
+		}
+		if level == 1 {
+			// a misaligned megapage
+			if ppn&0x3ff != 0 {
+				return 0, false
+			}
+			return ppn<<12 | addr&0x3fffff, true
+		}
+		return ppn<<12 | addr&0xfff, true
+	}
+	// the last level held a pointer
+	return 0, false
+}
+
+// pagePermits checks the permissions of a leaf pte for an access of the
+// given kind from the current privilege
+func (cpu *Cpu) pagePermits(pte uint32, kind accessKind) bool {
+	if kind == accessDebug {
+		return true
+	}
+	if cpu.priv == PrivUser && pte&PteU == 0 {
+		return false
+	}
+	if cpu.priv == PrivSupervisor && pte&PteU != 0 &&
+		(kind == accessFetch || cpu.mstatus&MstatusSUM == 0) {
+		return false
+	}
+	if pte&PteA == 0 {
+		return false
+	}
+	switch kind {
+	case accessFetch:
+		return pte&PteX != 0
+	case accessLoad:
+		return pte&PteR != 0 || cpu.mstatus&MstatusMXR != 0 && pte&PteX != 0
+	default:
+		return pte&PteW != 0 && pte&PteD != 0
+	}
+}
+
+// peekTranslate is translate for debugger accesses, the page table is
+// read through the peeker and the fault state is left alone
+func (cpu *Cpu) peekTranslate(addr uint32) (uint32, bool) {
+	if !cpu.paging() {
+		return addr, true
+	}
+	return cpu.walkWith(addr, accessDebug, cpu.peekPte)
+}
+
+// accessException returns the exception raised by the last access, which
+// was of the given kind, if any
+func (cpu *Cpu) accessException(kind accessKind) (uint32, bool) {
+	page := cpu.pageFault
+	if !cpu.memoryFault() {
+		return 0, false
+	}
+	if page {
+		return _PageFaults[kind], true
+	}
+	return _AccessFaults[kind], true
+}
+
+// loadTranslatedInstruction is loadInstruction through the page table,
+// the halves of an instruction may be on different pages
+func (cpu *Cpu) loadTranslatedInstruction(addr uint32) (uint32, bool) {
+	low, ok := cpu.fetchParcel(addr)
+	if !ok || low&0x3 != 0x3 {
+		return low, ok
+	}
+	high, ok := cpu.fetchParcel(addr + 2)
+	return low | high<<16, ok
+}
+
+func (cpu *Cpu) fetchParcel(addr uint32) (uint32, bool) {
+	paddr, ok := cpu.translate(addr, accessFetch)
+	if !ok {
+		return 0, false
+	}
+	var parcel uint32
+	if f, ok := cpu.fetcher.(ParcelFetcher); ok {
+		parcel = uint32(f.FetchHalfWord(paddr))
+	} else if cpu.fetcher != nil {
+		parcel = cpu.fetcher.FetchWord(paddr) & 0xffff
+	} else {
+		parcel = uint32(cpu.memory.LoadHalfWord(paddr))
+	}
+	return parcel, !cpu.memoryFault()
+}
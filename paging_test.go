@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+// _PagingProg maps the first 4MiB as they are so the code keeps running,
+// 0x40000000 to a data page and 0x40001000 to the same page read-only. It
+// then drops to supervisor mode, reads and writes through them and runs
+// the fault instruction. The tables are aligned in the space at its end.
+const _PagingProg = `
+	la t0, trap
+	csrrw x0, mtvec, t0
+	la s5, tables
+	li t0, 4095
+	add s5, s5, t0
+	srli s5, s5, 12
+	slli s5, s5, 12
+	li t0, 4096
+	add s6, s5, t0
+	add s7, s6, t0
+	li t1, {{.code}}
+	sw t1, 0(s5)
+	srli t1, s6, 12
+	slli t1, t1, 10
+	ori t1, t1, {{.valid}}
+	sw t1, 0x400(s5)
+	srli t1, s7, 12
+	slli t1, t1, 10
+	ori t2, t1, {{.rw}}
+	sw t2, 0(s6)
+	ori t2, t1, {{.ro}}
+	sw t2, 4(s6)
+	srli t1, s5, 12
+	li t2, {{.sv32}}
+	or t1, t1, t2
+	csrrw x0, satp, t1
+	li t1, {{.mpp}}
+	csrrw x0, mstatus, t1
+	la t1, supervisor
+	csrrw x0, mepc, t1
+	mret
+	supervisor:
+	li a0, 0x40000000
+	li a1, 42
+	sw a1, 8(a0)
+	lw s1, 8(a0)
+	li a0, 0x40001000
+	lw s2, 8(a0)
+	{{.fault}}
+	nop
+	trap:
+	csrrs s3, mcause, x0
+	csrrs s4, mtval, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	tables:
+	.space 16384
+`
+
+func TestSv32(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault string
+		cause uint32
+		tval  uint32
+	}{
+		{"store to read-only", "sw a1, 0(a0)", ExceptionStorePageFault, 0x40001000},
+		{"fetch from data", "jr a0", ExceptionInstructionPageFault, 0x40001000},
+		{"load unmapped", "li a0, 0x80000000\n\tlw a2, 0(a0)", ExceptionLoadPageFault, 0x80000000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prog := NewProgTemplate(_PagingProg).Execute(ProgArgs{
+				"code":  PteR | PteX | PteA | PteV,
+				"valid": PteV,
+				"rw":    PteR | PteW | PteA | PteD | PteV,
+				"ro":    PteR | PteA | PteV,
+				"sv32":  SatpModeSv32,
+				"mpp":   PrivSupervisor << MstatusMPPShift,
+				"fault": test.fault,
+			})
+			t.Log("prog: ", prog)
+			cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+			for i := 0; i < 100 && !cpu.halt; i++ {
+				cpu.Step()
+			}
+			if !cpu.halt {
+				t.Fatal("expected the trap handler to halt")
+			}
+			// both mappings reach the data page
+			assertRegEq(t, cpu, RegS1, 42)
+			assertRegEq(t, cpu, RegS2, 42)
+			if v := cpu.LoadWord(cpu.GetReg(RegS7) + 8); v != 42 {
+				t.Errorf("expected 42 at the physical address got %d", v)
+			}
+			assertRegEq(t, cpu, RegS3, test.cause)
+			assertRegEq(t, cpu, RegS4, test.tval)
+		})
+	}
+}
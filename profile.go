@@ -0,0 +1,90 @@
+package main
+
+// JumpKind tells how a jump affects the call stack
+type JumpKind int
+
+const (
+	// a jump within a function or a tail call, the stack is unchanged
+	JumpPlain JumpKind = iota
+	JumpCall
+	JumpReturn
+)
+
+// isLinkReg tells if reg is one of the link registers the calling
+// convention hints at, ra or the alternate link register t0
+func isLinkReg(reg uint8) bool {
+	return reg == RegRA || reg == RegT0
+}
+
+// classifyJump classifies a JAL or JALR following the return address
+// stack hints of the spec. A jump that links is a call, a JALR through a
+// link register that doesn't link is a return and anything else, like
+// the jal x0 and jalr x0 of a tail call, is a plain jump.
+func classifyJump(inst uint32) JumpKind {
+	_, rd, _, rs1, _ := itype(inst)
+	if isLinkReg(rd) {
+		return JumpCall
+	}
+	if inst&0x7f == OP_JALR && rd == RegZero && isLinkReg(rs1) {
+		return JumpReturn
+	}
+	return JumpPlain
+}
+
+// CallEdge is a call from the function at Caller to the one at Callee,
+// functions are identified by their entry address
+type CallEdge struct {
+	Caller uint32
+	Callee uint32
+}
+
+type callFrame struct {
+	entry   uint32
+	return_ uint32
+}
+
+// Profiler follows the guest's calls and returns to build its call graph
+type Profiler struct {
+	stack []callFrame
+	// the deepest the stack got
+	MaxDepth int
+	Calls    map[CallEdge]uint64
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{Calls: map[CallEdge]uint64{}}
+}
+
+// Depth is the number of calls that didn't return yet
+func (p *Profiler) Depth() int {
+	return len(p.stack)
+}
+
+func (p *Profiler) jump(inst, target, link uint32) {
+	switch classifyJump(inst) {
+	case JumpCall:
+		var caller uint32
+		if len(p.stack) > 0 {
+			caller = p.stack[len(p.stack)-1].entry
+		}
+		p.Calls[CallEdge{caller, target}]++
+		p.stack = append(p.stack, callFrame{target, link})
+		if len(p.stack) > p.MaxDepth {
+			p.MaxDepth = len(p.stack)
+		}
+	case JumpReturn:
+		// unwind to the frame returned to, frames skipped by a longjmp
+		// are dropped with it
+		for i := len(p.stack) - 1; i >= 0; i-- {
+			if p.stack[i].return_ == target {
+				p.stack = p.stack[:i]
+				return
+			}
+		}
+	}
+}
+
+// SetProfiler makes the cpu report its jumps to p, nil stops profiling
+func (cpu *Cpu) SetProfiler(p *Profiler) {
+	cpu.profiler = p
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func runProfiled(t *testing.T, prog string) *Profiler {
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	p := NewProfiler()
+	cpu.SetProfiler(p)
+	cpu.Execute()
+	return p
+}
+
+func TestProfilerTailCall(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 100
+	call count
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	count:
+	beqz a0, done
+	addi a0, a0, -1
+	tail count
+	done:
+	ret
+	`).Execute(nil)
+	p := runProfiled(t, prog)
+	if p.MaxDepth != 1 {
+		t.Errorf("max depth: expected 1, got %d", p.MaxDepth)
+	}
+	if p.Depth() != 0 {
+		t.Errorf("depth: expected 0, got %d", p.Depth())
+	}
+	if len(p.Calls) != 1 {
+		t.Errorf("expected a single call edge, got %v", p.Calls)
+	}
+}
+
+func TestProfilerRecursion(t *testing.T) {
+	prog := NewProgTemplate(`
+	la sp, stack
+	li a0, 5
+	call count
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	count:
+	beqz a0, done
+	addi sp, sp, -16
+	sw ra, 0(sp)
+	addi a0, a0, -1
+	call count
+	lw ra, 0(sp)
+	addi sp, sp, 16
+	done:
+	ret
+	.space 128
+	stack:
+	`).Execute(nil)
+	p := runProfiled(t, prog)
+	if p.MaxDepth != 6 {
+		t.Errorf("max depth: expected 6, got %d", p.MaxDepth)
+	}
+	if p.Depth() != 0 {
+		t.Errorf("depth: expected 0, got %d", p.Depth())
+	}
+}
+
+func TestClassifyJump(t *testing.T) {
+	tests := []struct {
+		inst string
+		kind JumpKind
+	}{
+		{"1: jal ra, 1b", JumpCall},
+		{"1: jal x0, 1b", JumpPlain},
+		{"jalr ra, 0(a0)", JumpCall},
+		{"jalr x0, 0(ra)", JumpReturn},
+		{"jalr x0, 0(t0)", JumpReturn},
+		{"jalr x0, 0(a0)", JumpPlain},
+	}
+	for _, test := range tests {
+		t.Run(test.inst, func(t *testing.T) {
+			code := assemble(t, test.inst)
+			inst := binary.LittleEndian.Uint32(code)
+			if kind := classifyJump(inst); kind != test.kind {
+				t.Errorf("expected %v, got %v", test.kind, kind)
+			}
+		})
+	}
+}
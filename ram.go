@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const LazyRamPageSize = 4096
+
+// LazyRam is a Ram that only allocates its pages on the first write,
+// this makes creating large memories cheap when most of it is never used.
+// Pages that were never written read as zero.
+type LazyRam struct {
+	size  uint32
+	pages [][]uint8
+}
+
+func NewLazyRam(size uint32) *LazyRam {
+	npages := (uint64(size) + LazyRamPageSize - 1) / LazyRamPageSize
+	return &LazyRam{
+		size:  size,
+		pages: make([][]uint8, npages),
+	}
+}
+
+func (mem *LazyRam) page(addr uint32, alloc bool) ([]uint8, uint32) {
+	if addr >= mem.size {
+		panic("address out of range")
+	}
+	idx := addr / LazyRamPageSize
+	page := mem.pages[idx]
+	if page == nil && alloc {
+		page = make([]uint8, LazyRamPageSize)
+		mem.pages[idx] = page
+	}
+	return page, addr % LazyRamPageSize
+}
+
+// AllocatedPages returns how many pages were allocated so far
+func (mem *LazyRam) AllocatedPages() int {
+	n := 0
+	for _, page := range mem.pages {
+		if page != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (mem *LazyRam) allocated() []uint32 {
+	var idxs []uint32
+	for idx, page := range mem.pages {
+		if page != nil {
+			idxs = append(idxs, uint32(idx))
+		}
+	}
+	return idxs
+}
+
+func (mem *LazyRam) LoadWord(addr uint32) uint32 {
+	return pagedLoadWord(mem, addr)
+}
+
+func (mem *LazyRam) LoadHalfWord(addr uint32) uint16 {
+	return pagedLoadHalfWord(mem, addr)
+}
+
+func (mem *LazyRam) LoadByte(addr uint32) uint8 {
+	return pagedLoadByte(mem, addr)
+}
+
+func (mem *LazyRam) StoreWord(addr uint32, v uint32) {
+	pagedStoreWord(mem, addr, v)
+}
+
+func (mem *LazyRam) StoreHalfWord(addr uint32, v uint16) {
+	pagedStoreHalfWord(mem, addr, v)
+}
+
+func (mem *LazyRam) StoreByte(addr uint32, v uint8) {
+	pagedStoreByte(mem, addr, v)
+}
+
+// SparseRam is like LazyRam but only keeps track of the pages it
+// allocated, so it can span the whole address space while costing nothing
+// for the parts that are never written
+type SparseRam struct {
+	size  uint32
+	pages map[uint32][]uint8
+}
+
+func NewSparseRam(size uint32) *SparseRam {
+	return &SparseRam{
+		size:  size,
+		pages: make(map[uint32][]uint8),
+	}
+}
+
+func (mem *SparseRam) page(addr uint32, alloc bool) ([]uint8, uint32) {
+	if addr >= mem.size {
+		panic("address out of range")
+	}
+	idx := addr / LazyRamPageSize
+	page := mem.pages[idx]
+	if page == nil && alloc {
+		page = make([]uint8, LazyRamPageSize)
+		mem.pages[idx] = page
+	}
+	return page, addr % LazyRamPageSize
+}
+
+// AllocatedPages returns how many pages were allocated so far
+func (mem *SparseRam) AllocatedPages() int {
+	return len(mem.pages)
+}
+
+func (mem *SparseRam) allocated() []uint32 {
+	idxs := make([]uint32, 0, len(mem.pages))
+	for idx := range mem.pages {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+	return idxs
+}
+
+func (mem *SparseRam) LoadWord(addr uint32) uint32 {
+	return pagedLoadWord(mem, addr)
+}
+
+func (mem *SparseRam) LoadHalfWord(addr uint32) uint16 {
+	return pagedLoadHalfWord(mem, addr)
+}
+
+func (mem *SparseRam) LoadByte(addr uint32) uint8 {
+	return pagedLoadByte(mem, addr)
+}
+
+func (mem *SparseRam) StoreWord(addr uint32, v uint32) {
+	pagedStoreWord(mem, addr, v)
+}
+
+func (mem *SparseRam) StoreHalfWord(addr uint32, v uint16) {
+	pagedStoreHalfWord(mem, addr, v)
+}
+
+func (mem *SparseRam) StoreByte(addr uint32, v uint8) {
+	pagedStoreByte(mem, addr, v)
+}
+
+// pagedMemory is a memory split into pages of LazyRamPageSize bytes that
+// are allocated on the first write
+type pagedMemory interface {
+	// page returns the page addr is in and addr's offset in it, if alloc
+	// is false and the page was never written the returned page is nil
+	page(addr uint32, alloc bool) ([]uint8, uint32)
+	// allocated returns the indexes of the allocated pages in order
+	allocated() []uint32
+}
+
+func pagedLoadWord(mem pagedMemory, addr uint32) uint32 {
+	page, offt := mem.page(addr, false)
+	if offt > LazyRamPageSize-4 {
+		// the access straddles two pages
+		return uint32(pagedLoadHalfWord(mem, addr)) |
+			uint32(pagedLoadHalfWord(mem, addr+2))<<16
+	}
+	if page == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(page[offt : offt+4])
+}
+
+func pagedLoadHalfWord(mem pagedMemory, addr uint32) uint16 {
+	page, offt := mem.page(addr, false)
+	if offt > LazyRamPageSize-2 {
+		return uint16(pagedLoadByte(mem, addr)) | uint16(pagedLoadByte(mem, addr+1))<<8
+	}
+	if page == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(page[offt : offt+2])
+}
+
+func pagedLoadByte(mem pagedMemory, addr uint32) uint8 {
+	page, offt := mem.page(addr, false)
+	if page == nil {
+		return 0
+	}
+	return page[offt]
+}
+
+func pagedStoreWord(mem pagedMemory, addr uint32, v uint32) {
+	page, offt := mem.page(addr, true)
+	if offt > LazyRamPageSize-4 {
+		pagedStoreHalfWord(mem, addr, uint16(v))
+		pagedStoreHalfWord(mem, addr+2, uint16(v>>16))
+		return
+	}
+	binary.LittleEndian.PutUint32(page[offt:offt+4], v)
+}
+
+func pagedStoreHalfWord(mem pagedMemory, addr uint32, v uint16) {
+	page, offt := mem.page(addr, true)
+	if offt > LazyRamPageSize-2 {
+		pagedStoreByte(mem, addr, uint8(v))
+		pagedStoreByte(mem, addr+1, uint8(v>>8))
+		return
+	}
+	binary.LittleEndian.PutUint16(page[offt:offt+2], v)
+}
+
+func pagedStoreByte(mem pagedMemory, addr uint32, v uint8) {
+	page, offt := mem.page(addr, true)
+	page[offt] = v
+}
+
+// MemDiff is a range of bytes that differ between two memories
+type MemDiff struct {
+	Addr uint32
+	Size uint32
+}
+
+// DiffMemory returns the ranges of [addr, addr+size) where a and b differ,
+// adjacent differing bytes are merged into a single range
+func DiffMemory(a, b Memory, addr, size uint32) []MemDiff {
+	var diffs []MemDiff
+	diffBytes := func(from, to uint64) {
+		for at := from; at < to; at++ {
+			if a.LoadByte(uint32(at)) == b.LoadByte(uint32(at)) {
+				continue
+			}
+			if n := len(diffs); n > 0 &&
+				uint64(diffs[n-1].Addr)+uint64(diffs[n-1].Size) == at {
+				diffs[n-1].Size++
+			} else {
+				diffs = append(diffs, MemDiff{uint32(at), 1})
+			}
+		}
+	}
+
+	end := uint64(addr) + uint64(size)
+	at := uint64(addr)
+	for ; at < end && at%4 != 0; at++ {
+		diffBytes(at, at+1)
+	}
+	// compare whole words and only look at the bytes of those that differ
+	for ; at+4 <= end; at += 4 {
+		if a.LoadWord(uint32(at)) != b.LoadWord(uint32(at)) {
+			diffBytes(at, at+4)
+		}
+	}
+	diffBytes(at, end)
+	return diffs
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestLazyRamZero(t *testing.T) {
+	mem := NewLazyRam(256 << 20)
+	for i := 0; i < FUZZ_ITER; i++ {
+		addr := rand.Uint32() % (256<<20 - 4)
+		if v := mem.LoadWord(addr); v != 0 {
+			t.Errorf("expected 0 at 0x%08x got 0x%08x", addr, v)
+		}
+		if v := mem.LoadHalfWord(addr); v != 0 {
+			t.Errorf("expected 0 at 0x%08x got 0x%04x", addr, v)
+		}
+		if v := mem.LoadByte(addr); v != 0 {
+			t.Errorf("expected 0 at 0x%08x got 0x%02x", addr, v)
+		}
+	}
+	if n := mem.AllocatedPages(); n != 0 {
+		t.Errorf("reads allocated %d pages", n)
+	}
+}
+
+func TestLazyRam(t *testing.T) {
+	mem := NewLazyRam(16 * LazyRamPageSize)
+	tests := []struct {
+		addr uint32
+		v    uint32
+	}{
+		{0, 0x12345678},
+		{LazyRamPageSize*3 + 8, 0xdeadbeef},
+		// straddles pages 5 and 6
+		{LazyRamPageSize*6 - 2, 0xcafebabe},
+	}
+	for _, test := range tests {
+		mem.StoreWord(test.addr, test.v)
+	}
+	for _, test := range tests {
+		if v := mem.LoadWord(test.addr); v != test.v {
+			t.Errorf("expected 0x%08x at 0x%08x got 0x%08x", test.v, test.addr, v)
+		}
+	}
+	if v := mem.LoadHalfWord(LazyRamPageSize*6 - 1); v != 0xfeba {
+		t.Errorf("expected 0xfeba got 0x%04x", v)
+	}
+	if v := mem.LoadByte(LazyRamPageSize*3 + 9); v != 0xbe {
+		t.Errorf("expected 0xbe got 0x%02x", v)
+	}
+	if n := mem.AllocatedPages(); n != 4 {
+		t.Errorf("expected 4 allocated pages got %d", n)
+	}
+}
+
+func TestSparseRam(t *testing.T) {
+	// all of the address space but the last byte
+	mem := NewSparseRam(0xffffffff)
+	mmu := NewMmu()
+	if err := mmu.AddRange(0, 0xffffffff, mem); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	mmu.StoreWord(0x100, 0x12345678)
+	mmu.StoreHalfWord(0xfffffff0, 0xbeef)
+	if v := mmu.LoadWord(0x100); v != 0x12345678 {
+		t.Errorf("expected 0x12345678 got 0x%08x", v)
+	}
+	if v := mmu.LoadByte(0x102); v != 0x34 {
+		t.Errorf("expected 0x34 got 0x%02x", v)
+	}
+	if v := mmu.LoadWord(0xfffffff0); v != 0xbeef {
+		t.Errorf("expected 0xbeef got 0x%08x", v)
+	}
+	if v := mmu.LoadWord(0x80000000); v != 0 {
+		t.Errorf("expected an unwritten page to read 0 got 0x%08x", v)
+	}
+	if n := mem.AllocatedPages(); n != 2 {
+		t.Errorf("expected 2 allocated pages got %d", n)
+	}
+
+	// straddles pages 1 and 2
+	mem.StoreWord(LazyRamPageSize*2-2, 0xcafebabe)
+	if v := mem.LoadWord(LazyRamPageSize*2 - 2); v != 0xcafebabe {
+		t.Errorf("expected 0xcafebabe got 0x%08x", v)
+	}
+	if n := mem.AllocatedPages(); n != 4 {
+		t.Errorf("expected 4 allocated pages got %d", n)
+	}
+}
+
+func benchmarkBoardRam(b *testing.B, newRam func(size uint32) Memory) {
+	prog := []uint8{0x13, 0x00, 0x00, 0x00} // nop
+	for i := 0; i < b.N; i++ {
+		mem := newRam(256 << 20)
+		for j, v := range prog {
+			mem.StoreByte(BoardInitialAddr+uint32(j), v)
+		}
+		mmu := NewMmu()
+		mmu.AddRange(0, 256<<20, mem)
+		New(mmu, BoardInitialAddr).Step()
+	}
+}
+
+func BenchmarkBoardFlatRam(b *testing.B) {
+	benchmarkBoardRam(b, func(size uint32) Memory { return NewRam(size) })
+}
+
+func BenchmarkBoardLazyRam(b *testing.B) {
+	benchmarkBoardRam(b, func(size uint32) Memory { return NewLazyRam(size) })
+}
+
+// findRangeLinear is how findRange used to scan the ranges
+func findRangeLinear(mmu *Mmu, addr uint32) (*Range, uint32) {
+	for _, r := range mmu.ranges {
+		if addr >= r.Addr && addr-r.Addr < r.Size {
+			return &r, addr - r.Addr
+		}
+	}
+	return nil, 0
+}
+
+// benchmarkFindRange looks up addresses spread over a dozen ranges, about
+// as many as a board with a few devices has
+func benchmarkFindRange(b *testing.B, find func(*Mmu, uint32) (*Range, uint32)) {
+	mmu := NewMmu()
+	var addrs [16]uint32
+	for i := range addrs {
+		if i < 12 {
+			mmu.AddRange(uint32(i)*0x10000, 0x1000, NewRam(0x1000))
+		}
+		addrs[i] = uint32(i%12)*0x10000 + 0x10
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r, _ := find(mmu, addrs[i%len(addrs)]); r == nil {
+			b.Fatalf("0x%08x isn't mapped", addrs[i%len(addrs)])
+		}
+	}
+}
+
+func BenchmarkFindRangeLinear(b *testing.B) {
+	benchmarkFindRange(b, findRangeLinear)
+}
+
+func BenchmarkFindRange(b *testing.B) {
+	benchmarkFindRange(b, (*Mmu).findRange)
+}
+
+func TestFindRange(t *testing.T) {
+	mmu := NewMmu()
+	// added out of order, with an empty range at the start of another
+	mmu.AddRange(0x3000, 0x100, NewRam(0x100))
+	mmu.AddRange(0x1000, 0x100, NewRam(0x100))
+	mmu.AddRange(0x2000, 0x100, NewRam(0x100))
+	mmu.AddRange(0x2000, 0, NewRam(0))
+	mmu.AddRange(0xffffff00, 0x100, NewRam(0x100))
+	for _, addr := range []uint32{0, 0xfff, 0x1000, 0x10ff, 0x1100, 0x2000,
+		0x2080, 0x3000, 0x30ff, 0x3100, 0xfffffeff, 0xffffff00, 0xffffffff} {
+		r, offset := mmu.findRange(addr)
+		expected, expectedOffset := findRangeLinear(mmu, addr)
+		if (r == nil) != (expected == nil) || offset != expectedOffset ||
+			r != nil && (r.Addr != expected.Addr || r.Size != expected.Size) {
+			t.Errorf("0x%08x: expected %+v, 0x%x got %+v, 0x%x",
+				addr, expected, expectedOffset, r, offset)
+		}
+	}
+}
+
+func TestFindRangeAliasing(t *testing.T) {
+	mmu := NewMmu()
+	mmu.AddRange(0x1000, 0x100, NewRam(0x100))
+	mmu.AddRange(0x2000, 0x100, NewRam(0x100))
+	r, _ := mmu.findRange(0x2010)
+	replacement := NewRam(0x100)
+	r.Memory = replacement
+	if again, _ := mmu.findRange(0x2020); again != r || again.Memory != replacement {
+		t.Errorf("the change to the range was lost")
+	}
+	mmu.StoreByte(0x2030, 0x5a)
+	if v := replacement.LoadByte(0x30); v != 0x5a {
+		t.Errorf("expected the store to reach the replacement got 0x%02x", v)
+	}
+}
+
+func TestDiffMemory(t *testing.T) {
+	prog := NewProgTemplate(`
+	la a0, value
+	li a1, 0xcafebabe
+	sw a1, 0(a0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	value:
+	.word 0x12345678
+	.word 0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	code := assemble(t, prog)
+	initial := newBoardMmu(append([]uint8(nil), code...))
+	board := NewDebugBoard(code)
+	cpu := board.Cpu()
+	cpu.Execute()
+
+	size := uint32(len(code))
+	diffs := DiffMemory(initial, board.board.mmu, BoardInitialAddr, size)
+	value := BoardInitialAddr + size - 8
+	expected := []MemDiff{{value, 4}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %v got %v", expected, diffs)
+	}
+
+	// a range that isn't word aligned only reports the bytes in it
+	diffs = DiffMemory(initial, board.board.mmu, value+1, 2)
+	expected = []MemDiff{{value + 1, 2}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %v got %v", expected, diffs)
+	}
+}
+
+func TestBigEndianRam(t *testing.T) {
+	prog := NewProgTemplate(`
+	la a0, value
+	lw a1, 0(a0)
+	lhu a2, 2(a0)
+	li a3, 0x0a0b0c0d
+	sw a3, 4(a0)
+	lbu a4, 4(a0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	value:
+	.byte 0x12, 0x34, 0x56, 0x78
+	.word 0
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	ram := NewRamFromBuffer(assemble(t, prog))
+	ram.SetBigEndian(true)
+	mmu := NewMmu()
+	mmu.AddRange(BoardInitialAddr, uint32(len(ram.memory)), ram)
+	cpu := New(mmu, BoardInitialAddr)
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	assertCsrEq(t, cpu, CsrHalt, 1)
+	assertRegEq(t, cpu, RegA1, 0x12345678)
+	assertRegEq(t, cpu, RegA2, 0x5678)
+	assertRegEq(t, cpu, RegA4, 0x0a)
+}
+
+func TestFetchPastOddEnd(t *testing.T) {
+	// a nop and a stray byte, too short for any instruction
+	cpu := NewDebugBoard([]uint8{0x13, 0, 0, 0, 0x01}).Cpu()
+	cpu.Step()
+	cpu.Step()
+	assertCsrEq(t, cpu, CsrCause|CsrM, ExceptionInstructionAccessFault)
+	assertCsrEq(t, cpu, CsrTval|CsrM, BoardInitialAddr+4)
+
+	ram := NewRamFromBuffer([]uint8{0x13, 0, 0, 0, 0x01})
+	if inst := ram.FetchWord(4); inst != 0 {
+		t.Errorf("expected 0 past the end got 0x%08x", inst)
+	}
+}
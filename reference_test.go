@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// reference emulator used for differential testing, it runs linux
+// user-mode binaries so the progs exit with the exit syscall
+const _QemuRiscv32 = "qemu-riscv32"
+
+// linux user-mode binaries can't be mapped at the bottom of memory
+const _ReferenceTextAddr = 0x10000
+
+// runReference runs prog under the reference emulator and returns its
+// exit code
+func runReference(t *testing.T, prog string) int {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "riscv_reference_test")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	elfPath := assembleElf(t, dir, prog, _ReferenceTextAddr)
+	err = exec.Command(_QemuRiscv32, elfPath).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal("reference run failed: ", err)
+	}
+	return 0
+}
+
+// runEmulated runs prog until it makes the exit ecall and returns the
+// exit code the same way the reference would see it
+func runEmulated(t *testing.T, prog string) int {
+	t.Helper()
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetHaltOnException(true)
+	for i := 0; i < 1000000 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	fault := cpu.LastFault()
+	if fault == nil || fault.Cause != ExceptionEcallM {
+		t.Fatalf("expected the prog to exit with an ecall got %v", fault)
+	}
+	return int(cpu.GetReg(RegA0) & 0xff)
+}
+
+func TestReference(t *testing.T) {
+	requireTool(t, _QemuRiscv32)
+	exit := `
+	# fold the registers we care about into the exit code
+	xor a0, a0, a1
+	xor a0, a0, a2
+	srli a1, a0, 8
+	xor a0, a0, a1
+	srli a1, a0, 16
+	xor a0, a0, a1
+	andi a0, a0, 0xff
+	li a7, 93
+	ecall
+	`
+	progs := []string{
+		// fibonacci
+		`
+		li a0, 0
+		li a1, 1
+		li t0, 40
+		loop:
+		add a2, a0, a1
+		mv a0, a1
+		mv a1, a2
+		addi t0, t0, -1
+		bnez t0, loop
+		`,
+		// shifts and compares
+		`
+		li a0, -1234567
+		srai a1, a0, 7
+		srli a2, a0, 3
+		slt t0, a0, a1
+		sltu t1, a0, a1
+		sll a1, a1, t0
+		sll a2, a2, t1
+		`,
+		// loads of all widths
+		`
+		la t0, data
+		lb a0, 1(t0)
+		lhu a1, 2(t0)
+		lw a2, 0(t0)
+		j done
+		data:
+		.word 0x12348678
+		done:
+		`,
+	}
+	for _, body := range progs {
+		prog := NewProgTemplate(body + exit).Execute(nil)
+		t.Log("prog: ", prog)
+		expected := runReference(t, prog)
+		got := runEmulated(t, prog)
+		if got != expected {
+			t.Errorf("expected exit code %d (reference) got %d", expected, got)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// Rom is memory the guest can only read, like firmware. The mmu faults
+// stores to it and those made directly to it are dropped.
+type Rom struct {
+	ram *Ram
+}
+
+// NewRom creates a rom holding contents, which it takes ownership of
+func NewRom(contents []uint8) *Rom {
+	return &Rom{ram: NewRamFromBuffer(contents)}
+}
+
+func (rom *Rom) FetchWord(addr uint32) uint32 {
+	return rom.ram.FetchWord(addr)
+}
+
+func (rom *Rom) LoadWord(addr uint32) uint32 {
+	return rom.ram.LoadWord(addr)
+}
+
+func (rom *Rom) LoadHalfWord(addr uint32) uint16 {
+	return rom.ram.LoadHalfWord(addr)
+}
+
+func (rom *Rom) LoadByte(addr uint32) uint8 {
+	return rom.ram.LoadByte(addr)
+}
+
+func (rom *Rom) StoreWord(addr uint32, v uint32)     {}
+func (rom *Rom) StoreHalfWord(addr uint32, v uint16) {}
+func (rom *Rom) StoreByte(addr uint32, v uint8)      {}
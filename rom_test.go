@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRom(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	li s0, {{.rom}}
+	lw a0, 0(s0)
+	lbu a1, 5(s0)
+	sw a0, 4(s0)
+	nop
+	handler:
+	csrrs a2, mcause, x0
+	csrrs a3, mtval, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(ProgArgs{"rom": 0x10000})
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog)).board
+	rom := NewRom([]uint8{0x78, 0x56, 0x34, 0x12, 0xaa, 0xbb, 0xcc, 0xdd})
+	if err := board.AddDevice(0x10000, 8, rom); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	cpu := board.Cpu()
+	cpu.Execute()
+	assertRegEq(t, cpu, RegA0, 0x12345678)
+	assertRegEq(t, cpu, RegA1, 0xbb)
+	assertRegEq(t, cpu, RegA2, ExceptionStoreAccessFault)
+	assertRegEq(t, cpu, RegA3, 0x10004)
+	if v := rom.LoadWord(4); v != 0xddccbbaa {
+		t.Errorf("the rom was written, it holds 0x%08x", v)
+	}
+}
+
+func TestRangePerm(t *testing.T) {
+	tests := []struct {
+		name   string
+		access string
+		perm   Perm
+		cause  uint32
+	}{
+		{"jump into data", "jr s0", PermR | PermW, ExceptionInstructionAccessFault},
+		{"load from write-only", "lw a0, 0(s0)", PermW | PermX, ExceptionLoadAccessFault},
+		{"store to read-only", "sw a0, 0(s0)", PermR | PermX, ExceptionStoreAccessFault},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prog := NewProgTemplate(`
+			la t0, handler
+			csrrw x0, mtvec, t0
+			li s0, {{.region}}
+			{{.access}}
+			nop
+			handler:
+			csrrs a2, mcause, x0
+			csrrs a3, mtval, x0
+			li t1, 1
+			csrrw x0, 0x3ff, t1
+			`).Execute(ProgArgs{"region": 0x10000, "access": test.access})
+			t.Log("prog: ", prog)
+			board := NewDebugBoard(assemble(t, prog)).board
+			// nops the guest could run if it was executable
+			data := NewRamFromBuffer([]uint8{0x13, 0, 0, 0, 0x13, 0, 0, 0})
+			if err := board.Mmu().AddRangePerm(0x10000, 8, data, test.perm); err != nil {
+				t.Fatal("unexpected error: ", err)
+			}
+			cpu := board.Cpu()
+			cpu.Execute()
+			assertRegEq(t, cpu, RegA2, test.cause)
+			assertRegEq(t, cpu, RegA3, 0x10000)
+		})
+	}
+}
@@ -1,6 +1,6 @@
 #include "common.h"
 
-static volatile char *IO_ADDR = (char*)0xfffffffe;
+static volatile char *IO_ADDR = (char*)EMU_SERIAL_ADDR;
 
 // We have this to avoid internally paying for the function
 // call
@@ -73,11 +73,11 @@ static char *ltohex(unsigned long v, char *s) {
 
 static const char *strtrap(word_t cause) {
 	switch (cause) {
-		case 11:
+		case EXC_ENVIRONMENT_CALL_FROM_M_MODE:
 			return "ecall";
-		case 3:
+		case EXC_BREAKPOINT:
 			return "ebreak";
-		case 2:
+		case EXC_ILLEGAL_INSTRUCTION:
 			return "illegal instruction";
 		default:
 			return "unknown trap";
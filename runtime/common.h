@@ -1,6 +1,8 @@
 #ifndef TT_LIBCOMMON_H
 #define TT_LIBCOMMON_H
 
+#include "emu.h"
+
 #define NULL ((void*)0)
 #define NGPR 31
 
@@ -0,0 +1,58 @@
+// Code generated by riscv -gen-header; DO NOT EDIT.
+#ifndef TT_EMU_H
+#define TT_EMU_H
+
+#define EMU_SERIAL_ADDR 0xfffffffe
+#define EMU_MSIP_ADDR 0x02000000
+#define EMU_MTIMECMP_ADDR 0x02004000
+#define EMU_MTIME_ADDR 0x0200bff8
+#define EMU_COUNTERS_ADDR 0x02010000
+
+#define CSR_HALT 0x3ff
+#define CSR_SSTATUS 0x100
+#define CSR_SIE 0x104
+#define CSR_STVEC 0x105
+#define CSR_SSCRATCH 0x140
+#define CSR_SEPC 0x141
+#define CSR_SCAUSE 0x142
+#define CSR_STVAL 0x143
+#define CSR_SIP 0x144
+#define CSR_SATP 0x180
+#define CSR_MSTATUS 0x300
+#define CSR_MISA 0x301
+#define CSR_MEDELEG 0x302
+#define CSR_MIDELEG 0x303
+#define CSR_MIE 0x304
+#define CSR_MTVEC 0x305
+#define CSR_MSCRATCH 0x340
+#define CSR_MEPC 0x341
+#define CSR_MCAUSE 0x342
+#define CSR_MTVAL 0x343
+#define CSR_MIP 0x344
+#define CSR_CYCLE 0xc00
+#define CSR_TIME 0xc01
+#define CSR_INSTRET 0xc02
+#define CSR_CYCLEH 0xc80
+#define CSR_TIMEH 0xc81
+#define CSR_INSTRETH 0xc82
+#define CSR_MVENDORID 0xf11
+#define CSR_MARCHID 0xf12
+#define CSR_MIMPID 0xf13
+#define CSR_MHARTID 0xf14
+
+#define EXC_INSTRUCTION_ADDRESS_MISALIGNED 0
+#define EXC_INSTRUCTION_ACCESS_FAULT 1
+#define EXC_ILLEGAL_INSTRUCTION 2
+#define EXC_BREAKPOINT 3
+#define EXC_LOAD_ADDRESS_MISALIGNED 4
+#define EXC_LOAD_ACCESS_FAULT 5
+#define EXC_STORE_ADDRESS_MISALIGNED 6
+#define EXC_STORE_ACCESS_FAULT 7
+#define EXC_ENVIRONMENT_CALL_FROM_U_MODE 8
+#define EXC_ENVIRONMENT_CALL_FROM_S_MODE 9
+#define EXC_ENVIRONMENT_CALL_FROM_M_MODE 11
+#define EXC_INSTRUCTION_PAGE_FAULT 12
+#define EXC_LOAD_PAGE_FAULT 13
+#define EXC_STORE_PAGE_FAULT 15
+
+#endif // TT_EMU_H
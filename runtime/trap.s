@@ -49,15 +49,15 @@ sw x30, 116(sp)
 sw x31, 120(sp)
 # now that we have all the register backed up we can use them
 # put sp in the register vector
-csrrw t0, mscratch, zero
+csrrs t0, mscratch, zero
 sw t0, 4(sp)
 # ip is also a register the trap handler might want to adjust
-csrrw t0, mepc, zero
+csrrs t0, mepc, zero
 sw t0, 124(sp)
 
 # call trap handler
-csrrw a0, mcause, zero
-csrrw a1, mtval, zero
+csrrs a0, mcause, zero
+csrrs a1, mtval, zero
 mv a2, sp # the registers
 la t0, trap_handler
 lw t0, (t0)
@@ -103,7 +103,7 @@ lw x29, 112(sp)
 lw x30, 116(sp)
 lw x31, 120(sp)
 # go back to the users sp
-csrrw sp, mscratch, zero
+csrrs sp, mscratch, zero
 # return back to user code
 mret
 
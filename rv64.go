@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	OP_IMM_32 = 0x1b
+	OP_32     = 0x3b
+)
+
+// Exception64 describes the exception that stopped a Cpu64
+type Exception64 struct {
+	Cause uint32
+	Tval  uint64
+	Epc   uint64
+}
+
+func (e *Exception64) Error() string {
+	return fmt.Sprintf("%s (tval: 0x%016x) at 0x%016x",
+		ExceptionName(e.Cause), e.Tval, e.Epc)
+}
+
+// Cpu64 is an RV64I hart. It only implements the unprivileged ISA, any
+// exception halts it. Memory is still addressed with 32 bits, addresses
+// are translated by requiring them to be the sign extension of their low
+// word so the top of the memory can be reached both ways.
+type Cpu64 struct {
+	initialAddr uint64
+	registers   RegisterFile[uint64]
+	pc          uint64
+	memory      Memory
+	faulter     AccessFaulter
+	fetcher     InstructionFetcher
+	halt        bool
+	haltValue   uint64
+	instret     uint64
+	exception   *Exception64
+}
+
+func NewCpu64(memory Memory, initialAddr uint64) *Cpu64 {
+	cpu := &Cpu64{}
+	cpu.initialAddr = initialAddr
+	cpu.memory = memory
+	cpu.faulter, _ = memory.(AccessFaulter)
+	cpu.fetcher, _ = memory.(InstructionFetcher)
+	cpu.Reset()
+	return cpu
+}
+
+func (cpu *Cpu64) Reset() {
+	cpu.registers = RegisterFile[uint64]{}
+	cpu.pc = cpu.initialAddr
+	cpu.halt = false
+	cpu.haltValue = 0
+	cpu.instret = 0
+	cpu.exception = nil
+}
+
+func (cpu *Cpu64) GetReg(idx uint8) uint64 {
+	return cpu.registers.Get(idx)
+}
+
+func (cpu *Cpu64) SetReg(idx uint8, v uint64) {
+	cpu.registers.Set(idx, v)
+}
+
+func (cpu *Cpu64) Pc() uint64 {
+	return cpu.pc
+}
+
+func (cpu *Cpu64) HaltValue() uint64 {
+	return cpu.haltValue
+}
+
+// Exception returns the exception that halted the cpu or nil
+func (cpu *Cpu64) Exception() *Exception64 {
+	return cpu.exception
+}
+
+func (cpu *Cpu64) Execute() {
+	for !cpu.halt {
+		cpu.Step()
+	}
+}
+
+func (cpu *Cpu64) Step() {
+	if cpu.halt {
+		return
+	}
+
+	// there are no compressed instructions
+	if cpu.pc%4 != 0 {
+		cpu.trap(ExceptionInstructionAddressMisaligned, cpu.pc)
+		return
+	}
+	addr, ok := translate64(cpu.pc)
+	if !ok {
+		cpu.trap(ExceptionInstructionAccessFault, cpu.pc)
+		return
+	}
+	var inst uint32
+	if cpu.fetcher != nil {
+		inst = cpu.fetcher.FetchWord(addr)
+	} else {
+		inst = cpu.memory.LoadWord(addr)
+	}
+	if cpu.memoryFault() {
+		cpu.trap(ExceptionInstructionAccessFault, cpu.pc)
+		return
+	}
+	cpu.decode(inst)
+}
+
+// memoryFault tells if the memory refused the last access
+func (cpu *Cpu64) memoryFault() bool {
+	return cpu.faulter != nil && cpu.faulter.TakeFault()
+}
+
+// translate64 maps a 64 bit address to the 32 bit physical address space
+func translate64(addr uint64) (uint32, bool) {
+	return uint32(addr), addr == sext32(uint32(addr))
+}
+
+// sext32 sign extends a 32 bit value to 64 bits as done by the W
+// instructions
+func sext32(v uint32) uint64 {
+	return uint64(int64(int32(v)))
+}
+
+func (cpu *Cpu64) trap(cause uint32, tval uint64) {
+	cpu.exception = &Exception64{cause, tval, cpu.pc}
+	cpu.halt = true
+}
+
+func (cpu *Cpu64) load(addr uint64, width uint8) (uint64, bool) {
+	paddr, ok := translate64(addr)
+	if !ok {
+		return 0, false
+	}
+	var v uint64
+	switch width {
+	case 0: // LB
+		v = signExtend(uint64(cpu.memory.LoadByte(paddr)), 7)
+	case 1: // LH
+		v = signExtend(uint64(cpu.memory.LoadHalfWord(paddr)), 15)
+	case 2: // LW
+		v = sext32(cpu.memory.LoadWord(paddr))
+	case 3: // LD
+		v = uint64(cpu.memory.LoadWord(paddr))
+		if cpu.memoryFault() {
+			return 0, false
+		}
+		v |= uint64(cpu.memory.LoadWord(paddr+4)) << 32
+	case 4: // LBU
+		v = uint64(cpu.memory.LoadByte(paddr))
+	case 5: // LHU
+		v = uint64(cpu.memory.LoadHalfWord(paddr))
+	case 6: // LWU
+		v = uint64(cpu.memory.LoadWord(paddr))
+	}
+
+	return v, !cpu.memoryFault()
+}
+
+func (cpu *Cpu64) store(addr uint64, width uint8, v uint64) bool {
+	paddr, ok := translate64(addr)
+	if !ok {
+		return false
+	}
+	switch width {
+	case 0: // SB
+		cpu.memory.StoreByte(paddr, uint8(v))
+	case 1: // SH
+		cpu.memory.StoreHalfWord(paddr, uint16(v))
+	case 2: // SW
+		cpu.memory.StoreWord(paddr, uint32(v))
+	case 3: // SD
+		cpu.memory.StoreWord(paddr, uint32(v))
+		if cpu.memoryFault() {
+			return false
+		}
+		cpu.memory.StoreWord(paddr+4, uint32(v>>32))
+	}
+
+	return !cpu.memoryFault()
+}
+
+func (cpu *Cpu64) decode(inst uint32) {
+	next := cpu.pc + 4
+	opcode := inst & 0x7f
+	switch opcode {
+	case OP_IMM:
+		_, rd, funct, rs1, imm32 := itype(inst)
+		rs1v := cpu.GetReg(rs1)
+		imm := sext32(imm32)
+		shamt := imm & 0x3f
+		var res uint64
+		switch funct {
+		case FUNCT_ADDI:
+			res = rs1v + imm
+		case FUNCT_SLTI:
+			if int64(rs1v) < int64(imm) {
+				res = 1
+			}
+		case FUNCT_SLTUI:
+			if rs1v < imm {
+				res = 1
+			}
+		case FUNCT_XORI:
+			res = rs1v ^ imm
+		case FUNCT_ANDI:
+			res = rs1v & imm
+		case FUNCT_ORI:
+			res = rs1v | imm
+		case FUNCT_SLLI:
+			// imm[11:6] is reserved
+			if imm&0xfc0 != 0 {
+				cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+				return
+			}
+			res = rs1v << shamt
+		case FUNCT_SRXI:
+			// imm[10] picks the arithmetic shift, the other bits
+			// of imm[11:6] are reserved
+			if imm&0xbc0 != 0 {
+				cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+				return
+			}
+			if imm&0x400 != 0 {
+				res = uint64(int64(rs1v) >> shamt)
+			} else {
+				res = rs1v >> shamt
+			}
+		}
+		cpu.SetReg(rd, res)
+	case OP_IMM_32:
+		_, rd, funct, rs1, imm := itype(inst)
+		rs1v := uint32(cpu.GetReg(rs1))
+		shamt := imm & 0x1f
+		var res uint32
+		switch funct {
+		case FUNCT_ADDI:
+			res = rs1v + imm
+		case FUNCT_SLLI:
+			// imm[11:5] is reserved
+			if imm&0xfe0 != 0 {
+				cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+				return
+			}
+			res = rs1v << shamt
+		case FUNCT_SRXI:
+			if imm&0xbe0 != 0 {
+				cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+				return
+			}
+			if imm&0x400 != 0 {
+				res = uint32(int32(rs1v) >> shamt)
+			} else {
+				res = rs1v >> shamt
+			}
+		default:
+			cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+			return
+		}
+		cpu.SetReg(rd, sext32(res))
+	case OP_LUI:
+		_, rd, imm := utype(inst)
+		cpu.SetReg(rd, sext32(imm<<12))
+	case OP_AUIPC:
+		_, rd, imm := utype(inst)
+		cpu.SetReg(rd, cpu.pc+sext32(imm<<12))
+	case OP:
+		_, rd, funct3, rs1, rs2, funct7 := rtype(inst)
+		rs1v := cpu.GetReg(rs1)
+		rs2v := cpu.GetReg(rs2)
+		shamt := rs2v & 0x3f
+		var res uint64
+		switch funct3 {
+		case FUNCT_ADD_SUB:
+			if funct7&0x20 == 0 {
+				res = rs1v + rs2v
+			} else {
+				res = rs1v - rs2v
+			}
+		case FUNCT_SLT:
+			if int64(rs1v) < int64(rs2v) {
+				res = 1
+			}
+		case FUNCT_SLTU:
+			if rs1v < rs2v {
+				res = 1
+			}
+		case FUNCT_AND:
+			res = rs1v & rs2v
+		case FUNCT_OR:
+			res = rs1v | rs2v
+		case FUNCT_XOR:
+			res = rs1v ^ rs2v
+		case FUNCT_SLL:
+			res = rs1v << shamt
+		case FUNCT_SRX:
+			if funct7&0x20 == 0 {
+				res = rs1v >> shamt
+			} else {
+				res = uint64(int64(rs1v) >> shamt)
+			}
+		}
+		cpu.SetReg(rd, res)
+	case OP_32:
+		_, rd, funct3, rs1, rs2, funct7 := rtype(inst)
+		rs1v := uint32(cpu.GetReg(rs1))
+		rs2v := uint32(cpu.GetReg(rs2))
+		shamt := rs2v & 0x1f
+		var res uint32
+		switch funct3 {
+		case FUNCT_ADD_SUB:
+			if funct7&0x20 == 0 {
+				res = rs1v + rs2v
+			} else {
+				res = rs1v - rs2v
+			}
+		case FUNCT_SLL:
+			res = rs1v << shamt
+		case FUNCT_SRX:
+			if funct7&0x20 == 0 {
+				res = rs1v >> shamt
+			} else {
+				res = uint32(int32(rs1v) >> shamt)
+			}
+		default:
+			cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+			return
+		}
+		cpu.SetReg(rd, sext32(res))
+	case OP_JAL:
+		_, rd, imm := jtype(inst)
+		cpu.SetReg(rd, next)
+		next = cpu.pc + sext32(imm)
+	case OP_JALR:
+		_, rd, _, rs1, imm := itype(inst)
+		target := (cpu.GetReg(rs1) + sext32(imm)) &^ 1
+		cpu.SetReg(rd, next)
+		next = target
+	case OP_BRANCH:
+		_, funct3, rs1, rs2, imm := btype(inst)
+		rs1v := cpu.GetReg(rs1)
+		rs2v := cpu.GetReg(rs2)
+		var shouldBranch bool
+		switch funct3 {
+		case FUNCT_BEQ:
+			shouldBranch = rs1v == rs2v
+		case FUNCT_BNE:
+			shouldBranch = rs1v != rs2v
+		case FUNCT_BLT:
+			shouldBranch = int64(rs1v) < int64(rs2v)
+		case FUNCT_BLTU:
+			shouldBranch = rs1v < rs2v
+		case FUNCT_BGE:
+			shouldBranch = int64(rs1v) >= int64(rs2v)
+		case FUNCT_BGEU:
+			shouldBranch = rs1v >= rs2v
+		default:
+			cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+			return
+		}
+		if shouldBranch {
+			next = cpu.pc + sext32(imm)
+		}
+	case OP_LOAD:
+		_, rd, width, rs1, imm := itype(inst)
+		addr := cpu.GetReg(rs1) + sext32(imm)
+		if width == 7 {
+			cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+			return
+		}
+		if addr%(1<<(width&3)) != 0 {
+			cpu.trap(ExceptionLoadAddressMisaligned, addr)
+			return
+		}
+		res, ok := cpu.load(addr, width)
+		if !ok {
+			cpu.trap(ExceptionLoadAccessFault, addr)
+			return
+		}
+		cpu.SetReg(rd, res)
+	case OP_STORE:
+		_, width, rs1, rs2, imm := stype(inst)
+		addr := cpu.GetReg(rs1) + sext32(imm)
+		if width > 3 {
+			cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+			return
+		}
+		if addr%(1<<width) != 0 {
+			cpu.trap(ExceptionStoreAddressMisaligned, addr)
+			return
+		}
+		if !cpu.store(addr, width, cpu.GetReg(rs2)) {
+			cpu.trap(ExceptionStoreAccessFault, addr)
+			return
+		}
+	case OP_FENCE:
+		// there is a single hart with no caches so there is nothing to
+		// order
+	case OP_SYSTEM:
+		_, _, funct3, rs1, imm := itype(inst)
+		switch {
+		case funct3 == FUNCT_CSRRW && imm&0xfff == CsrHalt:
+			cpu.haltValue = cpu.GetReg(rs1)
+			cpu.halt = true
+		case funct3 == FUNCT_PRIV && imm == PRIV_ECALL:
+			cpu.trap(ExceptionEcallM, 0)
+			return
+		case funct3 == FUNCT_PRIV && imm == PRIV_EBREAK:
+			cpu.trap(ExceptionBreakpoint, cpu.pc)
+			return
+		default:
+			cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+			return
+		}
+	default:
+		cpu.trap(ExceptionIllegalInstruction, uint64(inst))
+		return
+	}
+
+	cpu.pc = next
+	cpu.instret += 1
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func runCpu64(t *testing.T, prog string) *Cpu64 {
+	t.Helper()
+	prog += `
+	li t6, 1
+	csrrw x0, 0x3ff, t6
+	`
+	t.Log("prog: ", prog)
+	bin := assembleArch(t, prog, _Rv64)
+	mmu := NewMmu()
+	mmu.AddRange(BoardInitialAddr, uint32(len(bin)), NewRamFromBuffer(bin))
+	mmu.AddRange(0x1000, 0x100, NewRam(0x100))
+	cpu := NewCpu64(mmu, BoardInitialAddr)
+	cpu.Execute()
+	if e := cpu.Exception(); e != nil {
+		t.Fatalf("unexpected exception: %s", e)
+	}
+	return cpu
+}
+
+func TestRV64WInstructions(t *testing.T) {
+	tests := []struct {
+		op  string
+		ref func(a, b uint64) uint64
+	}{
+		{"addw", func(a, b uint64) uint64 { return sext32(uint32(a) + uint32(b)) }},
+		{"subw", func(a, b uint64) uint64 { return sext32(uint32(a) - uint32(b)) }},
+		{"sllw", func(a, b uint64) uint64 { return sext32(uint32(a) << (b & 0x1f)) }},
+		{"srlw", func(a, b uint64) uint64 { return sext32(uint32(a) >> (b & 0x1f)) }},
+		{"sraw", func(a, b uint64) uint64 { return sext32(uint32(int32(a) >> (b & 0x1f))) }},
+	}
+	for _, test := range tests {
+		for i := 0; i < FUZZ_ITER; i++ {
+			a, b := rand.Uint64(), rand.Uint64()
+			cpu := runCpu64(t, fmt.Sprintf(`
+			li a0, %d
+			li a1, %d
+			%s a2, a0, a1
+			`, int64(a), int64(b), test.op))
+			if expected := test.ref(a, b); cpu.GetReg(RegA2) != expected {
+				t.Errorf("%s 0x%016x, 0x%016x: expected 0x%016x got 0x%016x",
+					test.op, a, b, expected, cpu.GetReg(RegA2))
+			}
+		}
+	}
+}
+
+func TestRV64WImmInstructions(t *testing.T) {
+	for i := 0; i < FUZZ_ITER; i++ {
+		a := rand.Uint64()
+		imm := rand.Int63n(4096) - 2048
+		shamt := rand.Intn(32)
+		cpu := runCpu64(t, fmt.Sprintf(`
+		li a0, %d
+		addiw a1, a0, %d
+		slliw a2, a0, %d
+		srliw a3, a0, %d
+		sraiw a4, a0, %d
+		`, int64(a), imm, shamt, shamt, shamt))
+		expected := []uint64{
+			sext32(uint32(a) + uint32(imm)),
+			sext32(uint32(a) << uint(shamt)),
+			sext32(uint32(a) >> uint(shamt)),
+			sext32(uint32(int32(a) >> uint(shamt))),
+		}
+		for j, v := range expected {
+			reg := uint8(RegA1 + j)
+			if cpu.GetReg(reg) != v {
+				t.Errorf("x%d: expected 0x%016x got 0x%016x",
+					reg, v, cpu.GetReg(reg))
+			}
+		}
+	}
+}
+
+func TestRV64LoadStore(t *testing.T) {
+	cpu := runCpu64(t, `
+	li t0, 0x1000
+	li a0, 0x80000000ff
+	sd a0, 0(t0)
+	ld a1, 0(t0)
+	lw a2, 4(t0)
+	lwu a3, 0(t0)
+	lb a4, 0(t0)
+	li a5, 0x80000000
+	sw a5, 8(t0)
+	lw a6, 8(t0)
+	lwu a7, 8(t0)
+	`)
+	expected := map[uint8]uint64{
+		RegA1: 0x80000000ff,
+		RegA2: 0x80,
+		RegA3: 0xff,
+		RegA4: 0xffffffffffffffff,
+		RegA6: 0xffffffff80000000,
+		RegA7: 0x80000000,
+	}
+	for reg, v := range expected {
+		if cpu.GetReg(reg) != v {
+			t.Errorf("x%d: expected 0x%016x got 0x%016x", reg, v, cpu.GetReg(reg))
+		}
+	}
+}
+
+func TestRV64AddressTranslation(t *testing.T) {
+	prog := `
+	li t0, 0x100000000
+	lw a0, 0(t0)
+	`
+	bin := assembleArch(t, prog, _Rv64)
+	mmu := NewMmu()
+	mmu.AddRange(BoardInitialAddr, uint32(len(bin)), NewRamFromBuffer(bin))
+	cpu := NewCpu64(mmu, BoardInitialAddr)
+	cpu.Execute()
+	e := cpu.Exception()
+	if e == nil || e.Cause != ExceptionLoadAccessFault || e.Tval != 0x100000000 {
+		t.Errorf("expected a load access fault at 0x100000000 got %v", e)
+	}
+}
+
+func TestRV64Exceptions(t *testing.T) {
+	tests := []struct {
+		prog  string
+		cause uint32
+		tval  uint64
+	}{
+		// unmapped
+		{"li t0, 0x10\n\tld a0, 0(t0)", ExceptionLoadAccessFault, 0x10},
+		{"li t0, 0x10\n\tsd a0, 0(t0)", ExceptionStoreAccessFault, 0x10},
+		{"li t0, 0x1002\n\tlw a0, 0(t0)", ExceptionLoadAddressMisaligned, 0x1002},
+		{"li t0, 0x1004\n\tsd a0, 0(t0)", ExceptionStoreAddressMisaligned, 0x1004},
+		{"li t0, 0x1000\n\tjr t0", ExceptionInstructionAccessFault, 0x1000},
+		// slli with imm[11:6] set
+		{fmt.Sprintf(".word 0x%08x", encodeI(OP_IMM, 1, FUNCT_SLLI, 1, 0x41)),
+			ExceptionIllegalInstruction, uint64(encodeI(OP_IMM, 1, FUNCT_SLLI, 1, 0x41))},
+		// slliw with shamt[5] set
+		{fmt.Sprintf(".word 0x%08x", encodeI(OP_IMM_32, 1, FUNCT_SLLI, 1, 0x21)),
+			ExceptionIllegalInstruction, uint64(encodeI(OP_IMM_32, 1, FUNCT_SLLI, 1, 0x21))},
+	}
+	for _, test := range tests {
+		t.Log("prog: ", test.prog)
+		bin := assembleArch(t, test.prog, _Rv64)
+		mmu := NewMmu()
+		mmu.AddRange(BoardInitialAddr, uint32(len(bin)), NewRamFromBuffer(bin))
+		// data, fetching from it faults
+		mmu.AddRangePerm(0x1000, 0x100, NewRam(0x100), PermR|PermW)
+		cpu := NewCpu64(mmu, BoardInitialAddr)
+		cpu.Execute()
+		e := cpu.Exception()
+		if e == nil || e.Cause != test.cause || e.Tval != test.tval {
+			t.Errorf("expected exception %d at 0x%x got %v",
+				test.cause, test.tval, e)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+// Legacy SBI extensions
+const (
+	SbiSetTimer        = 0
+	SbiConsolePutchar  = 1
+	SbiConsoleGetchar  = 2
+	SbiShutdown        = 8
+	SbiErrNotSupported = -2
+)
+
+// SbiCall holds the arguments of an ecall made from supervisor mode
+type SbiCall struct {
+	Eid, Fid uint32
+	Args     [6]uint32
+}
+
+// SbiHandler emulates the machine mode firmware, the returned value is
+// placed in a0
+type SbiHandler interface {
+	HandleSbi(cpu *Cpu, call *SbiCall) uint32
+}
+
+// Console is the device behind the legacy console extensions
+type Console interface {
+	PutChar(c uint8)
+	// GetChar isn't ok when there is no input
+	GetChar() (uint8, bool)
+}
+
+// LegacySbi implements the legacy SBI extensions on top of a console
+type LegacySbi struct {
+	console Console
+	timer   uint64
+}
+
+func NewLegacySbi(console Console) *LegacySbi {
+	return &LegacySbi{console: console}
+}
+
+func (sbi *LegacySbi) Timer() uint64 {
+	return sbi.timer
+}
+
+func (sbi *LegacySbi) HandleSbi(cpu *Cpu, call *SbiCall) uint32 {
+	switch call.Eid {
+	case SbiSetTimer:
+		// setting a deadline clears the pending timer interrupt until
+		// the deadline is reached
+		sbi.timer = uint64(call.Args[1])<<32 | uint64(call.Args[0])
+		cpu.stimecmp = sbi.timer
+		cpu.softIp &^= MipSTIP
+		return 0
+	case SbiConsolePutchar:
+		sbi.console.PutChar(uint8(call.Args[0]))
+		return 0
+	case SbiConsoleGetchar:
+		c, ok := sbi.console.GetChar()
+		if !ok {
+			return 0xffffffff
+		}
+		return uint32(c)
+	case SbiShutdown:
+		cpu.guestHalt = true
+		cpu.Halt()
+		return 0
+	}
+
+	return uint32(SbiErrNotSupported & 0xffffffff)
+}
+
+func (cpu *Cpu) callSbi() {
+	// calls don't use all the argument registers so they are read
+	// directly to not count as reads by the guest
+	call := &SbiCall{
+		Eid: cpu.registers.Get(RegA7),
+		Fid: cpu.registers.Get(RegA6),
+	}
+	for i := range call.Args {
+		call.Args[i] = cpu.registers.Get(RegA0 + uint8(i))
+	}
+	cpu.SetReg(RegA0, cpu.sbi.HandleSbi(cpu, call))
+}
+
+// SetSbiHandler makes ecalls from supervisor mode go to h instead of
+// trapping, since h stands in for the firmware the cpu is reset into
+// supervisor mode while a handler is set
+func (cpu *Cpu) SetSbiHandler(h SbiHandler) {
+	cpu.sbi = h
+}
+
+// EcallRecord is an ecall and the values of its argument registers a0-a7
+type EcallRecord struct {
+	Pc   uint32
+	Args [8]uint32
+}
+
+// EcallRecorder logs every ecall made from supervisor mode before passing
+// it on to Handler, so tests can check exactly which calls a guest made.
+// Without a Handler the calls fail as not supported.
+type EcallRecorder struct {
+	Handler SbiHandler
+	calls   []EcallRecord
+}
+
+func (r *EcallRecorder) HandleSbi(cpu *Cpu, call *SbiCall) uint32 {
+	record := EcallRecord{Pc: cpu.instPc}
+	copy(record.Args[:], call.Args[:])
+	record.Args[6] = call.Fid
+	record.Args[7] = call.Eid
+	r.calls = append(r.calls, record)
+
+	if r.Handler == nil {
+		return uint32(SbiErrNotSupported & 0xffffffff)
+	}
+	return r.Handler.HandleSbi(cpu, call)
+}
+
+// Calls returns the recorded ecalls in the order they were made
+func (r *EcallRecorder) Calls() []EcallRecord {
+	return r.calls
+}
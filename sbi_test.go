@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSbiConsolePutchar(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a7, 1
+	li a0, 'h'
+	ecall
+	li a0, 'i'
+	ecall
+	li a7, 0x10
+	ecall
+	mv s0, a0
+	li a7, 8
+	ecall
+	li a0, 'x'
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.board.EnableSbi()
+	cpu := board.Cpu()
+	if cpu.priv != PrivSupervisor {
+		t.Fatalf("expected to boot in supervisor mode got %d", cpu.priv)
+	}
+	cpu.Execute()
+	board.board.Flush()
+	if output := board.output.String(); output != "hi" {
+		t.Errorf("expected output %q got %q", "hi", output)
+	}
+	if s0 := cpu.GetReg(RegS0); int32(s0) != SbiErrNotSupported {
+		t.Errorf("expected unsupported extension to return %d got %d",
+			SbiErrNotSupported, int32(s0))
+	}
+	if pc := cpu.pc; pc != cpu.initialAddr+10*4 {
+		t.Errorf("expected shutdown to halt at 0x%08x got 0x%08x",
+			cpu.initialAddr+10*4, pc)
+	}
+}
+
+func TestSbiSetTimer(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, stvec, t0
+	li t0, {{.stie}}
+	csrrs x0, sie, t0
+	li t0, {{.sie}}
+	csrrs x0, sstatus, t0
+	li a0, 50
+	li a1, 0
+	li a7, {{.settimer}}
+	ecall
+	loop:
+	j loop
+	handler:
+	csrrs s0, scause, x0
+	csrrs s1, sip, x0
+	li a0, -1
+	li a1, -1
+	li a7, {{.settimer}}
+	ecall
+	csrrs s2, sip, x0
+	li a7, {{.shutdown}}
+	ecall
+	`).Execute(ProgArgs{
+		"stie":     MieSTIE,
+		"sie":      MstatusSIE,
+		"settimer": SbiSetTimer,
+		"shutdown": SbiShutdown,
+	})
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.board.EnableSbi()
+	cpu := board.Cpu()
+	for i := 0; i < 200 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	if !cpu.halt {
+		t.Fatal("expected the timer interrupt to be taken")
+	}
+	if cpu.ticks < 50 {
+		t.Errorf("the interrupt was taken at time %d before the deadline",
+			cpu.ticks)
+	}
+	assertRegEq(t, cpu, RegS0, CauseInterrupt|InterruptSupervisorTimer)
+	if cpu.GetReg(RegS1)&MipSTIP == 0 {
+		t.Errorf("expected STIP to be pending in the handler")
+	}
+	if cpu.GetReg(RegS2)&MipSTIP != 0 {
+		t.Errorf("expected a new deadline to clear STIP")
+	}
+}
+
+func TestSbiOutputLimit(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a7, {{.putchar}}
+	li a0, 'a'
+	loop:
+	ecall
+	j loop
+	`).Execute(ProgArgs{"putchar": SbiConsolePutchar})
+	t.Log("prog: ", prog)
+	board := NewDebugBoard(assemble(t, prog))
+	board.board.EnableSbi()
+	board.board.SetLimits(0, 100)
+	if err := board.board.Run(); err != ErrOutputLimit {
+		t.Errorf("expected ErrOutputLimit got %v", err)
+	}
+	board.board.Flush()
+	if n := board.output.Len(); n != 100 {
+		t.Errorf("expected 100 bytes of output got %d", n)
+	}
+}
+
+const (
+	testSysWrite = 64
+	testSysExit  = 93
+)
+
+// testSyscalls implements just enough of write and exit for a guest
+type testSyscalls struct {
+	out  []uint8
+	code uint32
+}
+
+func (s *testSyscalls) HandleSbi(cpu *Cpu, call *SbiCall) uint32 {
+	switch call.Eid {
+	case testSysWrite:
+		for i := uint32(0); i < call.Args[2]; i++ {
+			s.out = append(s.out, cpu.LoadByte(call.Args[1]+i))
+		}
+		return call.Args[2]
+	case testSysExit:
+		s.code = call.Args[0]
+		cpu.Halt()
+		return 0
+	}
+	return uint32(SbiErrNotSupported & 0xffffffff)
+}
+
+func TestEcallRecorder(t *testing.T) {
+	prog := NewProgTemplate(`
+	li a0, 1
+	la a1, msg
+	li a2, 3
+	li a7, {{.write}}
+	ecall
+	li a0, 7
+	li a7, {{.exit}}
+	ecall
+	msg:
+	.ascii "hi\n"
+	`).Execute(ProgArgs{"write": testSysWrite, "exit": testSysExit})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	syscalls := &testSyscalls{}
+	recorder := &EcallRecorder{Handler: syscalls}
+	cpu.SetSbiHandler(recorder)
+	cpu.Reset()
+	cpu.Execute()
+
+	msg := cpu.initialAddr + 36
+	expected := []EcallRecord{
+		{cpu.initialAddr + 20, [8]uint32{1, msg, 3, 0, 0, 0, 0, testSysWrite}},
+		{cpu.initialAddr + 32, [8]uint32{7, msg, 3, 0, 0, 0, 0, testSysExit}},
+	}
+	if !reflect.DeepEqual(recorder.Calls(), expected) {
+		t.Errorf("expected ecalls %v got %v", expected, recorder.Calls())
+	}
+	if string(syscalls.out) != "hi\n" || syscalls.code != 7 {
+		t.Errorf("expected to write %q and exit with 7 got %q and %d",
+			"hi\n", syscalls.out, syscalls.code)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// CpuState holds the architectural state of a Cpu
+type CpuState struct {
+	Registers [32]uint32
+	Pc        uint32
+	Priv      uint32
+	Halt      bool
+	HaltValue uint32
+	Cycles    uint64
+	Ticks     uint64
+	Instret   uint64
+	Mtvec     uint32
+	Mcause    uint32
+	Mepc      uint32
+	Mtval     uint32
+	Mscratch  uint32
+	Mstatus   uint32
+	Mie       uint32
+	Medeleg   uint32
+	Mideleg   uint32
+	Stvec     uint32
+	Scause    uint32
+	Sepc      uint32
+	Stval     uint32
+	Sscratch  uint32
+	Satp      uint32
+	// mip and what it is recomputed from before every step
+	Mip      uint32
+	SoftIp   uint32
+	Injected uint32
+	Schedule []ScheduledInterrupt
+	Mtimecmp uint64
+	Stimecmp uint64
+	Msip     bool
+	// the LR/SC reservation
+	Reserved    bool
+	Reservation uint32
+	// what the run result reports
+	GuestHalt           bool
+	IllegalInstructions uint64
+}
+
+func (cpu *Cpu) getState() CpuState {
+	return CpuState{
+		Registers: [32]uint32(cpu.registers),
+		Pc:        cpu.pc,
+		Priv:      cpu.priv,
+		Halt:      cpu.halt,
+		HaltValue: cpu.haltValue,
+		Cycles:    cpu.cycles,
+		Ticks:     cpu.ticks,
+		Instret:   cpu.instret,
+		Mtvec:     cpu.mtvec,
+		Mcause:    cpu.mcause,
+		Mepc:      cpu.mepc,
+		Mtval:     cpu.mtval,
+		Mscratch:  cpu.mscratch,
+		Mstatus:   cpu.mstatus,
+		Mie:       cpu.mie,
+		Medeleg:   cpu.medeleg,
+		Mideleg:   cpu.mideleg,
+		Stvec:     cpu.stvec,
+		Scause:    cpu.scause,
+		Sepc:      cpu.sepc,
+		Stval:     cpu.stval,
+		Sscratch:  cpu.sscratch,
+		Satp:      cpu.satp,
+		Mip:       cpu.mip,
+		SoftIp:    cpu.softIp,
+		Injected:  cpu.injected,
+		// ScheduleInterrupt inserts in place, the state gets its own copy
+		Schedule:            append([]ScheduledInterrupt(nil), cpu.schedule...),
+		Mtimecmp:            cpu.mtimecmp,
+		Stimecmp:            cpu.stimecmp,
+		Msip:                cpu.msip,
+		Reserved:            cpu.reserved,
+		Reservation:         cpu.reservation,
+		GuestHalt:           cpu.guestHalt,
+		IllegalInstructions: cpu.illegalInstructions,
+	}
+}
+
+func (cpu *Cpu) setState(state *CpuState) {
+	cpu.registers = RegisterFile[uint32](state.Registers)
+	cpu.registers[0] = 0
+	cpu.pc = state.Pc
+	cpu.priv = state.Priv
+	cpu.halt = state.Halt
+	cpu.haltValue = state.HaltValue
+	cpu.cycles = state.Cycles
+	cpu.ticks = state.Ticks
+	cpu.instret = state.Instret
+	cpu.mtvec = state.Mtvec
+	cpu.mcause = state.Mcause
+	cpu.mepc = state.Mepc
+	cpu.mtval = state.Mtval
+	cpu.mscratch = state.Mscratch
+	cpu.mstatus = state.Mstatus
+	cpu.mie = state.Mie
+	cpu.medeleg = state.Medeleg
+	cpu.mideleg = state.Mideleg
+	cpu.stvec = state.Stvec
+	cpu.scause = state.Scause
+	cpu.sepc = state.Sepc
+	cpu.stval = state.Stval
+	cpu.sscratch = state.Sscratch
+	cpu.satp = state.Satp
+	cpu.mip = state.Mip
+	cpu.softIp = state.SoftIp
+	cpu.injected = state.Injected
+	cpu.schedule = append([]ScheduledInterrupt(nil), state.Schedule...)
+	cpu.mtimecmp = state.Mtimecmp
+	cpu.stimecmp = state.Stimecmp
+	cpu.msip = state.Msip
+	cpu.reserved = state.Reserved
+	cpu.reservation = state.Reservation
+	cpu.guestHalt = state.GuestHalt
+	cpu.illegalInstructions = state.IllegalInstructions
+}
+
+// Snapshot captures the architectural state of the cpu, memory is
+// captured separately, see Ram.Snapshot
+func (cpu *Cpu) Snapshot() CpuState {
+	return cpu.getState()
+}
+
+// Restore rolls the cpu back to a state captured by Snapshot, memory is
+// restored separately
+func (cpu *Cpu) Restore(state CpuState) {
+	cpu.setState(&state)
+	cpu.watchHit = nil
+	cpu.breakHit = false
+	// the memory may have been restored under the cached instructions
+	if cpu.icache != nil {
+		cpu.icache.flush()
+	}
+}
+
+// ExecuteOne applies a single instruction to state and returns the new
+// state. There is no memory attached and instead of trapping to mtvec
+// the exception is returned as an *Exception error.
+func ExecuteOne(state *CpuState, inst uint32) (*CpuState, error) {
+	cpu := New(NewMmu(), state.Pc)
+	cpu.setState(state)
+	// act as if we just fetched inst
+	cpu.instPc = cpu.pc
+	cpu.pc += 4
+	if exception := cpu.decode(inst); exception != nil {
+		return nil, exception
+	}
+
+	res := cpu.getState()
+	return &res, nil
+}
+
+// cpuJSON is the json form of CpuState, values are hex strings so the
+// output is easy to diff
+type cpuJSON struct {
+	Registers           map[string]string `json:"registers"`
+	Pc                  string            `json:"pc"`
+	Priv                string            `json:"priv"`
+	Halt                *bool             `json:"halt"`
+	HaltValue           string            `json:"haltValue"`
+	Cycles              string            `json:"cycles"`
+	Ticks               string            `json:"ticks"`
+	Instret             string            `json:"instret"`
+	Csrs                map[string]string `json:"csrs"`
+	SoftIp              string            `json:"softIp"`
+	Injected            string            `json:"injected"`
+	Schedule            []scheduleJSON    `json:"schedule"`
+	Mtimecmp            string            `json:"mtimecmp"`
+	Stimecmp            string            `json:"stimecmp"`
+	Msip                *bool             `json:"msip"`
+	Reserved            *bool             `json:"reserved"`
+	Reservation         string            `json:"reservation"`
+	GuestHalt           *bool             `json:"guestHalt"`
+	IllegalInstructions string            `json:"illegalInstructions"`
+}
+
+type scheduleJSON struct {
+	Instret   string `json:"instret"`
+	Interrupt uint32 `json:"interrupt"`
+}
+
+// the csr backed fields of CpuState by csr name
+func stateCsrs(state *CpuState) map[string]*uint32 {
+	return map[string]*uint32{
+		"mtvec":    &state.Mtvec,
+		"mcause":   &state.Mcause,
+		"mepc":     &state.Mepc,
+		"mtval":    &state.Mtval,
+		"mscratch": &state.Mscratch,
+		"mstatus":  &state.Mstatus,
+		"mie":      &state.Mie,
+		"mip":      &state.Mip,
+		"medeleg":  &state.Medeleg,
+		"mideleg":  &state.Mideleg,
+		"stvec":    &state.Stvec,
+		"scause":   &state.Scause,
+		"sepc":     &state.Sepc,
+		"stval":    &state.Stval,
+		"sscratch": &state.Sscratch,
+		"satp":     &state.Satp,
+	}
+}
+
+func hex32(v uint32) string {
+	return fmt.Sprintf("0x%08x", v)
+}
+
+func hex64(v uint64) string {
+	return fmt.Sprintf("0x%016x", v)
+}
+
+// parseHex parses the hex strings written by MarshalJSON, an empty string
+// is a missing field and leaves v as is
+func parseHex(name, s string, bits int, v *uint64) error {
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return fmt.Errorf("bad value for %s: %v", name, err)
+	}
+	*v = n
+	return nil
+}
+
+func parseHex32(name, s string, v *uint32) error {
+	n := uint64(*v)
+	if err := parseHex(name, s, 32, &n); err != nil {
+		return err
+	}
+	*v = uint32(n)
+	return nil
+}
+
+// MarshalJSON encodes the architectural state of the cpu, registers are
+// keyed by their ABI names
+func (cpu *Cpu) MarshalJSON() ([]byte, error) {
+	state := cpu.getState()
+	res := cpuJSON{
+		Registers: make(map[string]string, len(state.Registers)),
+		Pc:        hex32(state.Pc),
+		Priv:      hex32(state.Priv),
+		Halt:      &state.Halt,
+		HaltValue: hex32(state.HaltValue),
+		Cycles:    hex64(state.Cycles),
+		Ticks:     hex64(state.Ticks),
+		Instret:   hex64(state.Instret),
+		Csrs:      make(map[string]string),
+		SoftIp:    hex32(state.SoftIp),
+		Injected:  hex32(state.Injected),
+		// an empty list rather than null, so reading it back clears
+		// the schedule
+		Schedule:            make([]scheduleJSON, 0, len(state.Schedule)),
+		Mtimecmp:            hex64(state.Mtimecmp),
+		Stimecmp:            hex64(state.Stimecmp),
+		Msip:                &state.Msip,
+		Reserved:            &state.Reserved,
+		Reservation:         hex32(state.Reservation),
+		GuestHalt:           &state.GuestHalt,
+		IllegalInstructions: hex64(state.IllegalInstructions),
+	}
+	for _, s := range state.Schedule {
+		res.Schedule = append(res.Schedule,
+			scheduleJSON{hex64(s.Instret), s.Interrupt})
+	}
+	for i, v := range state.Registers {
+		if i == RegZero {
+			v = 0
+		}
+		res.Registers[_RegNames[i]] = hex32(v)
+	}
+	for name, v := range stateCsrs(&state) {
+		res.Csrs[name] = hex32(*v)
+	}
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON restores a state written by MarshalJSON as Restore does,
+// missing fields keep their current value and x0 is never written. A priv
+// that isn't one of the Priv* modes is rejected.
+func (cpu *Cpu) UnmarshalJSON(data []byte) error {
+	var in cpuJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	state := cpu.getState()
+	for name, s := range in.Registers {
+		reg := -1
+		for i, regName := range _RegNames {
+			if regName == name {
+				reg = i
+				break
+			}
+		}
+		if reg < 0 {
+			return fmt.Errorf("unknown register %q", name)
+		}
+		if reg == RegZero {
+			continue
+		}
+		if err := parseHex32(name, s, &state.Registers[reg]); err != nil {
+			return err
+		}
+	}
+	csrs := stateCsrs(&state)
+	for name, s := range in.Csrs {
+		v, ok := csrs[name]
+		if !ok {
+			return fmt.Errorf("unknown csr %q", name)
+		}
+		if err := parseHex32(name, s, v); err != nil {
+			return err
+		}
+	}
+	if err := parseHex32("pc", in.Pc, &state.Pc); err != nil {
+		return err
+	}
+	if err := parseHex32("priv", in.Priv, &state.Priv); err != nil {
+		return err
+	}
+	switch state.Priv {
+	case PrivUser, PrivSupervisor, PrivMachine:
+	default:
+		return fmt.Errorf("bad value for priv: %w", ErrInvalidPrivilege)
+	}
+	for _, field := range []struct {
+		name string
+		s    string
+		v    *uint32
+	}{
+		{"haltValue", in.HaltValue, &state.HaltValue},
+		{"softIp", in.SoftIp, &state.SoftIp},
+		{"injected", in.Injected, &state.Injected},
+		{"reservation", in.Reservation, &state.Reservation},
+	} {
+		if err := parseHex32(field.name, field.s, field.v); err != nil {
+			return err
+		}
+	}
+	for _, counter := range []struct {
+		name string
+		s    string
+		v    *uint64
+	}{
+		{"cycles", in.Cycles, &state.Cycles},
+		{"ticks", in.Ticks, &state.Ticks},
+		{"instret", in.Instret, &state.Instret},
+		{"mtimecmp", in.Mtimecmp, &state.Mtimecmp},
+		{"stimecmp", in.Stimecmp, &state.Stimecmp},
+		{"illegalInstructions", in.IllegalInstructions, &state.IllegalInstructions},
+	} {
+		if err := parseHex(counter.name, counter.s, 64, counter.v); err != nil {
+			return err
+		}
+	}
+	if in.Schedule != nil {
+		state.Schedule = nil
+		for _, s := range in.Schedule {
+			scheduled := ScheduledInterrupt{Interrupt: s.Interrupt}
+			if err := parseHex("schedule", s.Instret, 64, &scheduled.Instret); err != nil {
+				return err
+			}
+			state.Schedule = append(state.Schedule, scheduled)
+		}
+	}
+	for _, flag := range []struct {
+		in *bool
+		v  *bool
+	}{
+		{in.Halt, &state.Halt},
+		{in.Msip, &state.Msip},
+		{in.Reserved, &state.Reserved},
+		{in.GuestHalt, &state.GuestHalt},
+	} {
+		if flag.in != nil {
+			*flag.v = *flag.in
+		}
+	}
+	cpu.Restore(state)
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestExecuteOne(t *testing.T) {
+	for i := 0; i < FUZZ_ITER; i++ {
+		rd := randReg()
+		rs1 := randReg()
+		imm := rand.Int31()%0xfff - 0x800
+		rs1v := rand.Uint32()
+		// addi rd, rs1, imm
+		inst := uint32(imm)<<20 | uint32(rs1)<<15 | uint32(rd)<<7 | OP_IMM
+		state := &CpuState{Pc: 0x100, Priv: PrivMachine}
+		state.Registers[rs1] = rs1v
+		res, err := ExecuteOne(state, inst)
+		if err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+		expected := rs1v + sextend(imm)
+		if res.Registers[rd] != expected {
+			t.Errorf("expected x%d to be 0x%08x got 0x%08x",
+				rd, expected, res.Registers[rd])
+		}
+		if res.Pc != 0x104 {
+			t.Errorf("expected pc 0x104 got 0x%08x", res.Pc)
+		}
+		if res.Instret != 1 {
+			t.Errorf("expected instret 1 got %d", res.Instret)
+		}
+		if state.Registers[rd] != 0 && rd != rs1 {
+			t.Errorf("input state was modified")
+		}
+	}
+}
+
+func TestExecuteOneException(t *testing.T) {
+	state := &CpuState{Pc: 0x100, Priv: PrivMachine, Mtvec: 0x200}
+	// ebreak
+	res, err := ExecuteOne(state, 0x00100073)
+	if res != nil {
+		t.Errorf("expected no state on exception")
+	}
+	exception, ok := err.(*Exception)
+	if !ok {
+		t.Fatalf("expected an *Exception got %v", err)
+	}
+	if exception.Cause != ExceptionBreakpoint {
+		t.Errorf("expected cause %d got %d", ExceptionBreakpoint, exception.Cause)
+	}
+	if exception.Tval != 0x100 {
+		t.Errorf("expected tval 0x100 got 0x%08x", exception.Tval)
+	}
+}
+
+func TestSystemDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		inst  uint32
+		cause uint32
+		trap  bool
+		// the pc and a0 after the instruction when it doesn't trap
+		pc, a0 uint32
+	}{
+		{"ecall", 0x00000073, ExceptionEcallM, true, 0, 0},
+		{"ebreak", 0x00100073, ExceptionBreakpoint, true, 0, 0},
+		{"mret", 0x30200073, 0, false, 0x200, 0},
+		{"sret", 0x10200073, 0, false, 0x300, 0},
+		{"sfence.vma", 0x12000073, 0, false, 0x104, 0},
+		{"wfi", 0x10500073, 0, false, 0x104, 0},
+		{"csrrs a0, mscratch, x0", 0x34002573, 0, false, 0x104, 5},
+		// funct3 4 is reserved
+		{"reserved funct3", 0x00004073, ExceptionIllegalInstruction, true, 0, 0},
+		// an unknown privileged instruction
+		{"reserved imm", 0x7ff00073, ExceptionIllegalInstruction, true, 0, 0},
+		// ecall with rd set
+		{"ecall with rd", 0x000000f3, ExceptionIllegalInstruction, true, 0, 0},
+		// ebreak with rs1 set
+		{"ebreak with rs1", 0x00108073, ExceptionIllegalInstruction, true, 0, 0},
+		// wfi with rd set
+		{"wfi with rd", 0x105000f3, ExceptionIllegalInstruction, true, 0, 0},
+	}
+	for _, test := range tests {
+		state := &CpuState{Pc: 0x100, Priv: PrivMachine, Mscratch: 5,
+			Mepc: 0x200, Sepc: 0x300}
+		res, err := ExecuteOne(state, test.inst)
+		if !test.trap {
+			if err != nil {
+				t.Errorf("%s: unexpected exception %v", test.name, err)
+				continue
+			}
+			if res.Pc != test.pc {
+				t.Errorf("%s: expected pc 0x%x got 0x%x",
+					test.name, test.pc, res.Pc)
+			}
+			if res.Registers[RegA0] != test.a0 {
+				t.Errorf("%s: expected a0 %d got %d",
+					test.name, test.a0, res.Registers[RegA0])
+			}
+			continue
+		}
+		exception, ok := err.(*Exception)
+		if !ok {
+			t.Errorf("%s: expected an *Exception got %v", test.name, err)
+			continue
+		}
+		if exception.Cause != test.cause {
+			t.Errorf("%s: expected cause %d got %d",
+				test.name, test.cause, exception.Cause)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	prog := `
+	la t0, counter
+	la t1, handler
+	csrrw x0, mtvec, t1
+	loop:
+	lw a0, 0(t0)
+	addi a0, a0, 1
+	sw a0, 0(t0)
+	ecall
+	j loop
+	handler:
+	csrrw x0, mscratch, a0
+	csrrs t2, mepc, x0
+	addi t2, t2, 4
+	csrrw x0, mepc, t2
+	mret
+	counter:
+	.word 0
+	`
+	t.Log("prog: ", prog)
+	ram := NewRamFromBuffer(assemble(t, prog))
+	mmu := NewMmu()
+	mmu.AddRange(BoardInitialAddr, uint32(len(ram.memory)), ram)
+	cpu := New(mmu, BoardInitialAddr)
+	cpu.EnableInstructionCache(true)
+	for i := 0; i < 10; i++ {
+		cpu.Step()
+	}
+	state := cpu.Snapshot()
+	memory := ram.Snapshot()
+
+	for i := 0; i < 50; i++ {
+		cpu.Step()
+	}
+	after := cpu.Snapshot()
+	afterMemory := ram.Snapshot()
+	if reflect.DeepEqual(after, state) || bytes.Equal(afterMemory, memory) {
+		t.Fatalf("expected the run to change the machine state")
+	}
+
+	cpu.Restore(state)
+	ram.Restore(memory)
+	if !reflect.DeepEqual(cpu.Snapshot(), state) || !bytes.Equal(ram.Snapshot(), memory) {
+		t.Errorf("restore didn't bring back the snapshot")
+	}
+
+	// running again from the snapshot ends up in the same state
+	for i := 0; i < 50; i++ {
+		cpu.Step()
+	}
+	if !reflect.DeepEqual(cpu.Snapshot(), after) {
+		t.Errorf("expected state %+v got %+v", after, cpu.Snapshot())
+	}
+	if !bytes.Equal(ram.Snapshot(), afterMemory) {
+		t.Errorf("expected the same memory after running again")
+	}
+}
+
+func TestCpuJSON(t *testing.T) {
+	prog := NewProgTemplate(`
+	nop
+	`).Execute(nil)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := uint8(1); i < 32; i++ {
+		cpu.SetReg(i, uint32(i)*0x01010101)
+	}
+	csrs := []uint32{
+		CsrTvec | CsrM, CsrCause | CsrM, CsrEpc | CsrM, CsrTval | CsrM,
+		CsrScratch | CsrM, CsrStatus | CsrM, CsrIe | CsrM,
+	}
+	for i, csr := range csrs {
+		cpu.SetCsr(csr, uint32(i+1)*8)
+	}
+	// mstatus and mie only keep their defined bits
+	cpu.SetCsr(CsrStatus|CsrM, MstatusMPIE)
+	cpu.SetCsr(CsrIe|CsrM, MipMTIP)
+	cpu.Step()
+
+	data, err := json.Marshal(cpu)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	t.Log("json: ", string(data))
+
+	fresh := NewDebugBoard(assemble(t, prog)).Cpu()
+	if err := json.Unmarshal(data, fresh); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	for i := uint8(0); i < 32; i++ {
+		assertRegEq(t, fresh, i, cpu.GetReg(i))
+	}
+	assertPcEq(t, fresh, cpu.Pc())
+	for _, csr := range append(csrs, CsrCycle, CsrInstret, CsrTime) {
+		v, _ := cpu.GetCsr(csr)
+		assertCsrEq(t, fresh, csr, v)
+	}
+
+	// x0 is never loaded
+	if err := json.Unmarshal([]byte(`{"registers":{"zero":"0x5","a0":"0x7"}}`), fresh); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	assertRegEq(t, fresh, RegZero, 0)
+	assertRegEq(t, fresh, RegA0, 7)
+
+	if err := json.Unmarshal([]byte(`{"registers":{"x32":"0x1"}}`), fresh); err == nil {
+		t.Errorf("expected an error for an unknown register")
+	}
+
+	// flags missing from the json keep their value
+	fresh.halt = true
+	fresh.msip = true
+	if err := json.Unmarshal([]byte(`{"msip":false}`), fresh); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if !fresh.halt || fresh.msip {
+		t.Errorf("expected halt to be kept and msip cleared got halt %v msip %v",
+			fresh.halt, fresh.msip)
+	}
+
+	// the reserved privilege mode is rejected
+	err = json.Unmarshal([]byte(`{"priv":"0x2"}`), fresh)
+	if !errors.Is(err, ErrInvalidPrivilege) {
+		t.Errorf("expected %v for the reserved privilege mode got %v",
+			ErrInvalidPrivilege, err)
+	}
+	if fresh.GetPrivilege() != cpu.GetPrivilege() {
+		t.Errorf("expected privilege %d to be kept got %d",
+			cpu.GetPrivilege(), fresh.GetPrivilege())
+	}
+}
+
+func TestStateRoundTripPendingInterrupt(t *testing.T) {
+	prog := NewProgTemplate(`
+	nop
+	`).Execute(nil)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetCsr(CsrIp|CsrM, MipSSIP)
+	cpu.ScheduleInterrupt(100, InterruptMachineExternal)
+	cpu.ScheduleInterrupt(200, InterruptSupervisorExternal)
+	cpu.mtimecmp = 0
+	cpu.stimecmp = 0x100000000
+	cpu.msip = true
+	cpu.reserved = true
+	cpu.reservation = 0x200
+	cpu.guestHalt = true
+	cpu.illegalInstructions = 3
+	cpu.Step()
+	state := cpu.Snapshot()
+	if state.Mip&(MipSSIP|MipMTIP|MipMSIP) != MipSSIP|MipMTIP|MipMSIP {
+		t.Fatalf("expected pending interrupts got mip 0x%x", state.Mip)
+	}
+
+	fresh := NewDebugBoard(assemble(t, prog)).Cpu()
+	fresh.Restore(state)
+	if !reflect.DeepEqual(fresh.Snapshot(), state) {
+		t.Errorf("expected state %+v got %+v", state, fresh.Snapshot())
+	}
+
+	data, err := json.Marshal(cpu)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	t.Log("json: ", string(data))
+	fresh = NewDebugBoard(assemble(t, prog)).Cpu()
+	if err := json.Unmarshal(data, fresh); err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if !reflect.DeepEqual(fresh.Snapshot(), state) {
+		t.Errorf("expected state %+v got %+v", state, fresh.Snapshot())
+	}
+
+	// the schedule belongs to the snapshot, later changes don't leak in
+	cpu.ScheduleInterrupt(50, InterruptMachineSoftware)
+	if len(state.Schedule) != 2 || state.Schedule[0].Instret != 100 {
+		t.Errorf("expected the snapshot's schedule to stay as is got %v",
+			state.Schedule)
+	}
+}
+
+func TestStepBackInterruptState(t *testing.T) {
+	prog := NewProgTemplate(`
+	li t0, {{.ssip}}
+	li t1, {{.mtimecmp}}
+	li t2, 1000
+	csrrs x0, mip, t0
+	sw t2, 0(t1)
+	`).Execute(ProgArgs{
+		"ssip":     MipSSIP,
+		"mtimecmp": BoardClintAddr + ClintMtimecmp,
+	})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for cpu.Pc() != BoardInitialAddr+4*4 {
+		cpu.Step()
+	}
+	cpu.EnableJournal(4)
+	before := cpu.Snapshot()
+	cpu.Step()
+	cpu.Step()
+	if cpu.softIp != MipSSIP || uint32(cpu.mtimecmp) != 1000 {
+		t.Fatalf("expected the writes to happen got sip 0x%x mtimecmp %d",
+			cpu.softIp, cpu.mtimecmp)
+	}
+	for i := 0; i < 2; i++ {
+		if err := cpu.StepBack(); err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+	}
+	if !reflect.DeepEqual(cpu.Snapshot(), before) {
+		t.Errorf("expected state %+v got %+v", before, cpu.Snapshot())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+// the mstatus fields visible through sstatus
+const _SstatusMask = MstatusSIE | MstatusSPIE | MstatusSPP | MstatusSUM | MstatusMXR
+
+// every exception can be delegated but an ecall from machine mode, which
+// is never taken below it
+const _DelegableExceptions = 1<<ExceptionInstructionAddressMisaligned |
+	1<<ExceptionInstructionAccessFault |
+	1<<ExceptionIllegalInstruction |
+	1<<ExceptionBreakpoint |
+	1<<ExceptionLoadAddressMisaligned |
+	1<<ExceptionLoadAccessFault |
+	1<<ExceptionStoreAddressMisaligned |
+	1<<ExceptionStoreAccessFault |
+	1<<ExceptionEcallU |
+	1<<ExceptionEcallS |
+	1<<ExceptionInstructionPageFault |
+	1<<ExceptionLoadPageFault |
+	1<<ExceptionStorePageFault
+
+// machine interrupts are always handled in machine mode
+const _DelegableInterrupts = MipSSIP | MipSTIP | MipSEIP
+
+const _ImplementedInterrupts = _DelegableInterrupts | MipMSIP | MipMTIP | MipMEIP
+
+// the order simultaneous interrupts are taken in
+var _InterruptPriority = []uint32{
+	InterruptMachineExternal,
+	InterruptMachineSoftware,
+	InterruptMachineTimer,
+	InterruptSupervisorExternal,
+	InterruptSupervisorSoftware,
+	InterruptSupervisorTimer,
+}
+
+func isSupervisorCsr(csr uint32) bool {
+	switch csr {
+	case CsrStatus,
+		CsrIe,
+		CsrIp,
+		CsrTvec,
+		CsrTval,
+		CsrCause,
+		CsrEpc,
+		CsrScratch,
+		CsrAtp:
+
+		return true
+	}
+	return false
+}
+
+// getSupervisorCsr reads a supervisor csr, sstatus, sie and sip are
+// restricted views of their machine counterparts
+func (cpu *Cpu) getSupervisorCsr(csr uint32) uint32 {
+	switch csr {
+	case CsrStatus:
+		return cpu.mstatus & _SstatusMask
+	case CsrIe:
+		return cpu.mie & cpu.mideleg
+	case CsrIp:
+		cpu.updateInterrupts()
+		return cpu.mip & cpu.mideleg
+	case CsrTvec:
+		return cpu.stvec
+	case CsrTval:
+		return cpu.stval
+	case CsrCause:
+		return cpu.scause
+	case CsrEpc:
+		return cpu.sepc
+	case CsrScratch:
+		return cpu.sscratch
+	case CsrAtp:
+		return cpu.satp
+	}
+	return 0
+}
+
+func (cpu *Cpu) setSupervisorCsr(csr uint32, v uint32) {
+	switch csr {
+	case CsrStatus:
+		cpu.mstatus = cpu.mstatus&^_SstatusMask | v&_SstatusMask
+	case CsrIe:
+		cpu.mie = cpu.mie&^cpu.mideleg | v&cpu.mideleg
+	case CsrIp:
+		// only the software interrupt can be raised from supervisor mode
+		mask := cpu.mideleg & MipSSIP
+		cpu.softIp = cpu.softIp&^mask | v&mask
+	case CsrTvec:
+		cpu.stvec = v & 0xfffffffc
+	case CsrTval:
+		cpu.stval = v
+	case CsrCause:
+		cpu.scause = v
+	case CsrEpc:
+		cpu.sepc = v & 0xfffffffe
+	case CsrScratch:
+		cpu.sscratch = v
+	case CsrAtp:
+		// there is a single address space, the ASID reads as 0
+		cpu.satp = v & (SatpModeSv32 | SatpPpn)
+	}
+}
+
+// enterSupervisorTrap is enterTrap for traps delegated to supervisor
+// mode, SPP only tells user from supervisor mode
+func (cpu *Cpu) enterSupervisorTrap() {
+	cpu.reserved = false
+	cpu.mstatus &= ^uint32(MstatusSPIE | MstatusSPP)
+	if cpu.mstatus&MstatusSIE != 0 {
+		cpu.mstatus |= MstatusSPIE
+	}
+	cpu.mstatus &= ^uint32(MstatusSIE)
+	if cpu.priv == PrivSupervisor {
+		cpu.mstatus |= MstatusSPP
+	}
+	cpu.priv = PrivSupervisor
+}
+
+// leaveSupervisorTrap undoes enterSupervisorTrap on sret
+func (cpu *Cpu) leaveSupervisorTrap() {
+	cpu.reserved = false
+	cpu.mstatus &= ^uint32(MstatusSIE)
+	if cpu.mstatus&MstatusSPIE != 0 {
+		cpu.mstatus |= MstatusSIE
+	}
+	cpu.mstatus |= MstatusSPIE
+	cpu.priv = PrivUser
+	if cpu.mstatus&MstatusSPP != 0 {
+		cpu.priv = PrivSupervisor
+	}
+	cpu.mstatus &= ^uint32(MstatusSPP)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDelegatedTrap(t *testing.T) {
+	prog := NewProgTemplate(`
+	la s9, user
+	la t0, mhandler
+	csrrw x0, mtvec, t0
+	la t0, shandler
+	csrrw x0, stvec, t0
+	li t0, {{.deleg}}
+	csrrw x0, medeleg, t0
+	li t0, {{.sie}}
+	csrrw x0, sstatus, t0
+	csrrw x0, mepc, s9
+	mret
+	user:
+	ecall
+	li a4, 5
+	ebreak
+	shandler:
+	csrrs a0, scause, x0
+	csrrs a1, sepc, x0
+	csrrs a2, sstatus, x0
+	addi t0, a1, 4
+	csrrw x0, sepc, t0
+	sret
+	mhandler:
+	csrrs a3, mcause, x0
+	csrrs s1, mstatus, x0
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(ProgArgs{
+		"deleg": 1 << ExceptionEcallU,
+		"sie":   MstatusSIE,
+	})
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	for i := 0; i < 100 && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	if !cpu.halt {
+		t.Fatal("expected the machine handler to halt")
+	}
+	// the ecall from user mode went to the supervisor
+	assertRegEq(t, cpu, RegA0, ExceptionEcallU)
+	assertRegEq(t, cpu, RegA1, cpu.GetReg(RegS9))
+	assertRegEq(t, cpu, RegA2, MstatusSPIE)
+	// the machine state wasn't touched by it
+	assertCsrEq(t, cpu, CsrEpc|CsrM, cpu.GetReg(RegS9)+8)
+	// sret returned to user mode with interrupts enabled again
+	assertRegEq(t, cpu, RegA4, 5)
+	// the ebreak isn't delegated
+	assertRegEq(t, cpu, RegA3, ExceptionBreakpoint)
+	assertRegEq(t, cpu, RegS1, MstatusSIE|MstatusSPIE|PrivUser<<MstatusMPPShift)
+	assertCsrEq(t, cpu, CsrCause|CsrS, ExceptionEcallU)
+}
+
+func TestSupervisorCsrs(t *testing.T) {
+	prog := NewProgTemplate(`nop`).Execute(nil)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	cpu.SetCsr(CsrStatus|CsrM, MstatusMIE)
+	cpu.SetCsr(CsrStatus|CsrS, 0xffffffff)
+	// sstatus only reaches its own fields of mstatus
+	assertCsrEq(t, cpu, CsrStatus|CsrS, _SstatusMask)
+	assertCsrEq(t, cpu, CsrStatus|CsrM, MstatusMIE|_SstatusMask)
+
+	// satp has no ASID
+	cpu.SetCsr(CsrAtp|CsrS, 0xffffffff)
+	assertCsrEq(t, cpu, CsrAtp|CsrS, SatpModeSv32|SatpPpn)
+
+	// sie only reaches the delegated interrupts
+	cpu.SetCsr(CsrIdeleg|CsrM, 0xffffffff)
+	assertCsrEq(t, cpu, CsrIdeleg|CsrM, MipSSIP|MipSTIP|MipSEIP)
+	cpu.SetCsr(CsrIe|CsrM, MieMTIE)
+	cpu.SetCsr(CsrIe|CsrS, 0xffffffff)
+	assertCsrEq(t, cpu, CsrIe|CsrS, MieSSIE|MieSTIE|MieSEIE)
+	assertCsrEq(t, cpu, CsrIe|CsrM, MieMTIE|MieSSIE|MieSTIE|MieSEIE)
+
+	// an ecall from machine mode can't be delegated
+	cpu.SetCsr(CsrEdeleg|CsrM, 0xffffffff)
+	if v, _ := cpu.GetCsr(CsrEdeleg | CsrM); v&(1<<ExceptionEcallM) != 0 {
+		t.Errorf("ecall from machine mode was delegated")
+	}
+
+	for _, csr := range []uint32{CsrTvec, CsrEpc, CsrCause, CsrTval, CsrScratch} {
+		if !cpu.IsValidCsr(csr | CsrS) {
+			t.Errorf("expected %s to be valid", CsrName(csr|CsrS))
+		}
+	}
+}
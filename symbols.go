@@ -0,0 +1,91 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type Symbol struct {
+	Name string
+	Addr uint32
+	Size uint32
+}
+
+// SymbolTable maps addresses back to the code and data labels of an elf
+type SymbolTable struct {
+	// sorted by address
+	symbols []Symbol
+}
+
+// LoadSymbols reads the symbol table of an elf, assembler local labels
+// and symbols that aren't tied to a section are left out
+func LoadSymbols(r io.ReaderAt) (*SymbolTable, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	elfSymbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+
+	table := &SymbolTable{}
+	for _, sym := range elfSymbols {
+		switch elf.ST_TYPE(sym.Info) {
+		case elf.STT_FUNC, elf.STT_OBJECT, elf.STT_NOTYPE:
+		default:
+			continue
+		}
+		if sym.Section == elf.SHN_UNDEF || sym.Section >= elf.SHN_LORESERVE {
+			continue
+		}
+		if sym.Name == "" || strings.HasPrefix(sym.Name, ".L") ||
+			strings.HasPrefix(sym.Name, "$") {
+			continue
+		}
+		table.symbols = append(table.symbols, Symbol{
+			Name: sym.Name,
+			Addr: uint32(sym.Value),
+			Size: uint32(sym.Size),
+		})
+	}
+	sort.SliceStable(table.symbols, func(i, j int) bool {
+		return table.symbols[i].Addr < table.symbols[j].Addr
+	})
+
+	return table, nil
+}
+
+// SymbolFor returns the symbol addr falls in and the offset into it, a
+// symbol with no size is assumed to extend up to the next one
+func (table *SymbolTable) SymbolFor(addr uint32) (string, uint32, bool) {
+	i := sort.Search(len(table.symbols), func(i int) bool {
+		return table.symbols[i].Addr > addr
+	}) - 1
+	if i < 0 {
+		return "", 0, false
+	}
+
+	sym := table.symbols[i]
+	if sym.Size != 0 && addr-sym.Addr >= sym.Size {
+		return "", 0, false
+	}
+	return sym.Name, addr - sym.Addr, true
+}
+
+// Annotate renders addr along with its symbol, e.g. 0x00000104 <main+0x4>
+func (table *SymbolTable) Annotate(addr uint32) string {
+	name, offset, ok := table.SymbolFor(addr)
+	if !ok {
+		return fmt.Sprintf("0x%08x", addr)
+	}
+	if offset == 0 {
+		return fmt.Sprintf("0x%08x <%s>", addr, name)
+	}
+	return fmt.Sprintf("0x%08x <%s+0x%x>", addr, name, offset)
+}
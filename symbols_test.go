@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSymbolFor(t *testing.T) {
+	prog := `
+	.globl _start
+	.type _start, @function
+	_start:
+	nop
+	nop
+	.size _start, .-_start
+	.globl main
+	.type main, @function
+	main:
+	nop
+	nop
+	nop
+	.size main, .-main
+	`
+	dir, err := ioutil.TempDir("", "riscv_symbols_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// link at 0 so the addresses are the same whether or not the elf
+	// gets relocated
+	f, err := os.Open(assembleElf(t, dir, prog, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	symbols, err := LoadSymbols(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr   uint32
+		name   string
+		offset uint32
+		ok     bool
+	}{
+		{0x0, "_start", 0, true},
+		{0x4, "_start", 4, true},
+		{0x8, "main", 0, true},
+		{0x10, "main", 8, true},
+		{0x14, "", 0, false},
+	}
+	for _, test := range tests {
+		name, offset, ok := symbols.SymbolFor(test.addr)
+		if name != test.name || offset != test.offset || ok != test.ok {
+			t.Errorf("0x%08x: expected (%q, %d, %v) got (%q, %d, %v)",
+				test.addr, test.name, test.offset, test.ok, name, offset, ok)
+		}
+	}
+	if s := symbols.Annotate(0xc); s != "0x0000000c <main+0x4>" {
+		t.Errorf("unexpected annotation %q", s)
+	}
+}
@@ -0,0 +1,12 @@
+int value = 40;
+static int counter;
+// volatile so the address is taken through auipc instead of folded away
+int *volatile ptr;
+
+int main(void)
+{
+	ptr = &value;
+	*ptr += 1;
+	counter = *ptr + 1;
+	return counter;
+}
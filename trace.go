@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RegisterDelta is a register changed by a step
+type RegisterDelta struct {
+	Reg uint8
+	Old uint32
+	New uint32
+}
+
+// RegisterDeltas returns the registers that differ between s and next
+func (s *CpuState) RegisterDeltas(next *CpuState) []RegisterDelta {
+	var deltas []RegisterDelta
+	for i := range s.Registers {
+		if s.Registers[i] != next.Registers[i] {
+			deltas = append(deltas,
+				RegisterDelta{uint8(i), s.Registers[i], next.Registers[i]})
+		}
+	}
+	return deltas
+}
+
+// TraceHook is called after every step with the address of the executed
+// instruction and the state before and after it
+type TraceHook func(pc uint32, before, after *CpuState)
+
+func (cpu *Cpu) SetTraceHook(hook TraceHook) {
+	cpu.traceHook = hook
+}
+
+// StepHook is called on every step after the instruction is fetched and
+// before it executes, compressed instructions are passed expanded
+type StepHook func(pc, inst uint32)
+
+func (cpu *Cpu) SetStepHook(hook StepHook) {
+	cpu.stepHook = hook
+}
+
+// TrapHook is called when a trap is taken with its cause and tval and the
+// address it returns to
+type TrapHook func(cause, tval, pc uint32)
+
+func (cpu *Cpu) SetTrapHook(hook TrapHook) {
+	cpu.trapHook = hook
+}
+
+// FormatTraceLine renders a step as the pc followed by the registers it
+// wrote, it is stable so traces can be compared as text
+func FormatTraceLine(pc uint32, before, after *CpuState) string {
+	record := TraceRecord{Pc: pc}
+	for _, d := range before.RegisterDeltas(after) {
+		record.Mask |= 1 << d.Reg
+		record.Values[d.Reg] = d.New
+	}
+	return record.String()
+}
+
+// TraceRecord is a step of a binary trace
+type TraceRecord struct {
+	Pc   uint32
+	Inst uint32
+	// a bit per register the step wrote, its new value is in Values
+	Mask   uint32
+	Values [32]uint32
+}
+
+// String renders the record like FormatTraceLine
+func (r *TraceRecord) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "0x%08x", r.Pc)
+	for i := range r.Values {
+		if r.Mask&(1<<uint(i)) != 0 {
+			fmt.Fprintf(&sb, " x%d=0x%08x", i, r.Values[i])
+		}
+	}
+	return sb.String()
+}
+
+// BinaryTraceWriter writes a trace as compact binary records for runs too
+// long for text traces. A record is the pc, the instruction and the mask
+// of written registers as little endian uint32s, followed by the new
+// value of each register in the mask.
+type BinaryTraceWriter struct {
+	cpu *Cpu
+	w   *bufio.Writer
+	err error
+}
+
+func NewBinaryTraceWriter(cpu *Cpu, w io.Writer) *BinaryTraceWriter {
+	return &BinaryTraceWriter{cpu: cpu, w: bufio.NewWriter(w)}
+}
+
+// Trace records a step, it is meant to be used as the cpu's TraceHook
+func (t *BinaryTraceWriter) Trace(pc uint32, before, after *CpuState) {
+	if t.err != nil {
+		return
+	}
+	inst, _ := t.cpu.loadInstruction(pc)
+	if inst&0x3 != 0x3 {
+		inst &= 0xffff
+	}
+	var mask uint32
+	deltas := before.RegisterDeltas(after)
+	for _, d := range deltas {
+		mask |= 1 << d.Reg
+	}
+	buf := make([]uint8, 12+4*len(deltas))
+	binary.LittleEndian.PutUint32(buf[0:], pc)
+	binary.LittleEndian.PutUint32(buf[4:], inst)
+	binary.LittleEndian.PutUint32(buf[8:], mask)
+	for i, d := range deltas {
+		binary.LittleEndian.PutUint32(buf[12+4*i:], d.New)
+	}
+	_, t.err = t.w.Write(buf)
+}
+
+// Flush writes out buffered records and returns the first write error
+func (t *BinaryTraceWriter) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.w.Flush()
+}
+
+// ReadTraceRecord reads the next record of a binary trace, it returns
+// io.EOF at the end of the trace
+func ReadTraceRecord(r io.Reader) (TraceRecord, error) {
+	var record TraceRecord
+	var header [12]uint8
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return record, fmt.Errorf("truncated trace record")
+		}
+		return record, err
+	}
+	record.Pc = binary.LittleEndian.Uint32(header[0:])
+	record.Inst = binary.LittleEndian.Uint32(header[4:])
+	record.Mask = binary.LittleEndian.Uint32(header[8:])
+	var value [4]uint8
+	for i := range record.Values {
+		if record.Mask&(1<<uint(i)) == 0 {
+			continue
+		}
+		if _, err := io.ReadFull(r, value[:]); err != nil {
+			return record, fmt.Errorf("truncated trace record")
+		}
+		record.Values[i] = binary.LittleEndian.Uint32(value[:])
+	}
+	return record, nil
+}
+
+// DecodeBinaryTrace renders a binary trace as text, a line per step in
+// the format of FormatTraceLine
+func DecodeBinaryTrace(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		record, err := ReadTraceRecord(br)
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(bw, record.String()); err != nil {
+			return err
+		}
+	}
+}
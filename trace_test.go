@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update-golden", false,
+	"rewrite the golden traces instead of comparing against them")
+
+// recordTrace runs the cpu until it halts or executed max steps and
+// returns its trace
+func recordTrace(cpu *Cpu, max int) []string {
+	var trace []string
+	cpu.SetTraceHook(func(pc uint32, before, after *CpuState) {
+		trace = append(trace, FormatTraceLine(pc, before, after))
+	})
+	for i := 0; i < max && !cpu.halt; i++ {
+		cpu.Step()
+	}
+	cpu.SetTraceHook(nil)
+	return trace
+}
+
+// compareTrace reports the first step where trace diverges from golden
+func compareTrace(golden, trace []string) error {
+	for i := 0; i < len(golden) && i < len(trace); i++ {
+		if golden[i] != trace[i] {
+			return fmt.Errorf("step %d diverged, expected %q got %q",
+				i, golden[i], trace[i])
+		}
+	}
+	if len(golden) != len(trace) {
+		return fmt.Errorf("expected %d steps got %d", len(golden), len(trace))
+	}
+	return nil
+}
+
+// checkGoldenTrace compares trace to the golden trace at path, the
+// golden trace is written if it doesn't exist yet or -update-golden is
+// given
+func checkGoldenTrace(t *testing.T, path string, trace []string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || *updateGolden {
+		t.Logf("writing golden trace %s", path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(strings.Join(trace, "\n") + "\n")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if err := compareTrace(golden, trace); err != nil {
+		t.Errorf("%s: %s", path, err)
+	}
+}
+
+const _TraceProg = `
+	li a0, 10
+	li a1, 0
+	li a2, 1
+	loop:
+	add a3, a1, a2
+	mv a1, a2
+	mv a2, a3
+	addi a0, a0, -1
+	bnez a0, loop
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`
+
+func TestGoldenTrace(t *testing.T) {
+	t.Log("prog: ", _TraceProg)
+	cpu := NewDebugBoard(assemble(t, _TraceProg)).Cpu()
+	checkGoldenTrace(t, "testdata/fibonacci.trace", recordTrace(cpu, 1000))
+}
+
+func TestGoldenTraceDivergence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fibonacci.trace")
+	cpu := NewDebugBoard(assemble(t, _TraceProg)).Cpu()
+	trace := recordTrace(cpu, 1000)
+	// the first run generates the golden trace and the second verifies it
+	checkGoldenTrace(t, path, trace)
+	checkGoldenTrace(t, path, trace)
+
+	diverged := append([]string{}, trace...)
+	diverged[5] += " x1=0x00000000"
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if err := compareTrace(golden, diverged); err == nil {
+		t.Errorf("expected a divergence at step 5")
+	}
+	if err := compareTrace(golden, trace[:len(trace)-1]); err == nil {
+		t.Errorf("expected a divergence for a shorter trace")
+	}
+}
+
+func TestBinaryTrace(t *testing.T) {
+	t.Log("prog: ", _TraceProg)
+	cpu := NewDebugBoard(assemble(t, _TraceProg)).Cpu()
+	var buf bytes.Buffer
+	tw := NewBinaryTraceWriter(cpu, &buf)
+	cpu.SetTraceHook(tw.Trace)
+	cpu.Execute()
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// li a0, 10
+	record, err := ReadTraceRecord(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TraceRecord{Pc: cpu.initialAddr, Inst: 0x00a00513, Mask: 1 << RegA0}
+	expected.Values[RegA0] = 10
+	if record != expected {
+		t.Errorf("expected first record %+v got %+v", expected, record)
+	}
+
+	var text strings.Builder
+	if err := DecodeBinaryTrace(bytes.NewReader(data), &text); err != nil {
+		t.Fatal(err)
+	}
+	golden, err := ioutil.ReadFile("testdata/fibonacci.trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text.String() != string(golden) {
+		t.Errorf("decoded trace doesn't match the text trace:\n%s", text.String())
+	}
+
+	err = DecodeBinaryTrace(bytes.NewReader(data[:len(data)-2]), ioutil.Discard)
+	if err == nil {
+		t.Errorf("expected an error decoding a truncated trace")
+	}
+}
+
+func TestStepAndTrapHooks(t *testing.T) {
+	prog := NewProgTemplate(`
+	la t0, handler
+	csrrw x0, mtvec, t0
+	ecall
+	handler:
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	`).Execute(nil)
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	var pcs []uint32
+	var insts []uint32
+	cpu.SetStepHook(func(pc, inst uint32) {
+		pcs = append(pcs, pc)
+		insts = append(insts, inst)
+	})
+	var traps [][3]uint32
+	cpu.SetTrapHook(func(cause, tval, pc uint32) {
+		traps = append(traps, [3]uint32{cause, tval, pc})
+	})
+	cpu.Execute()
+
+	expectedPcs := []uint32{0x100, 0x104, 0x108, 0x10c, 0x110, 0x114}
+	if !reflect.DeepEqual(pcs, expectedPcs) {
+		t.Errorf("expected pcs %x got %x", expectedPcs, pcs)
+	}
+	// ecall
+	if insts[3] != 0x00000073 {
+		t.Errorf("expected ecall at 0x10c got 0x%08x", insts[3])
+	}
+	expectedTraps := [][3]uint32{{ExceptionEcallM, 0x10c, 0x10c}}
+	if !reflect.DeepEqual(traps, expectedTraps) {
+		t.Errorf("expected traps %x got %x", expectedTraps, traps)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+// WatchKind selects the accesses a watchpoint triggers on
+type WatchKind uint8
+
+const (
+	WatchWrite WatchKind = 1 << iota
+	WatchRead
+	WatchAccess = WatchRead | WatchWrite
+)
+
+// Watchpoint halts the cpu when an instruction accesses memory in
+// [Addr, Addr+Size)
+type Watchpoint struct {
+	Addr uint32
+	Size uint32
+	Kind WatchKind
+}
+
+// WatchpointHit describes the access that triggered a watchpoint. The
+// access completes and the cpu halts after the instruction that made it.
+type WatchpointHit struct {
+	Watchpoint Watchpoint
+	Pc         uint32
+	Addr       uint32
+	Size       uint32
+	Kind       WatchKind
+}
+
+func (cpu *Cpu) AddWatchpoint(w Watchpoint) {
+	cpu.watchpoints = append(cpu.watchpoints, w)
+}
+
+// RemoveWatchpoint removes a watchpoint added with AddWatchpoint and
+// reports if it was found
+func (cpu *Cpu) RemoveWatchpoint(w Watchpoint) bool {
+	for i, v := range cpu.watchpoints {
+		if v == w {
+			cpu.watchpoints = append(cpu.watchpoints[:i], cpu.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// WatchpointHit returns the access that halted the cpu, or nil if it
+// wasn't halted by a watchpoint
+func (cpu *Cpu) WatchpointHit() *WatchpointHit {
+	return cpu.watchHit
+}
+
+// WatchpointCallback is called for every access that hits a watchpoint
+// with the value of the accessed bytes before and after the access, they
+// are the same for reads
+type WatchpointCallback func(hit WatchpointHit, old, new uint32)
+
+// SetWatchpointCallback makes watchpoint hits call cb instead of halting
+// the cpu, nil goes back to halting
+func (cpu *Cpu) SetWatchpointCallback(cb WatchpointCallback) {
+	cpu.watchCb = cb
+}
+
+// watch checks an access of n bytes at addr made by the executing
+// instruction against the watchpoints, stored is the value of a store
+func (cpu *Cpu) watch(addr uint32, n int, kind WatchKind, stored uint32) {
+	// only the guest's own accesses count, not peeks from the debugger
+	if !cpu.executingStep || cpu.watchHit != nil {
+		return
+	}
+	for _, w := range cpu.watchpoints {
+		if w.Kind&kind == 0 || addr >= w.Addr+w.Size || w.Addr >= addr+uint32(n) {
+			continue
+		}
+		hit := WatchpointHit{w, cpu.instPc, addr, uint32(n), kind}
+		if cpu.watchCb != nil {
+			old := cpu.peekValue(addr, n)
+			new := old
+			if kind == WatchWrite {
+				new = stored
+			}
+			cpu.watchCb(hit, old, new)
+			return
+		}
+		cpu.watchHit = &hit
+		cpu.halt = true
+		return
+	}
+}
+
+// peekValue reads the n bytes at addr without side effects, bytes that
+// aren't plain memory read as 0
+func (cpu *Cpu) peekValue(addr uint32, n int) uint32 {
+	if cpu.peeker == nil {
+		return 0
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, _ := cpu.peeker.PeekByte(addr + uint32(i))
+		v |= uint32(b) << (8 * uint(i))
+	}
+	return v
+}
+
+// ClearWatchpointHit lets a cpu halted by a watchpoint continue
+func (cpu *Cpu) ClearWatchpointHit() {
+	if cpu.watchHit != nil {
+		cpu.watchHit = nil
+		cpu.halt = false
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWriteWatchpoint(t *testing.T) {
+	prog := `
+	la t0, variable
+	lw t1, 0(t0)
+	addi t1, t1, 1
+	store:
+	sw t1, 0(t0)
+	addi t1, t1, 1
+	li t2, 1
+	csrrw x0, 0x3ff, t2
+	variable:
+	.word 41
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	// la is 2 instructions
+	storeAddr := cpu.initialAddr + 4*4
+	variable := cpu.initialAddr + 8*4
+	w := Watchpoint{Addr: variable, Size: 4, Kind: WatchWrite}
+	cpu.AddWatchpoint(w)
+	cpu.Execute()
+
+	hit := cpu.WatchpointHit()
+	if hit == nil {
+		t.Fatalf("expected a watchpoint hit")
+	}
+	expected := WatchpointHit{w, storeAddr, variable, 4, WatchWrite}
+	if *hit != expected {
+		t.Errorf("expected %+v got %+v", expected, *hit)
+	}
+	if cpu.Pc() != storeAddr+4 {
+		t.Errorf("expected to halt after the store at 0x%08x got 0x%08x",
+			storeAddr, cpu.Pc())
+	}
+	if v := cpu.LoadWord(variable); v != 42 {
+		t.Errorf("expected the store to complete, got %d", v)
+	}
+	assertRegEq(t, cpu, RegT1, 42)
+}
+
+func TestWatchpointCallback(t *testing.T) {
+	prog := `
+	la t0, variable
+	li t1, 0x11223344
+	sw t1, 0(t0)
+	li t1, 0x5566
+	sh t1, 2(t0)
+	li t1, 0x77
+	sb t1, 1(t0)
+	lw t2, 0(t0)
+	sw t1, 4(t0)
+	li t1, 1
+	csrrw x0, 0x3ff, t1
+	variable:
+	.word 41
+	.word 0
+	`
+	t.Log("prog: ", prog)
+	cpu := NewDebugBoard(assemble(t, prog)).Cpu()
+	variable := cpu.initialAddr + 14*4
+	cpu.AddWatchpoint(Watchpoint{Addr: variable, Size: 4, Kind: WatchAccess})
+
+	type access struct {
+		addr     uint32
+		size     uint32
+		kind     WatchKind
+		old, new uint32
+	}
+	var accesses []access
+	cpu.SetWatchpointCallback(func(hit WatchpointHit, old, new uint32) {
+		accesses = append(accesses, access{hit.Addr, hit.Size, hit.Kind, old, new})
+	})
+	cpu.Execute()
+
+	expected := []access{
+		{variable, 4, WatchWrite, 41, 0x11223344},
+		{variable + 2, 2, WatchWrite, 0x1122, 0x5566},
+		{variable + 1, 1, WatchWrite, 0x33, 0x77},
+		{variable, 4, WatchRead, 0x55667744, 0x55667744},
+	}
+	if !reflect.DeepEqual(accesses, expected) {
+		t.Errorf("expected accesses %x got %x", expected, accesses)
+	}
+	if cpu.WatchpointHit() != nil {
+		t.Errorf("a callback shouldn't halt the cpu")
+	}
+	assertRegEq(t, cpu, RegT2, 0x55667744)
+}
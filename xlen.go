@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Word is an unsigned integer XLEN bits wide, uint32 for RV32 and uint64
+// for RV64
+type Word interface {
+	~uint32 | ~uint64
+}
+
+// RegisterFile holds the integer registers of a hart, x0 is hardwired to 0
+type RegisterFile[T Word] [32]T
+
+func (r *RegisterFile[T]) Get(idx uint8) T {
+	if idx == 0 {
+		return 0
+	} else if idx > 0 && idx < 32 {
+		return r[idx]
+	}
+
+	panic(fmt.Sprint("invalid register ", idx))
+}
+
+func (r *RegisterFile[T]) Set(idx uint8, v T) {
+	if idx == 0 {
+		// do nothing
+	} else if idx > 0 && idx < 32 {
+		r[idx] = v
+	} else {
+		panic(fmt.Sprint("invalid register ", idx))
+	}
+}
+
+// signExtend copies bit into all the bits above it
+func signExtend[T Word](n T, bit uint) T {
+	if n&(1<<bit) != 0 {
+		n |= ^((1 << bit) - 1)
+	}
+
+	return n
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// the RV32 only sign extension used before XLEN was made generic
+func signExtend32(n uint32, bit uint) uint32 {
+	if n&(1<<bit) != 0 {
+		n |= ^((1 << bit) - 1)
+	}
+
+	return n
+}
+
+func TestSignExtendWidths(t *testing.T) {
+	for i := 0; i < FUZZ_ITER; i++ {
+		n := rand.Uint32()
+		bit := uint(rand.Intn(32))
+		expected := signExtend32(n, bit)
+		if v := signExtend(n, bit); v != expected {
+			t.Errorf("signExtend(0x%08x, %d): expected 0x%08x got 0x%08x",
+				n, bit, expected, v)
+		}
+		v64 := signExtend(uint64(n), bit)
+		if uint32(v64) != expected {
+			t.Errorf("64 bit signExtend(0x%08x, %d): expected low word 0x%08x got 0x%08x",
+				n, bit, expected, uint32(v64))
+		}
+		if high := uint32(v64 >> 32); high != 0 && high != 0xffffffff {
+			t.Errorf("64 bit signExtend(0x%08x, %d): bad high word 0x%08x",
+				n, bit, high)
+		}
+	}
+}
+
+func testRegisterFile[T Word](t *testing.T, v T) {
+	var regs RegisterFile[T]
+	regs.Set(0, v)
+	if regs.Get(0) != 0 {
+		t.Errorf("expected x0 to stay 0")
+	}
+	for i := uint8(1); i < 32; i++ {
+		regs.Set(i, v+T(i))
+	}
+	for i := uint8(1); i < 32; i++ {
+		if regs.Get(i) != v+T(i) {
+			t.Errorf("expected x%d to be 0x%x got 0x%x", i, v+T(i), regs.Get(i))
+		}
+	}
+}
+
+func TestRegisterFile(t *testing.T) {
+	testRegisterFile[uint32](t, 0xfffffff0)
+	testRegisterFile[uint64](t, 0xfffffffffffffff0)
+}